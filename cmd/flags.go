@@ -107,6 +107,7 @@ var (
 		cli.StringFlag{Name: "environment", Value: "ENVIRONMENT", Usage: "Specify additional environment variables in a file.", EnvVar: "WERCKER_ENVIRONMENT_FILE"},
 		cli.BoolFlag{Name: "verbose", Usage: "Print more information."},
 		cli.BoolFlag{Name: "no-colors", Usage: "Wercker output will not use colors (does not apply to step output)."},
+		cli.StringFlag{Name: "log-timestamps", Value: "", Usage: "Prefix output with a timestamp, either rfc3339 or relative."},
 		cli.BoolFlag{Name: "debug", Usage: "Print additional debug information."},
 		cli.BoolFlag{Name: "journal", Usage: "Send logs to systemd-journald. Suppresses stdout logging."},
 	}
@@ -124,6 +125,7 @@ var (
 		This enables:
 		- internal/watch
 		`},
+		cli.BoolFlag{Name: "allow-host-commands", Usage: "Allow internal/watch to run host-command on the host after each reload."},
 	}
 
 	// These flags are advanced build settings
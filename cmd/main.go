@@ -28,6 +28,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/codegangsta/cli"
@@ -309,6 +310,45 @@ var (
 		},
 	}
 
+	stepsCommand = cli.Command{
+		Name:  "steps",
+		Usage: "describe the internal steps",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "list the internal steps that declare their data keys",
+				Action: func(c *cli.Context) {
+					for _, id := range dockerlocal.DescribedSteps() {
+						fmt.Println(id)
+					}
+				},
+			},
+			{
+				Name:  "describe",
+				Usage: "list the data keys of an internal step, e.g. wercker steps describe watch",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output the data keys as JSON",
+					},
+				},
+				Action: func(c *cli.Context) {
+					settings := util.NewCLISettings(c)
+					env := util.NewEnvironment(os.Environ()...)
+					opts, err := core.NewStepsOptions(settings, env)
+					if err != nil {
+						cliLogger.Errorln("Invalid options\n", err)
+						os.Exit(1)
+					}
+					err = cmdDescribeStep(c.Args().First(), opts)
+					if err != nil {
+						cliLogger.Fatal(err)
+					}
+				},
+			},
+		},
+	}
+
 	documentCommand = func(app *cli.App) cli.Command {
 		return cli.Command{
 			Name:  "doc",
@@ -353,6 +393,7 @@ func GetApp() *cli.App {
 		logoutCommand,
 		pullCommand,
 		versionCommand,
+		stepsCommand,
 		documentCommand(app),
 	}
 	app.Before = func(ctx *cli.Context) error {
@@ -370,6 +411,8 @@ func GetApp() *cli.App {
 		// Register the global signal handler
 		util.GlobalSigint().Register(os.Interrupt)
 		util.GlobalSigterm().Register(unix.SIGTERM)
+		util.GlobalSigusr1().Register(unix.SIGUSR1)
+		util.GlobalSigusr2().Register(unix.SIGUSR2)
 		return nil
 	}
 	return app
@@ -738,6 +781,39 @@ func emitProgress(counter *util.CounterReader, total int64, logger *util.Logger)
 	return stop
 }
 
+// cmdDescribeStep prints the data keys of the internal step name, the
+// internal/ prefix may be left out
+func cmdDescribeStep(name string, options *core.StepsOptions) error {
+	if name == "" {
+		return fmt.Errorf("Which step? One of: %s", strings.Join(dockerlocal.DescribedSteps(), ", "))
+	}
+	id := name
+	if !strings.Contains(id, "/") {
+		id = "internal/" + id
+	}
+	keys, ok := dockerlocal.StepDataKeys(id)
+	if !ok {
+		return fmt.Errorf("%s doesn't declare its data keys, try one of: %s", name, strings.Join(dockerlocal.DescribedSteps(), ", "))
+	}
+
+	if options.OutputJSON {
+		b, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(b)
+		os.Stdout.WriteString("\n")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tTYPE\tDEFAULT\tUSAGE")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Name, key.Type, key.Default, key.Usage)
+	}
+	return w.Flush()
+}
+
 func cmdVersion(options *core.VersionOptions) error {
 	logger := util.RootLogger().WithField("Logger", "Main")
 
@@ -874,7 +950,7 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 	if err != nil {
 		return nil, err
 	}
-	f := &util.Formatter{options.GlobalOptions.ShowColors}
+	f := &util.Formatter{ShowColors: options.GlobalOptions.ShowColors, Timestamps: options.GlobalOptions.LogTimestamps}
 
 	// Set up the runner
 	r, err := NewRunner(cmdCtx, options, dockerOptions, getter)
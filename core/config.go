@@ -155,6 +155,32 @@ type StepConfig struct {
 	Checkpoint string
 }
 
+// StepDataKey describes a key a step reads from its data, Default is
+// written the way the key would be in the yaml
+type StepDataKey struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default,omitempty"`
+	Usage   string `json:"usage"`
+}
+
+// WithDefaults returns a copy of the step config with defaults filled in
+// for the data keys it doesn't set, keys set on the step itself always win
+func (c *StepConfig) WithDefaults(defaults map[string]string) *StepConfig {
+	if len(defaults) == 0 {
+		return c
+	}
+	merged := *c
+	merged.Data = make(map[string]string, len(defaults)+len(c.Data))
+	for k, v := range defaults {
+		merged.Data[k] = v
+	}
+	for k, v := range c.Data {
+		merged.Data[k] = v
+	}
+	return &merged
+}
+
 // ifaceToString takes a value from yaml and makes it a string (currently
 // supported: string, int, bool). Returns an empty string if the type is not
 // supported.
@@ -251,23 +277,27 @@ type RawPipelineConfig struct {
 
 // PipelineConfig is for any pipeline sections
 // StepsMap is for compat with the multiple deploy target configs
+// WatchDefaults are data for every internal/watch step in the pipeline, a
+// key set on the step itself overrides the default
 // TODO(termie): it would be great to deprecate this behavior and switch
 //               to multiple pipelines instead
 type PipelineConfig struct {
-	Box        *RawBoxConfig
-	Steps      RawStepsConfig
-	AfterSteps RawStepsConfig `yaml:"after-steps"`
-	StepsMap   map[string][]*RawStepConfig
-	Services   []*RawBoxConfig `yaml:"services"`
-	BasePath   string          `yaml:"base-path"`
+	Box           *RawBoxConfig
+	Steps         RawStepsConfig
+	AfterSteps    RawStepsConfig `yaml:"after-steps"`
+	StepsMap      map[string][]*RawStepConfig
+	Services      []*RawBoxConfig   `yaml:"services"`
+	BasePath      string            `yaml:"base-path"`
+	WatchDefaults map[string]string `yaml:"watch-defaults"`
 }
 
 var pipelineReservedWords = map[string]struct{}{
-	"box":         struct{}{},
-	"services":    struct{}{},
-	"steps":       struct{}{},
-	"after-steps": struct{}{},
-	"base-path":   struct{}{},
+	"box":            struct{}{},
+	"services":       struct{}{},
+	"steps":          struct{}{},
+	"after-steps":    struct{}{},
+	"base-path":      struct{}{},
+	"watch-defaults": struct{}{},
 }
 
 // UnmarshalYAML in this case is a little involved due to the myriad shapes our
@@ -130,3 +130,30 @@ func (s *ConfigSuite) TestIfaceToString() {
 		s.Equal(test.expected, actual, "")
 	}
 }
+
+func (s *ConfigSuite) TestConfigWatchDefaults() {
+	b, err := ioutil.ReadFile("../tests/watch_defaults.yml")
+	s.Nil(err)
+	config, err := ConfigFromYaml(b)
+	s.Require().Nil(err)
+
+	dev := config.PipelinesMap["dev"]
+	s.Equal(map[string]string{"reload": "true", "max-trigger-size": "1mb", "show-changes": "true"}, dev.WatchDefaults)
+	s.Equal(2, len(dev.Steps))
+	_, ok := dev.StepsMap["watch-defaults"]
+	s.False(ok, "watch-defaults is not a list of steps")
+
+	// The step's own keys take precedence over the defaults
+	api := dev.Steps[0].WithDefaults(dev.WatchDefaults)
+	s.Equal("go run ./api", api.Data["code"])
+	s.Equal("true", api.Data["reload"])
+	s.Equal("1mb", api.Data["max-trigger-size"])
+	s.Equal("false", api.Data["show-changes"])
+
+	web := dev.Steps[1].WithDefaults(dev.WatchDefaults)
+	s.Equal("false", web.Data["reload"])
+	s.Equal("true", web.Data["show-changes"])
+
+	// and the original config is left alone
+	s.Equal(2, len(dev.Steps[1].Data))
+}
@@ -19,6 +19,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/chuckpreslar/emission"
 	"github.com/wercker/wercker/util"
@@ -49,6 +50,23 @@ const (
 	// FullPipelineFinished occurs when a pipeline finishes all it's steps,
 	// included after-steps.
 	FullPipelineFinished = "FullPipelineFinished"
+
+	// WatchConfigured occurs when the watch step has resolved its
+	// configuration, before it runs anything.
+	WatchConfigured = "WatchConfigured"
+
+	// WatchReloadStarted occurs when the watch step starts a reload, only
+	// with reload on.
+	WatchReloadStarted = "WatchReloadStarted"
+
+	// WatchReloadFinished occurs when the code of a reload exited, or
+	// couldn't be started. Without an exit line to wait for, in a tmux
+	// session, it occurs once the code was started.
+	WatchReloadFinished = "WatchReloadFinished"
+
+	// WatchReloadComplete occurs once per run of the watch step's code, when
+	// it exits or is stopped for the next reload or the end of the step.
+	WatchReloadComplete = "WatchReloadComplete"
 )
 
 // BuildStartedArgs contains the args associated with the "BuildStarted" event.
@@ -121,6 +139,69 @@ type FullPipelineFinishedArgs struct {
 	AfterStepSuccessful bool
 }
 
+// WatchConfiguredArgs contains the args associated with the
+// "WatchConfigured" event.
+type WatchConfiguredArgs struct {
+	Options  *PipelineOptions
+	Step     Step
+	Reload   bool
+	Debounce time.Duration
+	Root     string
+	Includes int
+	Excludes int
+	Signal   string
+	Shell    string
+}
+
+// WatchReloadStartedArgs contains the args associated with the
+// "WatchReloadStarted" event.
+type WatchReloadStartedArgs struct {
+	Options *PipelineOptions
+	Step    Step
+	// Reload counts the runs of the code, the first build is 1
+	Reload int
+	// Files are the changes that triggered the reload, none for the first
+	// build
+	Files []string
+}
+
+// WatchReloadFinishedArgs contains the args associated with the
+// "WatchReloadFinished" event.
+type WatchReloadFinishedArgs struct {
+	Options *PipelineOptions
+	Step    Step
+	Reload  int
+	Files   []string
+	// Duration is from starting the reload until its code exited
+	Duration time.Duration
+	// Exited is set once the code exited, ExitCode is -1 otherwise
+	Exited   bool
+	ExitCode int
+	// Error is why the code couldn't be started
+	Error string
+}
+
+// WatchReloadCompleteArgs contains the args associated with the
+// "WatchReloadComplete" event.
+type WatchReloadCompleteArgs struct {
+	Options *PipelineOptions
+	Step    Step
+	// Reload counts the runs of the code, the first build is 1
+	Reload int
+	// Files are the changes that triggered the run, none for the first build
+	Files []string
+	// Exited is set if the code ended on its own, ExitCode is -1 otherwise
+	Exited   bool
+	ExitCode int
+	// Duration is from starting the code until it ended or was stopped
+	Duration time.Duration
+	// Successful is false if the code couldn't be started or exited non-zero,
+	// a run stopped for the next reload is successful
+	Successful bool
+	// Error is why the code couldn't be started
+	Error string
+}
+
 // DebugHandler dumps events
 type DebugHandler struct {
 	logger *util.LogEntry
@@ -187,6 +268,10 @@ func (h *DebugHandler) ListenTo(e *NormalizedEmitter) {
 	e.AddListener(BuildStepStarted, h.Handler("BuildStepStarted"))
 	e.AddListener(BuildStepFinished, h.Handler("BuildStepFinished"))
 	e.AddListener(FullPipelineFinished, h.Handler("FullPipelineFinished"))
+	e.AddListener(WatchConfigured, h.Handler("WatchConfigured"))
+	e.AddListener(WatchReloadStarted, h.Handler("WatchReloadStarted"))
+	e.AddListener(WatchReloadFinished, h.Handler("WatchReloadFinished"))
+	e.AddListener(WatchReloadComplete, h.Handler("WatchReloadComplete"))
 }
 
 // NormalizedEmitter wraps the emission.Emitter and is smart enough about
@@ -285,6 +370,44 @@ func (e *NormalizedEmitter) Emit(event interface{}, args interface{}) {
 			a.Options = e.options
 		}
 		e.Emitter.Emit(event, a)
+	// Add options and the current step
+	case WatchConfigured:
+		a := args.(*WatchConfiguredArgs)
+		if a.Options == nil {
+			a.Options = e.options
+		}
+		if a.Step == nil {
+			a.Step = e.currentStep
+		}
+		e.Emitter.Emit(event, a)
+	// Add options and the current step
+	case WatchReloadComplete:
+		a := args.(*WatchReloadCompleteArgs)
+		if a.Options == nil {
+			a.Options = e.options
+		}
+		if a.Step == nil {
+			a.Step = e.currentStep
+		}
+		e.Emitter.Emit(event, a)
+	case WatchReloadStarted:
+		a := args.(*WatchReloadStartedArgs)
+		if a.Options == nil {
+			a.Options = e.options
+		}
+		if a.Step == nil {
+			a.Step = e.currentStep
+		}
+		e.Emitter.Emit(event, a)
+	case WatchReloadFinished:
+		a := args.(*WatchReloadFinishedArgs)
+		if a.Options == nil {
+			a.Options = e.options
+		}
+		if a.Step == nil {
+			a.Step = e.currentStep
+		}
+		e.Emitter.Emit(event, a)
 	}
 }
 
@@ -294,6 +417,11 @@ func NewEmitterContext(ctx context.Context) context.Context {
 	return context.WithValue(ctx, "Emitter", e)
 }
 
+// WithEmitter gives us a new context carrying an existing emitter
+func WithEmitter(ctx context.Context, e *NormalizedEmitter) context.Context {
+	return context.WithValue(ctx, "Emitter", e)
+}
+
 // EmitterFromContext gives us the emitter attached to the context
 func EmitterFromContext(ctx context.Context) (e *NormalizedEmitter, err error) {
 	e, ok := ctx.Value("Emitter").(*NormalizedEmitter)
@@ -44,6 +44,9 @@ type GlobalOptions struct {
 	Verbose    bool
 	ShowColors bool
 
+	// LogTimestamps is one of the util.Timestamps* modes, or empty
+	LogTimestamps string
+
 	// Auth
 	AuthToken      string
 	AuthTokenStore string
@@ -78,15 +81,25 @@ func NewGlobalOptions(c util.Settings, e *util.Environment) (*GlobalOptions, err
 	// TODO(termie): switch negative flag
 	showColors, _ := c.GlobalBool("no-colors")
 	showColors = !showColors
+	logTimestamps, _ := c.GlobalString("log-timestamps")
+	if !util.ValidTimestampMode(logTimestamps) {
+		return nil, fmt.Errorf("Invalid log-timestamps mode %q, expected %s or %s", logTimestamps, util.TimestampsRFC3339, util.TimestampsRelative)
+	}
 
 	authTokenStore, _ := c.GlobalString("auth-token-store")
 	authTokenStore = util.ExpandHomePath(authTokenStore, e.Get("HOME"))
 	authToken := guessAuthToken(c, e, authTokenStore)
 
-	// If debug is true, than force verbose and do not use colors.
+	// If debug is true, than force verbose and do not use colors. The debug
+	// log format already includes the time, so don't add it twice.
 	if debug {
 		verbose = true
 		showColors = false
+		logTimestamps = ""
+	}
+	// journald keeps its own time for every entry
+	if journal {
+		logTimestamps = ""
 	}
 
 	return &GlobalOptions{
@@ -96,6 +109,8 @@ func NewGlobalOptions(c util.Settings, e *util.Environment) (*GlobalOptions, err
 		Verbose:    verbose,
 		ShowColors: showColors,
 
+		LogTimestamps: logTimestamps,
+
 		AuthToken:      authToken,
 		AuthTokenStore: authTokenStore,
 	}, nil
@@ -358,14 +373,15 @@ type PipelineOptions struct {
 	SourceDir         string
 	IgnoreFile        string
 
-	AttachOnError  bool
-	DirectMount    bool
-	EnableDevSteps bool
-	PublishPorts   []string
-	ExposePorts    bool
-	EnableVolumes  bool
-	WerckerYml     string
-	Checkpoint     string
+	AttachOnError     bool
+	DirectMount       bool
+	EnableDevSteps    bool
+	AllowHostCommands bool
+	PublishPorts      []string
+	ExposePorts       bool
+	EnableVolumes     bool
+	WerckerYml        string
+	Checkpoint        string
 
 	DefaultsUsed PipelineDefaultsUsed
 }
@@ -572,6 +588,7 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 	attachOnError, _ := c.Bool("attach-on-error")
 	directMount, _ := c.Bool("direct-mount")
 	enableDevSteps, _ := c.Bool("enable-dev-steps")
+	allowHostCommands, _ := c.Bool("allow-host-commands")
 	// Deprecated
 	publishPorts, _ := c.StringSlice("publish")
 	exposePorts, _ := c.Bool("expose-ports")
@@ -627,9 +644,10 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 		SourceDir:         sourceDir,
 		IgnoreFile:        ignoreFile,
 
-		AttachOnError:  attachOnError,
-		DirectMount:    directMount,
-		EnableDevSteps: enableDevSteps,
+		AttachOnError:     attachOnError,
+		DirectMount:       directMount,
+		EnableDevSteps:    enableDevSteps,
+		AllowHostCommands: allowHostCommands,
 		// Deprecated
 		PublishPorts:  publishPorts,
 		ExposePorts:   exposePorts,
@@ -892,6 +910,25 @@ func NewPullOptions(c util.Settings, e *util.Environment) (*PullOptions, error)
 	}, nil
 }
 
+// StepsOptions for the steps command
+type StepsOptions struct {
+	*GlobalOptions
+	OutputJSON bool
+}
+
+// NewStepsOptions constructor
+func NewStepsOptions(c util.Settings, e *util.Environment) (*StepsOptions, error) {
+	globalOpts, err := NewGlobalOptions(c, e)
+	if err != nil {
+		return nil, err
+	}
+	json, _ := c.Bool("json")
+	return &StepsOptions{
+		GlobalOptions: globalOpts,
+		OutputJSON:    json,
+	}, nil
+}
+
 // VersionOptions contains the options associated with the version
 // command.
 type VersionOptions struct {
@@ -252,28 +252,75 @@ func (c *DockerClient) AttachTerminal(containerID string) error {
 	return err
 }
 
-// ExecOne uses docker exec to run a command in the container
+// ExecOne uses docker exec to run a command in the container, its exit code
+// is not checked
 func (c *DockerClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	_, err := c.ExecAll(containerID, [][]string{cmd}, output)
+	return err
+}
+
+// ExecAll uses docker exec to run each of cmds in the container in turn,
+// all writing their stdout to output, and returns their exit codes. A command exiting
+// non-zero is not an error, failing to run one is and returns the codes of
+// the ones before it.
+func (c *DockerClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	codes := []int{}
+	for _, cmd := range cmds {
+		exec, err := c.CreateExec(docker.CreateExecOptions{
+			AttachStdin:  false,
+			AttachStdout: true,
+			AttachStderr: true,
+			Tty:          false,
+			Cmd:          cmd,
+			Container:    containerID,
+		})
+		if err != nil {
+			return codes, err
+		}
+
+		err = c.StartExec(exec.ID, docker.StartExecOptions{
+			OutputStream: output,
+		})
+		if err != nil {
+			return codes, err
+		}
+
+		inspect, err := c.InspectExec(exec.ID)
+		if err != nil {
+			return codes, err
+		}
+		codes = append(codes, inspect.ExitCode)
+	}
+	return codes, nil
+}
+
+// ExecTTY uses docker exec to run cmd in the container on a pseudo-TTY of
+// its own, writing what it prints to output, and returns its exit code. The
+// terminal merges stderr into stdout.
+func (c *DockerClient) ExecTTY(containerID string, cmd []string, output io.Writer) (int, error) {
 	exec, err := c.CreateExec(docker.CreateExecOptions{
-		AttachStdin:  false,
 		AttachStdout: true,
 		AttachStderr: true,
-		Tty:          false,
+		Tty:          true,
 		Cmd:          cmd,
 		Container:    containerID,
 	})
 	if err != nil {
-		return err
+		return -1, err
 	}
-
 	err = c.StartExec(exec.ID, docker.StartExecOptions{
 		OutputStream: output,
+		Tty:          true,
+		RawTerminal:  true,
 	})
 	if err != nil {
-		return err
+		return -1, err
 	}
-
-	return nil
+	inspect, err := c.InspectExec(exec.ID)
+	if err != nil {
+		return -1, err
+	}
+	return inspect.ExitCode, nil
 }
 
 // DockerScratchPushStep creates a new image based on a scratch tarball and
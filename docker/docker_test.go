@@ -15,6 +15,7 @@
 package dockerlocal
 
 import (
+	"bytes"
 	"encoding/hex"
 	"testing"
 
@@ -48,3 +49,22 @@ func (s *DockerSuite) TestGenerateDockerID() {
 	// The ID needs to be 256 bits
 	s.Equal(256, len(b)*8)
 }
+
+func (s *DockerSuite) TestExecAll() {
+	client := DockerOrSkip(s.T())
+	container, err := TempBusybox(client)
+	s.Require().Nil(err)
+	defer container.Remove()
+	s.Require().Nil(client.StartContainer(container.ID, nil))
+
+	var output bytes.Buffer
+	codes, err := client.ExecAll(container.ID, [][]string{
+		{"echo", "one"},
+		{"/bin/sh", "-c", "echo two; echo hidden >&2; exit 3"},
+	}, &output)
+	s.Nil(err)
+	s.Equal([]int{0, 3}, codes)
+	s.Equal("one\ntwo\n", output.String())
+
+	s.Nil(client.ExecOne(container.ID, []string{"false"}, &output), "exit codes aren't errors")
+}
@@ -89,9 +89,17 @@ func NewDockerPipeline(name string, config *core.Config, options *core.PipelineO
 		return nil, err
 	}
 
+	// watch-defaults are merged under the data of every watch step
+	stepConfigFor := func(raw *core.RawStepConfig) *core.StepConfig {
+		if raw.ID == "internal/watch" {
+			return raw.WithDefaults(pipelineConfig.WatchDefaults)
+		}
+		return raw.StepConfig
+	}
+
 	steps := []core.Step{initStep}
 	for _, stepConfig := range stepsConfig {
-		step, err := NewStep(stepConfig.StepConfig, options, dockerOptions)
+		step, err := NewStep(stepConfigFor(stepConfig), options, dockerOptions)
 		if err != nil {
 			return nil, err
 		}
@@ -104,7 +112,7 @@ func NewDockerPipeline(name string, config *core.Config, options *core.PipelineO
 
 	var afterSteps []core.Step
 	for _, stepConfig := range afterStepsConfig {
-		step, err := NewStep(stepConfig.StepConfig, options, dockerOptions)
+		step, err := NewStep(stepConfigFor(stepConfig), options, dockerOptions)
 		if err != nil {
 			return nil, err
 		}
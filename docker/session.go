@@ -41,6 +41,11 @@ func NewDockerTransport(options *core.PipelineOptions, dockerOptions *Options, c
 	return &DockerTransport{options: options, client: client, containerID: containerID, logger: logger}, nil
 }
 
+// ContainerID is the container the session runs in
+func (t *DockerTransport) ContainerID() string {
+	return t.containerID
+}
+
 // Attach the given reader and writers to the transport, return a context
 // that will be closed when the transport dies
 func (t *DockerTransport) Attach(sessionCtx context.Context, stdin io.Reader, stdout, stderr io.Writer) (context.Context, error) {
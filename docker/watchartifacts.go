@@ -0,0 +1,148 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+)
+
+// reloadCollector collects the artifacts of finished reloads in the
+// background so it never holds up the next one. At most concurrency
+// collections run at a time and only the artifacts of the last retain
+// reloads are kept, 0 keeps everything.
+type reloadCollector struct {
+	collect func(reload int) error
+	discard func(reload int)
+	retain  int
+	logger  *util.LogEntry
+	slots   chan struct{}
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	latest  int
+	kept    []int
+}
+
+func newReloadCollector(concurrency, retain int, collect func(int) error, discard func(int), logger *util.LogEntry) *reloadCollector {
+	return &reloadCollector{
+		collect: collect,
+		discard: discard,
+		retain:  retain,
+		logger:  logger,
+		slots:   make(chan struct{}, concurrency),
+	}
+}
+
+// queue collects reload once a slot is free, it doesn't block
+func (c *reloadCollector) queue(reload int) {
+	c.mutex.Lock()
+	if reload > c.latest {
+		c.latest = reload
+	}
+	c.mutex.Unlock()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.slots <- struct{}{}
+		defer func() { <-c.slots }()
+		if c.stale(reload) {
+			c.logger.Debugln("Not collecting artifacts of reload", reload, "newer ones would replace them")
+			return
+		}
+		if err := c.collect(reload); err != nil {
+			c.logger.Warnln("Unable to collect the artifacts of reload", reload, err)
+			return
+		}
+		c.keep(reload)
+	}()
+}
+
+// stale tells whether reload would be discarded right after collecting it
+func (c *reloadCollector) stale(reload int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.retain > 0 && reload <= c.latest-c.retain
+}
+
+// keep records reload as collected and discards the oldest ones over
+// retain
+func (c *reloadCollector) keep(reload int) {
+	c.mutex.Lock()
+	c.kept = append(c.kept, reload)
+	sort.Ints(c.kept)
+	old := []int{}
+	for c.retain > 0 && len(c.kept) > c.retain {
+		old = append(old, c.kept[0])
+		c.kept = c.kept[1:]
+	}
+	c.mutex.Unlock()
+	for _, reload := range old {
+		c.discard(reload)
+	}
+}
+
+// wait blocks until everything queued is collected
+func (c *reloadCollector) wait() {
+	c.wg.Wait()
+}
+
+// reloadArtifactPath is where the artifacts of a single reload end up on
+// the host
+func (s *WatchStep) reloadArtifactPath(reload int, p ...string) string {
+	return s.options.HostPath(append([]string{s.SafeID(), "reloads", fmt.Sprintf("reload-%d", reload)}, p...)...)
+}
+
+// newProfileCollector collects each reload's profiles to the host. Once
+// they're copied they are removed from the container so the collection at
+// the end of the step only picks up the ones that weren't.
+func (s *WatchStep) newProfileCollector(containerID string) *reloadCollector {
+	collect := func(reload int) error {
+		guestPath := s.profilePath(fmt.Sprintf("reload-%d", reload))
+		artifact := &core.Artifact{
+			ContainerID:   containerID,
+			GuestPath:     guestPath,
+			HostTarPath:   s.reloadArtifactPath(reload) + ".tar",
+			HostPath:      s.reloadArtifactPath(reload),
+			ApplicationID: s.options.ApplicationID,
+			RunID:         s.options.RunID,
+			RunStepID:     s.SafeID(),
+			Bucket:        s.options.S3Bucket,
+			ContentType:   "application/x-tar",
+		}
+		if _, err := NewArtificer(s.options, s.dockerOptions).Collect(artifact); err != nil {
+			if err == util.ErrEmptyTarball {
+				return nil
+			}
+			return err
+		}
+		client, err := s.dockerClient()
+		if err != nil {
+			return err
+		}
+		return client.ExecOne(containerID, []string{"rm", "-rf", guestPath}, ioutil.Discard)
+	}
+	discard := func(reload int) {
+		os.RemoveAll(s.reloadArtifactPath(reload))
+		os.Remove(s.reloadArtifactPath(reload) + ".tar")
+	}
+	return newReloadCollector(s.config.ArtifactConcurrency, s.config.ArtifactRetention, collect, discard, s.logger)
+}
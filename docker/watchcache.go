@@ -0,0 +1,83 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// treeHash sums up the files we'd watch under root, their names, sizes and
+// modification times rather than their contents so it stays cheap. The
+// code is part of it, a different command is never the same build.
+func (s *WatchStep) treeHash(root string) (string, error) {
+	filters := s.newDirFilters(root)
+	h := sha256.New()
+	fmt.Fprintf(h, "code %s\n", s.command())
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if _, excluded := filters.match(path); excluded {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if s.hidden(path) || (len(s.config.Extensions) > 0 && !s.hasExtension(path)) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildCachePath is where the tree hash of the last successful build of
+// root is kept, in the working dir so it outlives the run
+func (s *WatchStep) buildCachePath(root string) string {
+	sum := sha256.Sum256([]byte(s.DisplayName() + "\x00" + root))
+	return s.options.WorkingPath("watch", hex.EncodeToString(sum[:8]))
+}
+
+// unchangedSinceLastBuild says whether hash is what the last successful
+// build saw, in the same container. A new container has nothing running
+// or built in it yet, so its first build is never skipped.
+func (s *WatchStep) unchangedSinceLastBuild(root, hash, containerID string) bool {
+	last, err := ioutil.ReadFile(s.buildCachePath(root))
+	return err == nil && strings.TrimSpace(string(last)) == hash+" "+containerID
+}
+
+// recordBuild remembers hash as the last successful build of root in the
+// container
+func (s *WatchStep) recordBuild(root, hash, containerID string) error {
+	path := s.buildCachePath(root)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(hash+" "+containerID+"\n"), 0644)
+}
@@ -0,0 +1,137 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pathWatcher is the part of fsnotify.Watcher commandWatchSet needs
+type pathWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+}
+
+// commandWatchSet is what watch-from-command asked us to watch. A listed
+// directory has everything directly in it watched, a listed file is
+// watched through its parent directory with the parent's other files
+// ignored.
+type commandWatchSet struct {
+	mutex   sync.Mutex
+	dirs    map[string]bool
+	files   map[string]bool
+	watched map[string]bool
+}
+
+func newCommandWatchSet() *commandWatchSet {
+	return &commandWatchSet{
+		dirs:    map[string]bool{},
+		files:   map[string]bool{},
+		watched: map[string]bool{},
+	}
+}
+
+// parseCommandPaths reads one path per line, relative paths are relative
+// to root
+func parseCommandPaths(root, output string) []string {
+	paths := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(root, line)
+		}
+		paths = append(paths, filepath.Clean(line))
+	}
+	return paths
+}
+
+// update replaces the set with paths, adding watches for new directories
+// and removing the ones nothing needs anymore. Paths that don't exist are
+// skipped, the next run of the command gets another chance at them.
+func (c *commandWatchSet) update(watcher pathWatcher, paths []string) (int, error) {
+	dirs := map[string]bool{}
+	files := map[string]bool{}
+	watched := map[string]bool{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			dirs[path] = true
+			watched[path] = true
+		} else {
+			files[path] = true
+			watched[filepath.Dir(path)] = true
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for dir := range watched {
+		if c.watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return len(c.watched), err
+		}
+		c.watched[dir] = true
+	}
+	for dir := range c.watched {
+		if !watched[dir] {
+			watcher.Remove(dir)
+			delete(c.watched, dir)
+		}
+	}
+	c.dirs = dirs
+	c.files = files
+	return len(c.watched), nil
+}
+
+// matches says whether a change to name is one the command asked for
+func (c *commandWatchSet) matches(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.files[name] || c.dirs[filepath.Dir(name)]
+}
+
+// watchFromCommand runs watch-from-command on the host from the project
+// directory and points the watcher at the paths it prints
+func (s *WatchStep) watchFromCommand(watcher pathWatcher) error {
+	cmd := execCommand("/bin/sh", "-c", s.config.WatchFromCommand)
+	cmd.Dir = s.options.ProjectPath
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	count, err := s.commandWatch.update(watcher, parseCommandPaths(s.options.ProjectPath, string(output)))
+	if err != nil {
+		return err
+	}
+	s.logger.Debugf("Watching %d directories from watch-from-command", count)
+	s.status.mutex.Lock()
+	s.status.watchedDirs = count
+	s.status.mutex.Unlock()
+	return nil
+}
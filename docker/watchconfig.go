@@ -0,0 +1,787 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/docker/go-units"
+	"golang.org/x/sys/unix"
+)
+
+// WatchConfig is the typed version of the internal/watch step data
+type WatchConfig struct {
+	Code                 string
+	Commands             []string
+	Setup                string
+	Reload               bool
+	ExplainExcludes      bool
+	DryRun               bool
+	WatchHidden          bool
+	LogFile              string
+	LogFileTruncate      bool
+	MaxTriggerSize       int64
+	SkipBinary           bool
+	IgnoreWrites         []string
+	HostCommand          string
+	InitialRetries       int
+	MaxReloadsPerMinute  int
+	InitialRetryDelay    time.Duration
+	RestartContainer     bool
+	Wrapper              string
+	User                 string
+	KeepPidfiles         []string
+	WaitForPorts         []int
+	WaitForPortsTimeout  time.Duration
+	Events               fsnotify.Op
+	TriggerPort          int
+	TriggerToken         string
+	Warmup               time.Duration
+	ShowChanges          bool
+	Clear                bool
+	Notify               bool
+	Extensions           []string
+	Profile              string
+	TmuxSession          string
+	GitTrigger           bool
+	GitTriggerInterval   time.Duration
+	Progress             bool
+	Groups               []WatchGroup
+	ForwardSignals       []string
+	TTY                  bool
+	Interactive          bool
+	WatchFromCommand     string
+	IgnoreFiles          []string
+	Memory               int64
+	CPU                  float64
+	LockFile             string
+	ReloadBackoff        time.Duration
+	ReloadBackoffMax     time.Duration
+	LogFilter            *regexp.Regexp
+	LogExclude           *regexp.Regexp
+	Root                 string
+	Paths                []string
+	RootOutsideProject   bool
+	SkipUnchangedInitial bool
+	OnExit               string
+	KillGroup            bool
+	SSHHost              string
+	SSHPath              string
+	SSHKey               string
+	EventSocket          string
+	PerFileCommand       *template.Template
+	PerFileMode          string
+	DebounceMode         string
+	GroupLogs            bool
+	Interval             time.Duration
+	WaitExit             bool
+	Snapshot             []string
+	Strict               bool
+	ArtifactConcurrency  int
+	ArtifactRetention    int
+	KillSequence         []killStep
+	KillTimeout          time.Duration
+	Poll                 bool
+	PollInterval         time.Duration
+
+	// Warnings are problems that don't stop the step, the data they came
+	// from is ignored
+	Warnings []string
+}
+
+// defaultWatchConfig is what we use for keys that aren't set
+func defaultWatchConfig() WatchConfig {
+	return WatchConfig{
+		InitialRetryDelay:   time.Second,
+		WaitForPortsTimeout: 10 * time.Second,
+		Events:              defaultWatchEvents,
+		GitTriggerInterval:  2 * time.Second,
+		IgnoreFiles:         defaultIgnoreFiles,
+		ReloadBackoff:       time.Second,
+		ReloadBackoffMax:    30 * time.Second,
+		OnExit:              onExitWait,
+		PerFileMode:         perFileList,
+		DebounceMode:        debounceLeading,
+		ArtifactConcurrency: 2,
+		ArtifactRetention:   10,
+		KillSequence:        timeoutKillSequence(stopSignal, defaultKillTimeout),
+		KillTimeout:         defaultKillTimeout,
+		PollInterval:        time.Second,
+	}
+}
+
+// WatchConfigError collects every problem found in the step data so they
+// can be reported at once
+type WatchConfigError []error
+
+func (e WatchConfigError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "Invalid watch step: " + strings.Join(messages, "; ")
+}
+
+// normalizeDataKeys spells every key with dashes, the step data can use
+// underscores as well. Keys given both ways are returned as duplicates.
+func normalizeDataKeys(data map[string]string) (map[string]string, []string) {
+	normalized := map[string]string{}
+	duplicates := []string{}
+	for key, value := range data {
+		name := strings.Replace(key, "_", "-", -1)
+		if _, ok := normalized[name]; ok {
+			duplicates = append(duplicates, name)
+		}
+		normalized[name] = value
+	}
+	sort.Strings(duplicates)
+	return normalized, duplicates
+}
+
+// parseWatchConfig turns the step data into a WatchConfig, applying
+// defaults for anything not given
+func parseWatchConfig(data map[string]string) (WatchConfig, error) {
+	config := defaultWatchConfig()
+	errs := WatchConfigError{}
+	fail := func(key string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, err))
+	}
+
+	// kill_timeout is the same key as kill-timeout
+	data, duplicates := normalizeDataKeys(data)
+	for _, key := range duplicates {
+		fail(key, fmt.Errorf("given more than once"))
+	}
+
+	// Keys have to be declared in watchDataKeys so wercker steps describe
+	// knows about them, TestDeclaredKeys checks the ones read here are
+	get := func(key string) (string, bool) {
+		value, ok := data[key]
+		return value, ok
+	}
+	getString := func(key string) string {
+		value, _ := get(key)
+		return value
+	}
+
+	parseBool := func(key string, dst *bool) {
+		if value, ok := get(key); ok {
+			if v, err := strconv.ParseBool(value); err == nil {
+				*dst = v
+			} else {
+				fail(key, err)
+			}
+		}
+	}
+	parseInt := func(key string, dst *int) {
+		if value, ok := get(key); ok {
+			if v, err := strconv.Atoi(value); err == nil {
+				*dst = v
+			} else {
+				fail(key, err)
+			}
+		}
+	}
+	parseDuration := func(key string, dst *time.Duration) {
+		if value, ok := get(key); ok {
+			if v, err := time.ParseDuration(value); err == nil {
+				*dst = v
+			} else {
+				fail(key, err)
+			}
+		}
+	}
+
+	config.Code = getString("code")
+	config.Setup = getString("setup")
+	if value, ok := get("commands"); ok {
+		if cmds, err := parseCommands(value); err == nil {
+			config.Commands = cmds
+		} else {
+			fail("commands", err)
+		}
+		switch {
+		case config.Code != "":
+			fail("commands", fmt.Errorf("can't be used with code, use one or the other"))
+		case len(config.Commands) > 0:
+			config.Code = commandsScript(config.Commands)
+		}
+	}
+	config.WatchFromCommand = getString("watch-from-command")
+	config.LockFile = getString("lock-file")
+	config.Root = getString("root")
+	if value, ok := get("paths"); ok {
+		for _, path := range splitPaths(value) {
+			if filepath.IsAbs(path) {
+				fail("paths", fmt.Errorf("%s must be relative to the project root", path))
+				continue
+			}
+			config.Paths = append(config.Paths, filepath.Clean(path))
+		}
+		if len(config.Paths) == 0 {
+			fail("paths", fmt.Errorf("is empty, leave it out to watch everything"))
+		}
+	}
+	parseBool("root-outside-project", &config.RootOutsideProject)
+	parseBool("watch-hidden", &config.WatchHidden)
+	parseBool("skip-unchanged-initial", &config.SkipUnchangedInitial)
+	parseBool("kill-group", &config.KillGroup)
+	signal := stopSignal
+	if value, ok := get("signal"); ok {
+		if v, err := parseSignal(value); err == nil {
+			signal = v
+		} else {
+			fail("signal", err)
+		}
+	}
+	parseDuration("kill-timeout", &config.KillTimeout)
+	if config.KillTimeout < 0 {
+		fail("kill-timeout", fmt.Errorf("can't be negative"))
+	}
+	if value, ok := get("kill-sequence"); ok {
+		if sequence, err := parseKillSequence(value); err != nil {
+			fail("kill-sequence", err)
+		} else if _, ok := data["signal"]; ok && sequence[0].Signal != signal {
+			fail("kill-sequence", fmt.Errorf("starts with %s but signal is %s", sequence[0].Signal, signal))
+		} else if _, ok := data["kill-timeout"]; ok {
+			fail("kill-timeout", fmt.Errorf("can't be used with kill-sequence, put the wait in the sequence instead"))
+		} else {
+			config.KillSequence = sequence
+		}
+	} else {
+		config.KillSequence = timeoutKillSequence(signal, config.KillTimeout)
+	}
+	parseBool("poll", &config.Poll)
+	parseDuration("poll-interval", &config.PollInterval)
+	if config.PollInterval <= 0 {
+		fail("poll-interval", fmt.Errorf("must be positive"))
+	}
+	parseBool("group-logs", &config.GroupLogs)
+	config.SSHHost = getString("ssh-host")
+	config.SSHPath = getString("ssh-path")
+	config.SSHKey = getString("ssh-key")
+	config.EventSocket = getString("event-socket")
+	if value, ok := get("per-file-command"); ok {
+		if tmpl, err := template.New("per-file-command").Option("missingkey=error").Parse(value); err == nil {
+			config.PerFileCommand = tmpl
+		} else {
+			fail("per-file-command", err)
+		}
+	}
+	if value, ok := get("debounce-mode"); ok {
+		switch value {
+		case debounceTrailing, debounceLeading:
+			config.DebounceMode = value
+		default:
+			fail("debounce-mode", fmt.Errorf("unknown mode %q, expected %s or %s", value, debounceLeading, debounceTrailing))
+		}
+	}
+	if value, ok := get("per-file-mode"); ok {
+		switch value {
+		case perFileList, perFileEach:
+			config.PerFileMode = value
+		default:
+			fail("per-file-mode", fmt.Errorf("unknown mode %q, expected %s or %s", value, perFileList, perFileEach))
+		}
+	}
+
+	parseRegexp := func(key string, dst **regexp.Regexp) {
+		if value, ok := get(key); ok {
+			if re, err := regexp.Compile(value); err == nil {
+				*dst = re
+			} else {
+				config.Warnings = append(config.Warnings, fmt.Sprintf("Ignoring %s: %s", key, err))
+			}
+		}
+	}
+	parseRegexp("log-filter", &config.LogFilter)
+	parseRegexp("log-exclude", &config.LogExclude)
+	parseBool("reload", &config.Reload)
+	parseBool("explain-excludes", &config.ExplainExcludes)
+	parseBool("dry-run", &config.DryRun)
+	parseBool("strict", &config.Strict)
+	config.LogFile = getString("log-file")
+	parseBool("log-file-truncate", &config.LogFileTruncate)
+	if value, ok := get("max-trigger-size"); ok {
+		if v, err := units.FromHumanSize(value); err == nil {
+			config.MaxTriggerSize = v
+		} else {
+			fail("max-trigger-size", err)
+		}
+	}
+	if value, ok := get("memory"); ok {
+		if v, err := units.RAMInBytes(value); err == nil && v > 0 {
+			config.Memory = v
+		} else {
+			fail("memory", fmt.Errorf("invalid size %q", value))
+		}
+	}
+	if value, ok := get("cpu"); ok {
+		if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 {
+			config.CPU = v
+		} else {
+			fail("cpu", fmt.Errorf("%q is not a positive number of CPUs", value))
+		}
+	}
+	parseBool("skip-binary", &config.SkipBinary)
+	if value, ok := get("ignore-writes"); ok {
+		config.IgnoreWrites = []string{}
+		for _, pattern := range splitList(value) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				fail("ignore-writes", fmt.Errorf("bad pattern %q: %s", pattern, err))
+				continue
+			}
+			config.IgnoreWrites = append(config.IgnoreWrites, pattern)
+		}
+	}
+	config.HostCommand = getString("host-command")
+	parseInt("initial-retries", &config.InitialRetries)
+	parseInt("max-reloads-per-minute", &config.MaxReloadsPerMinute)
+	parseInt("artifact-concurrency", &config.ArtifactConcurrency)
+	parseInt("artifact-retention", &config.ArtifactRetention)
+	parseDuration("initial-retry-delay", &config.InitialRetryDelay)
+	parseBool("restart-container", &config.RestartContainer)
+	if value, ok := get("wrapper"); ok {
+		if strings.Contains(value, wrapperPlaceholder) {
+			config.Wrapper = value
+		} else {
+			fail("wrapper", fmt.Errorf("must contain %s where the code should go", wrapperPlaceholder))
+		}
+	}
+	if value, ok := get("user"); ok {
+		if validUserName.MatchString(value) {
+			config.User = value
+		} else {
+			fail("user", fmt.Errorf("%q is not a valid user name", value))
+		}
+	}
+	if value, ok := get("snapshot"); ok {
+		for _, pattern := range splitList(value) {
+			if err := validSnapshotPattern(pattern); err != nil {
+				fail("snapshot", err)
+				continue
+			}
+			config.Snapshot = append(config.Snapshot, pattern)
+		}
+	}
+	if value, ok := get("keep-pidfiles"); ok {
+		config.KeepPidfiles = splitList(value)
+	}
+	if value, ok := get("wait-for-ports"); ok {
+		for _, port := range splitList(value) {
+			if v, err := strconv.Atoi(port); err == nil {
+				config.WaitForPorts = append(config.WaitForPorts, v)
+			} else {
+				fail("wait-for-ports", err)
+			}
+		}
+	}
+	parseDuration("wait-for-ports-timeout", &config.WaitForPortsTimeout)
+	if value, ok := get("events"); ok {
+		if v, err := parseWatchEvents(value); err == nil {
+			config.Events = v
+		} else {
+			fail("events", err)
+		}
+	}
+
+	parseInt("trigger-port", &config.TriggerPort)
+	parseDuration("warmup", &config.Warmup)
+	parseBool("show-changes", &config.ShowChanges)
+	parseBool("clear", &config.Clear)
+	parseBool("notify", &config.Notify)
+	if value, ok := get("extensions"); ok {
+		for _, ext := range splitList(value) {
+			config.Extensions = append(config.Extensions, "."+strings.TrimPrefix(ext, "."))
+		}
+	}
+	config.TriggerToken = getString("trigger-token")
+
+	if value, ok := get("profile"); ok {
+		switch value {
+		case profileDir, profileNode:
+			config.Profile = value
+		default:
+			fail("profile", fmt.Errorf("unknown profile %q, expected %s or %s", value, profileDir, profileNode))
+		}
+	}
+
+	parseBool("wait-exit", &config.WaitExit)
+	if value, ok := get("on-exit"); ok {
+		switch value {
+		case onExitWait, onExitReload, onExitFinish:
+			config.OnExit = value
+		default:
+			fail("on-exit", fmt.Errorf("unknown behavior %q, expected %s, %s or %s", value, onExitWait, onExitReload, onExitFinish))
+		}
+	}
+
+	if value, ok := get("tmux-session"); ok {
+		if strings.ContainsAny(value, ":. ") || value == "" {
+			fail("tmux-session", fmt.Errorf("%q is not a valid tmux session name", value))
+		} else {
+			config.TmuxSession = value
+		}
+	}
+
+	parseBool("progress", &config.Progress)
+	parseBool("tty", &config.TTY)
+	parseBool("interactive", &config.Interactive)
+	parseBool("git-trigger", &config.GitTrigger)
+	parseDuration("git-trigger-interval", &config.GitTriggerInterval)
+	parseDuration("reload-backoff", &config.ReloadBackoff)
+	parseDuration("reload-backoff-max", &config.ReloadBackoffMax)
+	parseDuration("interval", &config.Interval)
+
+	if value, ok := get("groups"); ok {
+		if groups, err := parseWatchGroups(value); err == nil {
+			config.Groups = groups
+		} else {
+			fail("groups", err)
+		}
+	}
+
+	if value, ok := get("ignore-files"); ok {
+		config.IgnoreFiles = []string{}
+		for _, name := range splitList(value) {
+			if strings.ContainsRune(name, '/') {
+				fail("ignore-files", fmt.Errorf("%s must be a file name, they're read from every watched directory", name))
+				continue
+			}
+			config.IgnoreFiles = append(config.IgnoreFiles, name)
+		}
+	}
+
+	if value, ok := get("forward-signals"); ok {
+		for _, name := range splitList(value) {
+			name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+			if _, ok := forwardableSignals[name]; !ok {
+				fail("forward-signals", fmt.Errorf("can't forward %s, expected one of HUP, USR2, WINCH, QUIT", name))
+				continue
+			}
+			config.ForwardSignals = append(config.ForwardSignals, name)
+		}
+	}
+
+	if config.ReloadBackoff < 0 {
+		fail("reload-backoff", fmt.Errorf("must not be negative, use 0 to turn it off"))
+	}
+	if config.ReloadBackoffMax < config.ReloadBackoff {
+		fail("reload-backoff-max", fmt.Errorf("must be at least reload-backoff"))
+	}
+
+	if config.Interval < 0 {
+		fail("interval", fmt.Errorf("must not be negative, use 0 to turn it off"))
+	}
+	if len(config.Commands) > 0 && len(config.Groups) > 0 {
+		fail("commands", fmt.Errorf("can't be used with groups"))
+	}
+	if config.Setup != "" && len(config.Groups) > 0 {
+		fail("setup", fmt.Errorf("can't be used with groups"))
+	}
+	if config.User != "" && len(config.Groups) > 0 {
+		fail("user", fmt.Errorf("can't be used with groups"))
+	}
+	if config.Interactive && len(config.Groups) > 0 {
+		fail("interactive", fmt.Errorf("can't be used with groups"))
+	}
+	if config.Interactive && config.TmuxSession != "" {
+		fail("interactive", fmt.Errorf("can't be used with tmux-session, attach to the tmux session instead"))
+	}
+	if config.Interactive && config.TTY {
+		fail("interactive", fmt.Errorf("can't be used with tty, the code runs in an exec of its own that our input doesn't reach"))
+	}
+	if config.Interval > 0 && len(config.Groups) > 0 {
+		fail("interval", fmt.Errorf("can't be used with groups"))
+	}
+	if config.Interval > 0 && !config.Reload {
+		config.Warnings = append(config.Warnings, "Ignoring interval: it only applies with reload")
+	}
+
+	// restart-on-exit picks what happens to both the code and the container
+	// exiting, with on-exit and restart-container in one key
+	if value, ok := get("restart-on-exit"); ok {
+		restart, err := strconv.ParseBool(value)
+		_, onExitSet := get("on-exit")
+		_, restartSet := get("restart-container")
+		switch {
+		case err != nil:
+			fail("restart-on-exit", err)
+		case onExitSet || restartSet || config.WaitExit:
+			fail("restart-on-exit", fmt.Errorf("can't be used with on-exit, wait-exit or restart-container, it sets them"))
+		case config.TmuxSession != "":
+			fail("restart-on-exit", fmt.Errorf("can't tell when a command in tmux exits"))
+		case restart:
+			config.OnExit = onExitReload
+			config.RestartContainer = true
+		default:
+			config.OnExit = onExitFinish
+		}
+	}
+
+	// wait-exit is on-exit finish for a single run
+	if config.WaitExit {
+		switch {
+		case config.Reload:
+			config.Warnings = append(config.Warnings, "Ignoring wait-exit: it only applies without reload, use on-exit instead")
+		case config.TmuxSession != "":
+			fail("wait-exit", fmt.Errorf("can't tell when a command in tmux exits"))
+		case config.OnExit != onExitWait && config.OnExit != onExitFinish:
+			fail("wait-exit", fmt.Errorf("can't be used with on-exit %s", config.OnExit))
+		default:
+			config.OnExit = onExitFinish
+		}
+	}
+	if config.OnExit != onExitWait && config.TmuxSession != "" {
+		fail("on-exit", fmt.Errorf("can't tell when a command in tmux exits, only %s works with tmux-session", onExitWait))
+	}
+	if config.SSHHost != "" && config.SSHPath == "" {
+		fail("ssh-path", fmt.Errorf("is required with ssh-host"))
+	}
+	if config.SSHHost == "" && (config.SSHPath != "" || config.SSHKey != "") {
+		fail("ssh-host", fmt.Errorf("is required with ssh-path and ssh-key"))
+	}
+	if len(config.Paths) > 0 && config.WatchFromCommand != "" {
+		fail("paths", fmt.Errorf("can't be used with watch-from-command"))
+	}
+	if config.SSHHost != "" && config.GitTrigger {
+		fail("ssh-host", fmt.Errorf("can't be used with git-trigger"))
+	}
+	if config.ArtifactConcurrency < 1 {
+		fail("artifact-concurrency", fmt.Errorf("must be at least 1"))
+	}
+	if config.ArtifactRetention < 0 {
+		fail("artifact-retention", fmt.Errorf("must not be negative, use 0 to keep everything"))
+	}
+	if config.MaxReloadsPerMinute < 0 {
+		fail("max-reloads-per-minute", fmt.Errorf("must not be negative, use 0 to turn it off"))
+	}
+	if config.InitialRetries < 0 {
+		fail("initial-retries", fmt.Errorf("must not be negative"))
+	}
+	if config.GitTriggerInterval <= 0 {
+		fail("git-trigger-interval", fmt.Errorf("must be positive"))
+	}
+	if config.TriggerPort < 0 || config.TriggerPort > 65535 {
+		fail("trigger-port", fmt.Errorf("%d is not a valid port", config.TriggerPort))
+	}
+
+	// The groups loop routes changes to the groups and reloads them, these
+	// only do something in the single-command loop
+	if len(config.Groups) > 0 {
+		for _, key := range []struct {
+			name string
+			set  bool
+		}{
+			{"trigger-port", config.TriggerPort != 0},
+			{"git-trigger", config.GitTrigger},
+			{"ssh-host", config.SSHHost != ""},
+			{"event-socket", config.EventSocket != ""},
+			{"lock-file", config.LockFile != ""},
+			{"max-reloads-per-minute", config.MaxReloadsPerMinute > 0},
+			{"tmux-session", config.TmuxSession != ""},
+			{"tty", config.TTY},
+			{"wrapper", config.Wrapper != ""},
+			{"forward-signals", len(config.ForwardSignals) > 0},
+			{"host-command", config.HostCommand != ""},
+			{"notify", config.Notify},
+			{"wait-for-ports", len(config.WaitForPorts) > 0},
+			{"snapshot", len(config.Snapshot) > 0},
+			{"profile", config.Profile != ""},
+		} {
+			if key.set {
+				fail(key.name, fmt.Errorf("can't be used with groups"))
+			}
+		}
+	}
+
+	unknown := []string{}
+	for key := range data {
+		if !watchDataKeyNames[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		config.Warnings = append(config.Warnings, fmt.Sprintf("Ignoring unknown key %s", key))
+	}
+
+	if len(errs) > 0 {
+		return config, errs
+	}
+	return config, nil
+}
+
+// defaultWatchEvents are the operations that trigger a reload unless the
+// events key says otherwise
+const defaultWatchEvents = fsnotify.Write | fsnotify.Create | fsnotify.Remove | fsnotify.Rename
+
+var watchEventNames = map[string]fsnotify.Op{
+	"write":  fsnotify.Write,
+	"create": fsnotify.Create,
+	"remove": fsnotify.Remove,
+	"rename": fsnotify.Rename,
+	"chmod":  fsnotify.Chmod,
+}
+
+// splitList splits a step data value on commas and whitespace
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// splitPaths splits a step data value on commas and newlines, paths can
+// have spaces in them
+func splitPaths(value string) []string {
+	paths := []string{}
+	for _, path := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// parseWatchEvents builds an op mask from a comma or space separated list
+// of operation names
+func parseWatchEvents(events string) (fsnotify.Op, error) {
+	var mask fsnotify.Op
+	for _, name := range splitList(events) {
+		op, ok := watchEventNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("Unknown watch event %q, expected one of write, create, remove, rename, chmod", name)
+		}
+		mask |= op
+	}
+	if mask == 0 {
+		return 0, fmt.Errorf("No watch events given")
+	}
+	return mask, nil
+}
+
+// parseCommands reads the commands key, one command per line or a JSON list
+// of them like groups takes. A command in the list can span lines.
+func parseCommands(value string) ([]string, error) {
+	cmds := []string{}
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		list := []string{}
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return nil, fmt.Errorf("not a JSON list of commands: %s", err)
+		}
+		for _, cmd := range list {
+			if strings.TrimSpace(cmd) != "" {
+				cmds = append(cmds, cmd)
+			}
+		}
+		return cmds, nil
+	}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			cmds = append(cmds, line)
+		}
+	}
+	return cmds, nil
+}
+
+// forwardableSignals are the host signals forward-signals can pass on to
+// the processes in the container. SIGINT and SIGTERM stop the watch and
+// SIGUSR1 dumps its status, so they can't be forwarded. SIGUSR2 pauses the
+// watch unless it is forwarded.
+var forwardableSignals = map[string]os.Signal{
+	"HUP":   unix.SIGHUP,
+	"USR2":  unix.SIGUSR2,
+	"WINCH": unix.SIGWINCH,
+	"QUIT":  unix.SIGQUIT,
+}
+
+// Profiling modes for the profile key
+const (
+	profileDir  = "dir"
+	profileNode = "node"
+)
+
+// What to do when the code exits on its own, for the on-exit key
+const (
+	onExitWait   = "wait"
+	onExitReload = "reload"
+	onExitFinish = "finish"
+)
+
+// When a burst of changes reloads, for the debounce-mode key
+const (
+	debounceTrailing = "trailing"
+	debounceLeading  = "leading"
+)
+
+// wrapperPlaceholder is replaced by the step code in the wrapper key
+const wrapperPlaceholder = "{{cmd}}"
+
+// WatchGroup is one entry of the groups key, a command that is only
+// reloaded when files matching its paths change
+type WatchGroup struct {
+	Name    string   `json:"name"`
+	Paths   []string `json:"paths"`
+	Command string   `json:"command"`
+}
+
+var groupNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseWatchGroups reads the groups key, a JSON list of groups:
+//
+//	groups: |
+//	  [{"name": "api", "paths": ["api", "lib/*.go"], "command": "go run ./api"},
+//	   {"name": "web", "paths": ["web"], "command": "npm start"}]
+func parseWatchGroups(value string) ([]WatchGroup, error) {
+	groups := []WatchGroup{}
+	if err := json.Unmarshal([]byte(value), &groups); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if !groupNameRe.MatchString(group.Name) {
+			return nil, fmt.Errorf("group name %q may only contain letters, digits, - and _", group.Name)
+		}
+		if seen[group.Name] {
+			return nil, fmt.Errorf("group %s is defined twice", group.Name)
+		}
+		seen[group.Name] = true
+		if len(group.Paths) == 0 {
+			return nil, fmt.Errorf("group %s has no paths", group.Name)
+		}
+		if group.Command == "" {
+			return nil, fmt.Errorf("group %s has no command", group.Name)
+		}
+		for _, pattern := range group.Paths {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("group %s: bad path pattern %q", group.Name, pattern)
+			}
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,549 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type WatchConfigSuite struct {
+	*util.TestSuite
+}
+
+func TestWatchConfigSuite(t *testing.T) {
+	suiteTester := &WatchConfigSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// TestDeclaredKeys checks every key parseWatchConfig reads is declared in
+// watchDataKeys, so wercker steps describe lists it and it isn't warned
+// about as unknown
+func (s *WatchConfigSuite) TestDeclaredKeys() {
+	file, err := parser.ParseFile(token.NewFileSet(), "watchconfig.go", nil, 0)
+	s.Require().Nil(err)
+	readers := map[string]bool{"get": true, "getString": true, "parseBool": true, "parseInt": true, "parseDuration": true, "parseRegexp": true, "fail": true}
+	read := 0
+	ast.Inspect(file, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		if fun, ok := call.Fun.(*ast.Ident); !ok || !readers[fun.Name] {
+			return true
+		}
+		if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			key, err := strconv.Unquote(lit.Value)
+			s.Require().Nil(err)
+			s.True(watchDataKeyNames[key], "%s isn't declared in watchDataKeys", key)
+			read++
+		}
+		return true
+	})
+	s.NotZero(read)
+}
+
+func (s *WatchConfigSuite) TestDefaults() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.Equal(defaultWatchConfig(), config)
+	s.Equal(time.Second, config.InitialRetryDelay)
+	s.Equal(defaultWatchEvents, config.Events)
+}
+
+func (s *WatchConfigSuite) TestParse() {
+	config, err := parseWatchConfig(map[string]string{
+		"code":             "./server",
+		"reload":           "true",
+		"max-trigger-size": "1kb",
+		"initial-retries":  "3",
+		"wait-for-ports":   "8080, 9090",
+		"keep-pidfiles":    "/var/run/db.pid",
+		"events":           "write",
+	})
+	s.Nil(err)
+	s.Equal("./server", config.Code)
+	s.True(config.Reload)
+	s.Equal(int64(1000), config.MaxTriggerSize)
+	s.Equal(3, config.InitialRetries)
+	s.Equal([]int{8080, 9090}, config.WaitForPorts)
+	s.Equal([]string{"/var/run/db.pid"}, config.KeepPidfiles)
+	s.Equal(fsnotify.Write, config.Events)
+}
+
+func (s *WatchConfigSuite) TestAggregatesErrors() {
+	_, err := parseWatchConfig(map[string]string{
+		"reload":              "sometimes",
+		"initial-retry-delay": "soon",
+		"wrapper":             "dlv exec",
+	})
+	s.Require().NotNil(err)
+	errs, ok := err.(WatchConfigError)
+	s.Require().True(ok)
+	s.Equal(3, len(errs))
+	s.Contains(err.Error(), "reload")
+	s.Contains(err.Error(), "initial-retry-delay")
+	s.Contains(err.Error(), "wrapper")
+}
+
+func (s *WatchConfigSuite) TestGroups() {
+	config, err := parseWatchConfig(map[string]string{
+		"groups": `[{"name": "api", "paths": ["api", "lib/*.go"], "command": "go run ./api"},
+		            {"name": "web", "paths": ["web"], "command": "npm start"}]`,
+	})
+	s.Require().Nil(err)
+	s.Equal(2, len(config.Groups))
+	api := config.Groups[0]
+	s.True(api.matches("api/server.go"))
+	s.True(api.matches("api/handlers/users.go"))
+	s.True(api.matches("lib/util.go"))
+	s.False(api.matches("lib/util.js"))
+	s.False(api.matches("web/index.js"))
+	s.False(api.matches("apiary.go"))
+
+	s.Equal("setsid sh -c 'go run ./api' & echo $! > '/tmp/wercker-watch-api.pid'", api.reloadCommand())
+	s.Contains(api.killCommand("TERM"), "kill -s TERM -- -$pgid")
+
+	for _, groups := range []string{
+		`[{"name": "a b", "paths": ["x"], "command": "y"}]`,
+		`[{"name": "a", "paths": [], "command": "y"}]`,
+		`[{"name": "a", "paths": ["x"]}]`,
+		`[{"name": "a", "paths": ["x"], "command": "y"}, {"name": "a", "paths": ["z"], "command": "y"}]`,
+		`not json`,
+	} {
+		_, err := parseWatchConfig(map[string]string{"groups": groups})
+		s.NotNil(err, groups)
+	}
+}
+
+func (s *WatchConfigSuite) TestGroupsIgnoredKeys() {
+	groups := `[{"name": "a", "command": "a", "paths": ["*"]}]`
+	for _, data := range []map[string]string{
+		{"trigger-port": "8080"},
+		{"git-trigger": "true"},
+		{"ssh-host": "example.invalid", "ssh-path": "/src"},
+		{"event-socket": "/tmp/watch.sock"},
+		{"lock-file": ".building"},
+		{"max-reloads-per-minute": "5"},
+		{"tmux-session": "dev"},
+		{"tty": "true"},
+		{"wrapper": "dlv exec {{cmd}}"},
+		{"forward-signals": "HUP"},
+		{"host-command": "make"},
+		{"notify": "true"},
+		{"wait-for-ports": "8080"},
+		{"snapshot": "gen/*"},
+		{"profile": "dir"},
+	} {
+		key := ""
+		for name := range data {
+			if name != "ssh-path" {
+				key = name
+			}
+		}
+		data["groups"] = groups
+		_, err := parseWatchConfig(data)
+		s.Require().NotNil(err, key)
+		s.Contains(err.Error(), key+": can't be used with groups")
+	}
+
+	// Turned off they're fine
+	_, err := parseWatchConfig(map[string]string{"groups": groups, "git-trigger": "false", "tty": "false"})
+	s.Nil(err)
+}
+
+func (s *WatchConfigSuite) TestForwardSignals() {
+	config, err := parseWatchConfig(map[string]string{"forward-signals": "hup, SIGUSR2"})
+	s.Nil(err)
+	s.Equal([]string{"HUP", "USR2"}, config.ForwardSignals)
+
+	_, err = parseWatchConfig(map[string]string{"forward-signals": "INT"})
+	s.NotNil(err)
+	_, err = parseWatchConfig(map[string]string{"forward-signals": "USR1"})
+	s.NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestIgnoreFiles() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.Equal([]string{".gitignore", ".werckerignore"}, config.IgnoreFiles)
+
+	config, err = parseWatchConfig(map[string]string{"ignore-files": ".gitignore .ignore,.rgignore"})
+	s.Nil(err)
+	s.Equal([]string{".gitignore", ".ignore", ".rgignore"}, config.IgnoreFiles)
+
+	_, err = parseWatchConfig(map[string]string{"ignore-files": "sub/.ignore"})
+	s.NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestResourceLimits() {
+	config, err := parseWatchConfig(map[string]string{"memory": "512m", "cpu": "0.5"})
+	s.Nil(err)
+	s.Equal(int64(512*1024*1024), config.Memory)
+	s.Equal(0.5, config.CPU)
+
+	_, err = parseWatchConfig(map[string]string{"memory": "lots", "cpu": "-1"})
+	s.Require().NotNil(err)
+	s.Equal(2, len(err.(WatchConfigError)))
+}
+
+func (s *WatchConfigSuite) TestLogFilters() {
+	config, err := parseWatchConfig(map[string]string{"log-filter": "^(ERROR|WARN)", "log-exclude": "healthz"})
+	s.Nil(err)
+	s.True(config.LogFilter.MatchString("ERROR boom"))
+	s.True(config.LogExclude.MatchString("GET /healthz"))
+	s.Equal(0, len(config.Warnings))
+
+	config, err = parseWatchConfig(map[string]string{"log-filter": "(unclosed"})
+	s.Nil(err, "a bad pattern is only a warning")
+	s.Nil(config.LogFilter)
+	s.Require().Equal(1, len(config.Warnings))
+	s.Contains(config.Warnings[0], "log-filter")
+}
+
+func (s *WatchConfigSuite) TestOnExit() {
+	config, err := parseWatchConfig(map[string]string{"on-exit": "finish"})
+	s.Nil(err)
+	s.Equal(onExitFinish, config.OnExit)
+
+	_, err = parseWatchConfig(map[string]string{"on-exit": "explode"})
+	s.NotNil(err)
+	_, err = parseWatchConfig(map[string]string{"on-exit": "reload", "tmux-session": "dev"})
+	s.NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestRestartOnExit() {
+	config, err := parseWatchConfig(map[string]string{"reload": "true", "restart_on_exit": "true"})
+	s.Nil(err)
+	s.Equal(onExitReload, config.OnExit)
+	s.True(config.RestartContainer)
+
+	config, err = parseWatchConfig(map[string]string{"reload": "true", "restart-on-exit": "false"})
+	s.Nil(err)
+	s.Equal(onExitFinish, config.OnExit)
+	s.False(config.RestartContainer)
+
+	config, err = parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.Equal(onExitWait, config.OnExit, "unset keeps waiting")
+
+	for _, data := range []map[string]string{
+		{"restart-on-exit": "yes please"},
+		{"restart-on-exit": "true", "on-exit": "reload"},
+		{"restart-on-exit": "false", "restart-container": "true"},
+		{"restart-on-exit": "false", "wait-exit": "true"},
+		{"restart-on-exit": "true", "tmux-session": "dev"},
+	} {
+		_, err = parseWatchConfig(data)
+		s.Require().NotNil(err, "%v", data)
+		s.Contains(err.Error(), "restart-on-exit")
+	}
+}
+
+func (s *WatchConfigSuite) TestSSH() {
+	config, err := parseWatchConfig(map[string]string{"ssh-host": "dev@box", "ssh-path": "/srv/app"})
+	s.Nil(err)
+	s.Equal("dev@box", config.SSHHost)
+
+	_, err = parseWatchConfig(map[string]string{"ssh-host": "dev@box"})
+	s.NotNil(err)
+	_, err = parseWatchConfig(map[string]string{"ssh-path": "/srv/app"})
+	s.NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestPerFile() {
+	config, err := parseWatchConfig(map[string]string{"per-file-command": "go test {{.File}}", "per-file-mode": "each"})
+	s.Nil(err)
+	s.NotNil(config.PerFileCommand)
+	s.Equal(perFileEach, config.PerFileMode)
+
+	_, err = parseWatchConfig(map[string]string{"per-file-command": "go test {{.File", "per-file-mode": "some"})
+	s.Require().NotNil(err)
+	s.Equal(2, len(err.(WatchConfigError)))
+}
+
+func (s *WatchConfigSuite) TestGroupLogs() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.False(config.GroupLogs)
+
+	config, err = parseWatchConfig(map[string]string{"group-logs": "true"})
+	s.Nil(err)
+	s.True(config.GroupLogs)
+
+	_, err = parseWatchConfig(map[string]string{"group-logs": "sometimes"})
+	s.NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestInterval() {
+	config, err := parseWatchConfig(map[string]string{"reload": "true", "interval": "5m"})
+	s.Nil(err)
+	s.Equal(5*time.Minute, config.Interval)
+	s.Empty(config.Warnings)
+
+	config, err = parseWatchConfig(map[string]string{"interval": "5m"})
+	s.Nil(err)
+	s.Equal(1, len(config.Warnings), "nothing to schedule without reload")
+
+	_, err = parseWatchConfig(map[string]string{"reload": "true", "interval": "-1s"})
+	s.NotNil(err)
+	_, err = parseWatchConfig(map[string]string{"reload": "true", "interval": "1m", "groups": `[{"name": "a", "command": "a", "paths": ["*"]}]`})
+	s.Require().NotNil(err)
+	s.Equal(1, len(err.(WatchConfigError)))
+}
+
+func (s *WatchConfigSuite) TestSetup() {
+	config, err := parseWatchConfig(map[string]string{"code": "npm start", "setup": "npm install"})
+	s.Nil(err)
+	s.Equal("npm install", config.Setup)
+
+	_, err = parseWatchConfig(map[string]string{"setup": "npm install", "groups": `[{"name": "a", "command": "a", "paths": ["*"]}]`})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "setup")
+}
+
+func (s *WatchConfigSuite) TestDebounceMode() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.Equal(debounceLeading, config.DebounceMode)
+	config, err = parseWatchConfig(map[string]string{"debounce_mode": "trailing"})
+	s.Nil(err)
+	s.Equal(debounceTrailing, config.DebounceMode)
+
+	_, err = parseWatchConfig(map[string]string{"debounce-mode": "both"})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "debounce-mode")
+}
+
+func (s *WatchConfigSuite) TestClear() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.False(config.Clear)
+	config, err = parseWatchConfig(map[string]string{"clear": "true"})
+	s.Nil(err)
+	s.True(config.Clear)
+}
+
+func (s *WatchConfigSuite) TestPaths() {
+	config, err := parseWatchConfig(map[string]string{"paths": "services/api, libs/my lib\n./docs/"})
+	s.Nil(err)
+	s.Equal([]string{"services/api", "libs/my lib", "docs"}, config.Paths)
+
+	for _, value := range []string{"/srv/app", " , \n"} {
+		_, err = parseWatchConfig(map[string]string{"paths": value})
+		s.Require().NotNil(err, value)
+		s.Contains(err.Error(), "paths")
+	}
+	_, err = parseWatchConfig(map[string]string{"paths": "src", "watch-from-command": "git ls-files"})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "paths")
+}
+
+func (s *WatchConfigSuite) TestUser() {
+	config, err := parseWatchConfig(map[string]string{"code": "node server.js", "user": "node"})
+	s.Nil(err)
+	s.Equal("node", config.User)
+
+	for _, data := range []map[string]string{
+		{"user": "node; rm -rf /"},
+		{"user": ""},
+		{"user": "-node"},
+		{"user": "node", "groups": `[{"name": "a", "command": "a", "paths": ["*"]}]`},
+	} {
+		_, err = parseWatchConfig(data)
+		s.Require().NotNil(err, "%v", data)
+		s.Contains(err.Error(), "user")
+	}
+}
+
+func (s *WatchConfigSuite) TestInteractive() {
+	config, err := parseWatchConfig(map[string]string{"code": "python", "interactive": "true"})
+	s.Nil(err)
+	s.True(config.Interactive)
+
+	_, err = parseWatchConfig(map[string]string{"interactive": "true", "tmux-session": "dev"})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "interactive")
+
+	_, err = parseWatchConfig(map[string]string{"interactive": "true", "groups": `[{"name": "a", "command": "a", "paths": ["*"]}]`})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "interactive")
+}
+
+func (s *WatchConfigSuite) TestMaxReloadsPerMinute() {
+	config, err := parseWatchConfig(map[string]string{"max_reloads_per_minute": "20"})
+	s.Nil(err)
+	s.Equal(20, config.MaxReloadsPerMinute)
+
+	_, err = parseWatchConfig(map[string]string{"max-reloads-per-minute": "-1"})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "max-reloads-per-minute")
+}
+
+func (s *WatchConfigSuite) TestCommands() {
+	config, err := parseWatchConfig(map[string]string{"commands": "go generate ./...\n\n  go build -o app\n./app"})
+	s.Nil(err)
+	s.Equal([]string{"go generate ./...", "go build -o app", "./app"}, config.Commands)
+	s.Equal(commandsScript(config.Commands), config.Code, "runs in place of code")
+
+	config, err = parseWatchConfig(map[string]string{"commands": "./app"})
+	s.Nil(err)
+	s.Equal("{ ./app\n}", config.Code)
+
+	config, err = parseWatchConfig(map[string]string{"commands": `["go build -o app", "for f in a b; do\n  echo $f\ndone", " "]`})
+	s.Nil(err)
+	s.Equal([]string{"go build -o app", "for f in a b; do\n  echo $f\ndone"}, config.Commands, "a JSON list keeps multi-line commands whole")
+	_, err = parseWatchConfig(map[string]string{"commands": `["./app"`})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "commands")
+
+	_, err = parseWatchConfig(map[string]string{"code": "./app", "commands": "./app"})
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "commands")
+	_, err = parseWatchConfig(map[string]string{"commands": "./app", "groups": `[{"name": "a", "command": "a", "paths": ["*"]}]`})
+	s.Require().NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestIgnoreWrites() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.Empty(config.IgnoreWrites, "off unless set")
+
+	config, err = parseWatchConfig(map[string]string{"ignore-writes": "*.pid, tmp"})
+	s.Nil(err)
+	s.Equal([]string{"*.pid", "tmp"}, config.IgnoreWrites)
+
+	_, err = parseWatchConfig(map[string]string{"ignore-writes": "[a-"})
+	s.NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestDataKeys() {
+	keys, ok := StepDataKeys("internal/watch")
+	s.Require().True(ok)
+	_, ok = StepDataKeys("internal/shell")
+	s.False(ok)
+
+	// The defaults are valid values for their keys
+	data := map[string]string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		s.False(seen[key.Name], "%s is declared twice", key.Name)
+		seen[key.Name] = true
+		if key.Default != "" {
+			data[key.Name] = key.Default
+		}
+	}
+	config, err := parseWatchConfig(data)
+	s.Nil(err)
+	s.Empty(config.Warnings)
+	defaults := defaultWatchConfig()
+	s.Equal(defaults.Events, config.Events)
+	s.Equal(defaults.IgnoreWrites, config.IgnoreWrites)
+	s.Equal(defaults.ReloadBackoffMax, config.ReloadBackoffMax)
+
+	config, err = parseWatchConfig(map[string]string{"relaod": "true"})
+	s.Nil(err)
+	s.Equal([]string{"Ignoring unknown key relaod"}, config.Warnings)
+}
+
+func (s *WatchConfigSuite) TestWaitExit() {
+	config, err := parseWatchConfig(map[string]string{"wait-exit": "true"})
+	s.Nil(err)
+	s.Equal(onExitFinish, config.OnExit)
+
+	config, err = parseWatchConfig(map[string]string{"wait-exit": "true", "reload": "true"})
+	s.Nil(err)
+	s.Equal(onExitWait, config.OnExit)
+	s.Equal(1, len(config.Warnings))
+
+	_, err = parseWatchConfig(map[string]string{"wait-exit": "true", "on-exit": "reload"})
+	s.NotNil(err)
+	_, err = parseWatchConfig(map[string]string{"wait-exit": "true", "tmux-session": "dev"})
+	s.Require().NotNil(err)
+	s.Equal(1, len(err.(WatchConfigError)))
+}
+
+func (s *WatchConfigSuite) TestKillSequence() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.Equal([]killStep{{"INT", 5 * time.Second}, {"KILL", 0}}, config.KillSequence)
+
+	config, err = parseWatchConfig(map[string]string{"kill-sequence": "SIGINT:2s, term:3s, KILL"})
+	s.Nil(err)
+	s.Equal([]killStep{{"INT", 2 * time.Second}, {"TERM", 3 * time.Second}, {"KILL", 0}}, config.KillSequence)
+
+	for _, value := range []string{"INT,KILL", "STOP", "INT:soon,KILL", "INT:0s,KILL", ","} {
+		_, err = parseWatchConfig(map[string]string{"kill-sequence": value})
+		s.NotNil(err, value)
+	}
+}
+
+func (s *WatchConfigSuite) TestSignal() {
+	config, err := parseWatchConfig(map[string]string{"signal": "sigterm"})
+	s.Nil(err)
+	s.Equal([]killStep{{"TERM", 5 * time.Second}, {"KILL", 0}}, config.KillSequence)
+
+	_, err = parseWatchConfig(map[string]string{"signal": "TREM"})
+	s.NotNil(err)
+	config, err = parseWatchConfig(map[string]string{"signal": "TERM", "kill-sequence": "TERM:2s,KILL"})
+	s.Nil(err)
+	s.Equal(2, len(config.KillSequence))
+	_, err = parseWatchConfig(map[string]string{"signal": "HUP", "kill-sequence": "TERM:2s,KILL"})
+	s.NotNil(err)
+}
+
+func (s *WatchConfigSuite) TestKillTimeout() {
+	config, err := parseWatchConfig(map[string]string{"kill_timeout": "1s", "signal": "TERM"})
+	s.Nil(err)
+	s.Equal([]killStep{{"TERM", time.Second}, {"KILL", 0}}, config.KillSequence)
+
+	config, err = parseWatchConfig(map[string]string{"kill-timeout": "0s"})
+	s.Nil(err)
+	s.Equal([]killStep{{Signal: "INT"}}, config.KillSequence, "0 sends the signal only")
+	config, err = parseWatchConfig(map[string]string{"signal": "KILL"})
+	s.Nil(err)
+	s.Equal([]killStep{{Signal: "KILL"}}, config.KillSequence)
+
+	_, err = parseWatchConfig(map[string]string{"kill-timeout": "-1s"})
+	s.NotNil(err)
+	_, err = parseWatchConfig(map[string]string{"kill-timeout": "1s", "kill-sequence": "INT:2s,KILL"})
+	s.NotNil(err)
+	_, err = parseWatchConfig(map[string]string{"kill-timeout": "1s", "kill_timeout": "2s"})
+	s.NotNil(err, "given both ways")
+}
+
+func (s *WatchConfigSuite) TestPoll() {
+	config, err := parseWatchConfig(map[string]string{})
+	s.Nil(err)
+	s.False(config.Poll)
+	s.Equal(time.Second, config.PollInterval)
+
+	config, err = parseWatchConfig(map[string]string{"poll": "true", "poll-interval": "250ms"})
+	s.Nil(err)
+	s.True(config.Poll)
+	s.Equal(250*time.Millisecond, config.PollInterval)
+
+	_, err = parseWatchConfig(map[string]string{"poll-interval": "0s"})
+	s.NotNil(err)
+}
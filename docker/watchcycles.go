@@ -0,0 +1,163 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wercker/wercker/core"
+)
+
+// maxHeaderFiles is how many changed files a group-logs header and the
+// Reloading message name
+const maxHeaderFiles = 3
+
+// logCycles keeps track of the reload whose output we are showing, for the
+// group-logs header and footer and the WatchReloadComplete event. The pump
+// and the reload loop both use it.
+type logCycles struct {
+	mutex   sync.Mutex
+	reload  int
+	files   []string
+	started time.Time
+	code    *int
+	ended   time.Time
+	err     error
+
+	// completed gets every cycle that ends, it's called with the mutex held
+	completed func(*core.WatchReloadCompleteArgs)
+}
+
+// begin starts the output of reload and returns what to print for it, the
+// footer of the previous cycle if it is still open and the new header
+func (c *logCycles) begin(reload int, files []string, now time.Time) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lines := []string{}
+	if footer := c.footer(now); footer != "" {
+		lines = append(lines, footer)
+	}
+	c.reload = reload
+	c.files = files
+	c.started = now
+	c.code = nil
+	c.err = nil
+	return append(lines, cycleHeader(reload, files))
+}
+
+// exited records how the code of reload ended at now, it shows up in the
+// footer. The cycle is complete right away, the footer only waits for the
+// output that comes after the exit.
+func (c *logCycles) exited(reload, code int, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if reload != c.reload || c.code != nil {
+		return
+	}
+	c.code = &code
+	c.ended = now
+	if c.completed != nil {
+		c.completed(c.result(now))
+	}
+}
+
+// failed records that the code of reload couldn't be started
+func (c *logCycles) failed(reload int, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if reload == c.reload {
+		c.err = err
+	}
+}
+
+// end closes the current cycle, the footer is empty if there is none
+func (c *logCycles) end(now time.Time) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.footer(now)
+}
+
+func (c *logCycles) footer(now time.Time) string {
+	if c.reload == 0 {
+		return ""
+	}
+	status := "stopped"
+	if c.code != nil {
+		// exited already completed the cycle
+		now = c.ended
+		status = fmt.Sprintf("exited %d", *c.code)
+	} else if c.completed != nil {
+		c.completed(c.result(now))
+	}
+	ran := now.Sub(c.started)
+	ran -= ran % (100 * time.Millisecond)
+	footer := fmt.Sprintf("--- reload #%d ran %s, %s ---", c.reload, ran, status)
+	c.reload = 0
+	return footer
+}
+
+// result describes the current cycle as it ends at now
+func (c *logCycles) result(now time.Time) *core.WatchReloadCompleteArgs {
+	args := &core.WatchReloadCompleteArgs{
+		Reload:     c.reload,
+		Files:      c.files,
+		ExitCode:   -1,
+		Duration:   now.Sub(c.started),
+		Successful: c.err == nil,
+	}
+	if c.code != nil {
+		args.Exited = true
+		args.ExitCode = *c.code
+		args.Successful = *c.code == 0
+	}
+	if c.err != nil {
+		args.Error = c.err.Error()
+	}
+	return args
+}
+
+func cycleHeader(reload int, files []string) string {
+	if len(files) == 0 {
+		return fmt.Sprintf("--- reload #%d ---", reload)
+	}
+	return fmt.Sprintf("--- reload #%d (%s) ---", reload, fileNames(files))
+}
+
+// reloadMessage is what we log when changes to files reload, files are all
+// the changed ones, deleted ones included. Without files the reload came
+// from the interval or a webhook
+func reloadMessage(files []string) string {
+	if len(files) == 0 {
+		return "Reloading"
+	}
+	return fmt.Sprintf("Reloading (changed: %s)", fileNames(files))
+}
+
+// fileNames lists the first maxHeaderFiles of files and how many more
+// there are
+func fileNames(files []string) string {
+	shown := files
+	if len(shown) > maxHeaderFiles {
+		shown = shown[:maxHeaderFiles]
+	}
+	names := strings.Join(shown, ", ")
+	if extra := len(files) - len(shown); extra > 0 {
+		names = fmt.Sprintf("%s and %d more", names, extra)
+	}
+	return names
+}
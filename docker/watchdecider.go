@@ -0,0 +1,65 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"gopkg.in/fsnotify.v1"
+)
+
+// ReloadDecider decides whether a file system event reloads the code, for
+// code embedding wercker that wants its own policy. changed are the files
+// already waiting for the next reload, groups don't keep track of those so
+// it's always empty for them.
+type ReloadDecider interface {
+	ShouldReload(event fsnotify.Event, changed []string) bool
+}
+
+// ReloadDeciderFunc lets a plain function be a ReloadDecider
+type ReloadDeciderFunc func(event fsnotify.Event, changed []string) bool
+
+// ShouldReload calls f
+func (f ReloadDeciderFunc) ShouldReload(event fsnotify.Event, changed []string) bool {
+	return f(event, changed)
+}
+
+// defaultReloadDecider goes by the step's config: the events, extensions,
+// skip patterns and so on
+type defaultReloadDecider struct {
+	step *WatchStep
+}
+
+func (d defaultReloadDecider) ShouldReload(event fsnotify.Event, changed []string) bool {
+	return d.step.shouldTrigger(event)
+}
+
+// DefaultReloadDecider is what the step uses when no other decider is set,
+// a custom one can wrap it to only change part of the decision
+func (s *WatchStep) DefaultReloadDecider() ReloadDecider {
+	return defaultReloadDecider{step: s}
+}
+
+// SetReloadDecider replaces how the step decides on reloads, nil goes back
+// to the default. It has to be set before Execute.
+func (s *WatchStep) SetReloadDecider(decider ReloadDecider) {
+	s.decider = decider
+}
+
+// reloadDecider is the decider in use
+func (s *WatchStep) reloadDecider() ReloadDecider {
+	if s.decider == nil {
+		return s.DefaultReloadDecider()
+	}
+	return s.decider
+}
@@ -0,0 +1,77 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/wercker/wercker/util"
+)
+
+// opNames spells op the way the events key does, e.g. create|write
+func opNames(op fsnotify.Op) string {
+	names := []string{}
+	for _, name := range []string{"create", "write", "remove", "rename", "chmod"} {
+		if op&watchEventNames[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// With dry-run Execute goes through the same loop as always, only the
+// places that would run or signal something in the container log what they
+// would have done instead. Nothing is sent to the session, so no run ever
+// exits and reloads don't wait for one.
+
+// dryRunLog says what a dry-run would have done. Its methods do nothing on
+// a nil log, which is what a step that isn't a dry-run has.
+type dryRunLog struct {
+	logger *util.LogEntry
+	f      *util.Formatter
+}
+
+func (d *dryRunLog) say(message string) {
+	if d == nil {
+		return
+	}
+	d.logger.Info(d.f.Info("dry-run", message))
+}
+
+// event says what came of a file event, name relative to the project
+func (d *dryRunLog) event(event fsnotify.Event, project, outcome string) {
+	name := event.Name
+	if rel, err := filepath.Rel(project, event.Name); err == nil {
+		name = rel
+	}
+	d.say(fmt.Sprintf("%s %s, %s", opNames(event.Op), name, outcome))
+}
+
+// dryRunCommand says what reload would send to the container, setup only
+// comes first on the first one as nothing ever says it's done
+func (s *WatchStep) dryRunCommand(reload int, files []string) {
+	if s.config.Setup != "" && reload == 1 {
+		s.dryRun.say("would run the setup first: " + s.asUser(s.config.Setup))
+	}
+	message := "would run: " + s.command()
+	if len(files) > 0 {
+		message += fmt.Sprintf(" (changed: %s)", fileNames(files))
+	}
+	s.dryRun.say(message)
+}
@@ -0,0 +1,172 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// commandExit is how a run of the code ended on its own
+type commandExit struct {
+	reload int
+	code   int
+}
+
+// runExits keeps the exit codes the sentinel reported by reload, the ones
+// of runs that were stopped included, so whoever started a run can wait
+// for it to end
+type runExits struct {
+	mutex sync.Mutex
+	codes map[int]int
+	waits map[int]chan struct{}
+	calls map[int][]func(int)
+}
+
+func newRunExits() *runExits {
+	return &runExits{codes: map[int]int{}, waits: map[int]chan struct{}{}, calls: map[int][]func(int){}}
+}
+
+// exited records the exit code of reload, only the first one counts
+func (r *runExits) exited(reload, code int) {
+	r.mutex.Lock()
+	if _, ok := r.codes[reload]; ok {
+		r.mutex.Unlock()
+		return
+	}
+	r.codes[reload] = code
+	if wait, ok := r.waits[reload]; ok {
+		close(wait)
+	} else {
+		wait := make(chan struct{})
+		close(wait)
+		r.waits[reload] = wait
+	}
+	calls := r.calls[reload]
+	delete(r.calls, reload)
+	r.mutex.Unlock()
+	for _, call := range calls {
+		call(code)
+	}
+}
+
+// onExit calls do with the exit code of reload once it exited, right away
+// if it did already
+func (r *runExits) onExit(reload int, do func(code int)) {
+	r.mutex.Lock()
+	code, ok := r.codes[reload]
+	if !ok {
+		r.calls[reload] = append(r.calls[reload], do)
+	}
+	r.mutex.Unlock()
+	if ok {
+		do(code)
+	}
+}
+
+// wait is closed once reload exited
+func (r *runExits) wait(reload int) <-chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	wait, ok := r.waits[reload]
+	if !ok {
+		wait = make(chan struct{})
+		r.waits[reload] = wait
+	}
+	return wait
+}
+
+// code is the exit code of reload, if it exited
+func (r *runExits) code(reload int) (int, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	code, ok := r.codes[reload]
+	return code, ok
+}
+
+// exitSentinel marks the lines exitCommand prints, it's unique to the step
+// so nothing the code prints is mistaken for one
+func (s *WatchStep) exitSentinel() string {
+	return "wercker-watch-exit-" + s.SafeID()
+}
+
+// exitCommand runs right after the code, the shell only gets to it once
+// the code is done, so it tells us the code exited and with what. The run
+// it belongs to is part of the line since a run we kill for a reload
+// prints it too. The exit codes end up in the WatchReloadComplete events
+// and the group-logs footers.
+func (s *WatchStep) exitCommand(reload int) string {
+	return fmt.Sprintf(`echo "%s %d $?"`, s.exitSentinel(), reload)
+}
+
+// withExit puts exitCommand on the line that ends cmd. The shell reads that
+// whole line before it runs cmd, so code reading stdin, a REPL with
+// interactive, can't take the exit line for input.
+func (s *WatchStep) withExit(reload int, cmd string) string {
+	return fmt.Sprintf("{ %s\n}; %s", cmd, s.exitCommand(reload))
+}
+
+// waitsForExit says whether builds wait for the exit line of their run. A
+// tmux pane is respawned for the next reload whether its code is done or
+// not, and a dry-run runs nothing that could exit.
+func (s *WatchStep) waitsForExit() bool {
+	return s.config.TmuxSession == "" && !s.config.DryRun
+}
+
+// tmuxExitFile is where the code in the tmux pane leaves its exit code
+func (s *WatchStep) tmuxExitFile(reload int) string {
+	return fmt.Sprintf("/tmp/wercker-watch-%s.exit-%d", s.SafeID(), reload)
+}
+
+// tmuxExitCommand does what exitCommand does for code running in the tmux
+// pane. The pane's shell isn't ours, so the pane writes the exit code to
+// tmuxExitFile and a job in the background of our shell waits for that.
+// Once the pane is respawned for the next reload the job gives up, that
+// run was stopped.
+func (s *WatchStep) tmuxExitCommand(reload int) string {
+	file := shellQuote(s.tmuxExitFile(reload))
+	pid := fmt.Sprintf(`tmux display-message -p -t %s '#{pane_pid}'`, shellQuote(s.config.TmuxSession))
+	return fmt.Sprintf(`{ pid=$(%[1]s); while [ ! -s %[2]s ] && [ "$(%[1]s)" = "$pid" ]; do sleep 0.2; done; [ -s %[2]s ] && echo "%[3]s %[4]d $(cat %[2]s)"; rm -f %[2]s; } &`, pid, file, s.exitSentinel(), reload)
+}
+
+// actsOnExit tells whether the code exiting on its own does anything
+func (s *WatchStep) actsOnExit() bool {
+	return s.config.OnExit == onExitReload || s.config.OnExit == onExitFinish
+}
+
+// parseCommandExits takes the lines exitCommand printed out of some output
+func (s *WatchStep) parseCommandExits(output string) (string, []commandExit) {
+	sentinel := s.exitSentinel()
+	if !strings.Contains(output, sentinel) {
+		return output, nil
+	}
+	kept := []string{}
+	exits := []commandExit{}
+	for _, line := range strings.SplitAfter(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == sentinel {
+			reload, err := strconv.Atoi(fields[1])
+			code, err2 := strconv.Atoi(fields[2])
+			if err == nil && err2 == nil {
+				exits = append(exits, commandExit{reload: reload, code: code})
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, ""), exits
+}
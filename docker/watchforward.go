@@ -0,0 +1,144 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/wercker/wercker/util"
+)
+
+// forwardDialTimeout is how long a forwarded connection waits for the
+// docker host to answer
+const forwardDialTimeout = 5 * time.Second
+
+// portForwarder makes the ports published on a remote docker host, a
+// docker-machine VM say, reachable on localhost. Docker publishes them on
+// its own host already, the forwarder just relays TCP connections there.
+type portForwarder struct {
+	mutex     sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	logger    *util.LogEntry
+}
+
+func newPortForwarder(logger *util.LogEntry) *portForwarder {
+	return &portForwarder{conns: map[net.Conn]bool{}, logger: logger}
+}
+
+// isLocalHostURI tells whether a published port is on this machine
+// already, those need no forward
+func isLocalHostURI(uri string) bool {
+	host, _, err := net.SplitHostPort(uri)
+	if err != nil {
+		return false
+	}
+	if host == "" || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// forward listens on local and relays every connection to target,
+// returning the address it listens on
+func (p *portForwarder) forward(local, target string) (string, error) {
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		return "", err
+	}
+	p.mutex.Lock()
+	p.listeners = append(p.listeners, listener)
+	p.mutex.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.relay(conn, target)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+func (p *portForwarder) relay(conn net.Conn, target string) {
+	upstream, err := net.DialTimeout("tcp", target, forwardDialTimeout)
+	if err != nil {
+		p.logger.Debugln("Unable to forward connection to", target, err)
+		conn.Close()
+		return
+	}
+	if !p.track(conn, upstream) {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	conn.Close()
+	upstream.Close()
+	<-done
+	p.untrack(conn, upstream)
+}
+
+// track remembers conns so stop can close them, it refuses once stop has
+// closed the listeners
+func (p *portForwarder) track(conns ...net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.listeners == nil {
+		return false
+	}
+	for _, conn := range conns {
+		p.conns[conn] = true
+	}
+	return true
+}
+
+func (p *portForwarder) untrack(conns ...net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range conns {
+		delete(p.conns, conn)
+	}
+}
+
+// stop closes the listeners and every forwarded connection, a nil
+// forwarder does nothing
+func (p *portForwarder) stop() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+	p.listeners = nil
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = map[net.Conn]bool{}
+}
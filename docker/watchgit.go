@@ -0,0 +1,122 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bufio"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// gitStatus maps the tracked files git sees as changed to their status
+// code from `git status --porcelain`
+type gitStatus map[string]string
+
+// parseGitStatus reads porcelain v1 output, for renames only the new path
+// is kept
+func parseGitStatus(output string) gitStatus {
+	status := gitStatus{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 4 {
+			continue
+		}
+		code, path := line[:2], line[3:]
+		if i := strings.Index(path, " -> "); i != -1 {
+			path = path[i+4:]
+		}
+		status[strings.Trim(path, `"`)] = code
+	}
+	return status
+}
+
+// gitChanges turns the difference between two statuses into events for
+// the files involved, sorted by path
+func gitChanges(root string, previous, current gitStatus) []fsnotify.Event {
+	events := []fsnotify.Event{}
+	for path, code := range current {
+		if previous[path] == code {
+			continue
+		}
+		op := fsnotify.Write
+		if strings.Contains(code, "A") {
+			op = fsnotify.Create
+		} else if strings.Contains(code, "D") {
+			op = fsnotify.Remove
+		}
+		events = append(events, fsnotify.Event{Name: filepath.Join(root, path), Op: op})
+	}
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			// reverted or committed, either way the file changed again
+			events = append(events, fsnotify.Event{Name: filepath.Join(root, path), Op: fsnotify.Write})
+		}
+	}
+	sort.Sort(eventsByName(events))
+	return events
+}
+
+type eventsByName []fsnotify.Event
+
+func (e eventsByName) Len() int           { return len(e) }
+func (e eventsByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e eventsByName) Less(i, j int) bool { return e[i].Name < e[j].Name }
+
+// readGitStatus asks git which tracked files changed in root
+func (s *WatchStep) readGitStatus(root string) (gitStatus, error) {
+	cmd := execCommand("git", "status", "--porcelain", "--untracked-files=no")
+	cmd.Dir = root
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseGitStatus(string(output)), nil
+}
+
+// watchGit polls git every git-trigger-interval and sends the files whose
+// status changed, until stop is closed. Saving a file that was already
+// modified doesn't change its status, so it doesn't trigger a reload. It
+// gives up right away if the first git status fails.
+func (s *WatchStep) watchGit(root string, changes chan<- []fsnotify.Event, stop <-chan struct{}) {
+	previous, err := s.readGitStatus(root)
+	if err != nil {
+		s.logger.Warnln("Unable to read git status, git-trigger is off:", err)
+		return
+	}
+	for {
+		select {
+		case <-s.clock.After(s.config.GitTriggerInterval):
+			current, err := s.readGitStatus(root)
+			if err != nil {
+				s.logger.Debugln("git status failed:", err)
+				continue
+			}
+			if events := gitChanges(root, previous, current); len(events) > 0 {
+				select {
+				case changes <- events:
+				case <-stop:
+					return
+				}
+			}
+			previous = current
+		case <-stop:
+			return
+		}
+	}
+}
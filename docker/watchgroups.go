@@ -0,0 +1,267 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+// matches checks whether a path relative to the project root belongs to
+// the group, either matching one of its patterns or sitting in a directory
+// that does
+func (g WatchGroup) matches(rel string) bool {
+	for _, pattern := range g.Paths {
+		for p := rel; p != "." && p != "/" && p != ""; p = filepath.Dir(p) {
+			if ok, _ := filepath.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pidfile is where the group's process id is kept in the container
+func (g WatchGroup) pidfile() string {
+	return fmt.Sprintf("/tmp/wercker-watch-%s.pid", g.Name)
+}
+
+// reloadCommand starts the group again in the background, stopGroup has
+// stopped its previous run. Each run gets its own process group through
+// setsid so only this group's processes are signalled.
+func (g WatchGroup) reloadCommand() string {
+	return fmt.Sprintf(`setsid sh -c %s & echo $! > %s`, shellQuote(g.Command), shellQuote(g.pidfile()))
+}
+
+// killCommand signals the process group of the group's last run and echoes
+// it as a negative PID, it echoes nothing if there's no run to signal
+func (g WatchGroup) killCommand(signal string) string {
+	return fmt.Sprintf(`pgid=$(cat %s 2>/dev/null); [ -n "$pgid" ] && kill -s %s -- -$pgid 2>/dev/null && echo -$pgid; true`, shellQuote(g.pidfile()), signal)
+}
+
+// stopGroup walks kill-sequence against the process group of g's last run,
+// the way stopProcesses does for the single command
+func (s *WatchStep) stopGroup(containerID string, g WatchGroup) error {
+	client, err := s.dockerClient()
+	if err != nil {
+		return err
+	}
+	return s.walkKillSequence(containerID, func(signal string) (signalled, error) {
+		var output bytes.Buffer
+		if err := client.ExecOne(containerID, []string{"/bin/sh", "-c", g.killCommand(signal)}, &output); err != nil {
+			return signalled{}, err
+		}
+		return signalled{pids: parseKilledPids(output.String())}, nil
+	})
+}
+
+// groupRunner reloads a single group, a reload requested while one is in
+// flight waits for it to finish and several of those collapse into one
+type groupRunner struct {
+	group    WatchGroup
+	debounce *util.Debouncer
+	pending  chan struct{}
+}
+
+// request asks for a reload, one already pending covers it
+func (r *groupRunner) request() {
+	select {
+	case r.pending <- struct{}{}:
+	default:
+	}
+}
+
+// groupPause holds the groups' reloads back while SIGUSR2 has paused them,
+// the groups that came up meanwhile reload once on resume
+type groupPause struct {
+	mutex  sync.Mutex
+	paused bool
+	held   []*groupRunner
+}
+
+func (p *groupPause) request(r *groupRunner) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.paused {
+		r.request()
+		return
+	}
+	for _, held := range p.held {
+		if held == r {
+			return
+		}
+	}
+	p.held = append(p.held, r)
+}
+
+// toggle pauses or resumes and says whether it's paused now
+func (p *groupPause) toggle() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.paused = !p.paused
+	if !p.paused {
+		for _, r := range p.held {
+			r.request()
+		}
+		p.held = nil
+	}
+	return p.paused
+}
+
+// executeGroups is the watch loop used when the groups key is set. There's
+// one watcher for the project and changes are routed to the debouncer of
+// every group they belong to, changes outside any group are ignored.
+func (s *WatchStep) executeGroups(ctx context.Context, sess *core.Session, watcher fileWatcher, finishedStep <-chan struct{}, containerID string, f *util.Formatter) (int, error) {
+	runners := make([]*groupRunner, len(s.config.Groups))
+	for i, group := range s.config.Groups {
+		runners[i] = &groupRunner{
+			group:    group,
+			debounce: s.newDebouncer(),
+			pending:  make(chan struct{}, 1),
+		}
+	}
+
+	root := s.watchRoot()
+	stop := make(chan struct{})
+	pause := &groupPause{}
+	var wg sync.WaitGroup
+	for _, r := range runners {
+		wg.Add(2)
+		go func(r *groupRunner) {
+			defer wg.Done()
+			for {
+				select {
+				case <-r.debounce.C:
+					pause.request(r)
+				case <-stop:
+					return
+				}
+			}
+		}(r)
+		go func(r *groupRunner) {
+			defer wg.Done()
+			for {
+				select {
+				case <-r.pending:
+					s.logger.Info(f.Info("Reloading", r.group.Name))
+					if s.config.DryRun {
+						s.dryRun.say("would run: " + r.group.Command)
+						continue
+					}
+					if err := s.stopGroup(containerID, r.group); err != nil {
+						s.logger.Errorln(f.Fail("Unable to stop "+r.group.Name), err)
+						continue
+					}
+					if err := sess.Send(ctx, false, "set +e", r.group.reloadCommand()); err != nil {
+						s.logger.Errorln(f.Fail("Reloading "+r.group.Name+" failed"), err)
+					}
+				case <-stop:
+					return
+				}
+			}
+		}(r)
+	}
+	teardown := func() {
+		close(stop)
+		wg.Wait()
+		for _, r := range runners {
+			r.debounce.Stop()
+		}
+		s.stopProcesses(containerID)
+	}
+
+	// SIGUSR2 pauses and resumes the groups like it does the single
+	// command, the handler has to be put back after every use
+	togglePause := make(chan struct{})
+	pauseHandler := &util.SignalHandler{
+		ID: "pause-watch",
+		F: func() bool {
+			select {
+			case togglePause <- struct{}{}:
+			default:
+			}
+			return false
+		},
+	}
+	util.GlobalSigusr2().Add(pauseHandler)
+	defer util.GlobalSigusr2().Remove(pauseHandler)
+
+	// Start every group once
+	for _, r := range runners {
+		r.debounce.Trigger()
+	}
+	s.markReady()
+	for {
+		select {
+		case <-togglePause:
+			util.GlobalSigusr2().Add(pauseHandler)
+			if pause.toggle() {
+				s.logger.Info(f.Info("Paused, changes won't reload until the next SIGUSR2"))
+			} else {
+				s.logger.Info(f.Info("Resumed"))
+			}
+		case event, ok := <-watcher.Events():
+			if !ok {
+				s.logger.Error(errWatcherClosed)
+				teardown()
+				return -1, errWatcherClosed
+			}
+			s.logger.Debugln("fsnotify event", event.String())
+			s.followDirs(watcher, root, event)
+			if !s.reloadDecider().ShouldReload(event, nil) {
+				s.dryRun.event(event, s.options.ProjectPath, "ignored")
+				continue
+			}
+			rel, err := filepath.Rel(s.options.ProjectPath, event.Name)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			pending := []string{}
+			for _, r := range runners {
+				if r.group.matches(rel) {
+					s.logger.Debug(f.Info("Modified file", event.Name), r.group.Name)
+					s.status.trigger(event.Name)
+					r.debounce.Trigger()
+					pending = append(pending, r.group.Name)
+				}
+			}
+			if len(pending) == 0 {
+				s.dryRun.event(event, s.options.ProjectPath, "in no group, ignored")
+			} else {
+				s.dryRun.event(event, s.options.ProjectPath, "reload pending for "+strings.Join(pending, ", "))
+			}
+		case err, ok := <-watcher.Errors():
+			if !ok {
+				err = errWatcherClosed
+			}
+			s.logger.Error(err)
+			teardown()
+			return -1, err
+		case <-ctx.Done():
+			teardown()
+			return -1, errContainerGone
+		case <-finishedStep:
+			teardown()
+			return 0, nil
+		}
+	}
+}
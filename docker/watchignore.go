@@ -0,0 +1,120 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// dirFilters are the exclusion patterns in effect in each directory under
+// root, watchFilters plus the ignore files of the directory and the ones
+// above it. Patterns of a nested ignore file are relative to its directory
+// the way the root's are to root. A trailing slash makes no difference
+// since only directories are matched, negated patterns are skipped.
+type dirFilters struct {
+	step  *WatchStep
+	root  string
+	base  []string
+	byDir map[string][]string
+}
+
+func (s *WatchStep) newDirFilters(root string) *dirFilters {
+	return &dirFilters{
+		step:  s,
+		root:  root,
+		base:  s.watchFilters(root),
+		byDir: map[string][]string{},
+	}
+}
+
+// match tells whether the directory path is excluded and by which pattern,
+// it is checked against the filters of its parent
+func (f *dirFilters) match(path string) (string, bool) {
+	return f.step.matchFilters(f.filters(filepath.Dir(path)), path)
+}
+
+// filters returns the patterns in effect in dir, reading the ignore files
+// between root and dir the first time they are needed
+func (f *dirFilters) filters(dir string) []string {
+	if filters, ok := f.byDir[dir]; ok {
+		return filters
+	}
+	if dir == f.root || !inDir(f.root, dir) {
+		// watchFilters already has root's ignore files
+		return f.base
+	}
+	filters := f.filters(filepath.Dir(dir))
+	for _, name := range f.step.config.IgnoreFiles {
+		if nested := f.step.loadIgnoreFile(dir, name); len(nested) > 0 {
+			filters = append(append([]string{}, filters...), nested...)
+		}
+	}
+	f.byDir[dir] = filters
+	return filters
+}
+
+// inDir tells whether path is dir or somewhere below it
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// excludedLocation returns the pattern that excludes one of the directories
+// path is in, going from root down to its parent
+func (f *dirFilters) excludedLocation(path string) (string, bool) {
+	dir := filepath.Dir(path)
+	if dir == f.root || !inDir(f.root, dir) {
+		return "", false
+	}
+	if pattern, excluded := f.excludedLocation(dir); excluded {
+		return pattern, true
+	}
+	return f.match(dir)
+}
+
+// eventFilters are the dirFilters the event loop checks changes against,
+// built on first use and dropped when the ignore rules change
+type eventFilters struct {
+	mutex   sync.Mutex
+	filters *dirFilters
+}
+
+func (e *eventFilters) reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.filters = nil
+}
+
+// excludedLocation tells whether path is below a directory the walk leaves
+// out, wercker's internal directories or one the filters exclude. Events
+// from there shouldn't arrive since nothing is watched there, but a watch
+// added before the ignore rules changed or a directory the poller picked
+// up would still deliver them, so the event loop checks every path itself.
+func (s *WatchStep) excludedLocation(path string) (string, bool) {
+	if dir, internal := s.internalDir(path); internal {
+		return dir, true
+	}
+	if s.options == nil {
+		return "", false
+	}
+	s.eventFilters.mutex.Lock()
+	defer s.eventFilters.mutex.Unlock()
+	if s.eventFilters.filters == nil {
+		s.eventFilters.filters = s.newDirFilters(s.watchRoot())
+	}
+	return s.eventFilters.filters.excludedLocation(path)
+}
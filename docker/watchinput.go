@@ -0,0 +1,49 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// forwardInput passes the lines read from in on to the code for
+// interactive, until in runs out, send fails or stop is closed. The code
+// shares its stdin with the shell of the session, so a line typed while
+// nothing runs would be run as a command, those are dropped instead. The
+// terminal stays in line mode so Ctrl-C still reaches our SIGINT handler.
+func (s *WatchStep) forwardInput(in io.Reader, send func(string) error, stop <-chan struct{}) {
+	reader := bufio.NewReader(in)
+	for {
+		line, err := reader.ReadString('\n')
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if line != "" {
+			if !s.status.running() {
+				s.logger.Warnln("Dropping input, the code isn't running:", strings.TrimSuffix(line, "\n"))
+			} else if sendErr := send(strings.TrimSuffix(line, "\n")); sendErr != nil {
+				s.logger.Debugln("Not forwarding input any longer:", sendErr)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
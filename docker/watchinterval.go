@@ -0,0 +1,66 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"time"
+
+	"github.com/wercker/wercker/util"
+)
+
+// reloadSchedule ticks every interval for the interval key. Every reload
+// starts the wait over, so a tick never comes right after a reload for a
+// file change. A nil schedule never ticks.
+type reloadSchedule struct {
+	interval time.Duration
+	timer    util.ClockTimer
+}
+
+// newReloadSchedule returns nil when interval is off
+func newReloadSchedule(clock util.Clock, interval time.Duration) *reloadSchedule {
+	if interval <= 0 {
+		return nil
+	}
+	return &reloadSchedule{interval: interval, timer: clock.NewTimer(interval)}
+}
+
+// C is where the ticks arrive
+func (r *reloadSchedule) C() <-chan time.Time {
+	if r == nil {
+		return nil
+	}
+	return r.timer.C()
+}
+
+// restart waits a whole interval from now, dropping a tick that wasn't
+// read yet
+func (r *reloadSchedule) restart() {
+	if r == nil {
+		return
+	}
+	if !r.timer.Stop() {
+		select {
+		case <-r.timer.C():
+		default:
+		}
+	}
+	r.timer.Reset(r.interval)
+}
+
+func (r *reloadSchedule) stop() {
+	if r != nil {
+		r.timer.Stop()
+	}
+}
@@ -0,0 +1,309 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wercker/wercker/util"
+)
+
+// killStep is one entry of kill-sequence, the signal and how long the
+// processes get to exit before the next entry
+type killStep struct {
+	Signal string
+	Wait   time.Duration
+}
+
+// defaultKillTimeout is how long the code gets after signal before KILL
+const defaultKillTimeout = 5 * time.Second
+
+// timeoutKillSequence is the kill-sequence signal and kill-timeout stand
+// for, signal followed by KILL unless the timeout is 0
+func timeoutKillSequence(signal string, timeout time.Duration) []killStep {
+	if timeout <= 0 || signal == "KILL" {
+		return []killStep{{Signal: signal}}
+	}
+	return []killStep{{Signal: signal, Wait: timeout}, {Signal: "KILL"}}
+}
+
+// killableSignals are the names kill-sequence accepts
+var killableSignals = map[string]bool{
+	"HUP": true, "INT": true, "QUIT": true, "KILL": true, "TERM": true, "USR1": true, "USR2": true,
+}
+
+// killPollInterval is how often we check whether the processes are gone
+// while waiting between the signals of kill-sequence
+const killPollInterval = 100 * time.Millisecond
+
+// parseKillSequence reads kill-sequence, e.g. INT:2s,TERM:3s,KILL sends
+// INT, gives the processes 2s, sends TERM, gives them 3s and sends KILL.
+// Every entry but the last needs a wait.
+func parseKillSequence(value string) ([]killStep, error) {
+	steps := []killStep{}
+	entries := splitList(value)
+	for i, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		name, err := parseSignal(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		step := killStep{Signal: name}
+		if len(parts) == 2 {
+			wait, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			if wait <= 0 {
+				return nil, fmt.Errorf("the wait after %s must be positive", name)
+			}
+			step.Wait = wait
+		} else if i < len(entries)-1 {
+			return nil, fmt.Errorf("%s needs a wait like %s:2s before the next signal", name, name)
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no signals given")
+	}
+	return steps, nil
+}
+
+// parseSignal checks a signal name, with or without SIG in front, and
+// returns it the way kill -s takes it
+func parseSignal(value string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "SIG")
+	if !killableSignals[name] {
+		return "", fmt.Errorf("unknown signal %q, expected one of HUP, INT, QUIT, KILL, TERM, USR1, USR2", value)
+	}
+	return name, nil
+}
+
+// procUnavailable is what procKillCommand exits with in a container
+// without /proc
+const procUnavailable = 3
+
+// procKillCommand is killCommand for containers without ps, awk or grep, it
+// finds the processes in /proc and only uses what's built into sh. It leaves
+// out PID 1, the shell itself and the keep-pidfiles, and with kill-group
+// signals the code's process group first. Without /proc it exits with
+// procUnavailable before signalling anything.
+func (s *WatchStep) procKillCommand(signal string) string {
+	keep := ""
+	if len(s.config.KeepPidfiles) > 0 {
+		reads := make([]string, len(s.config.KeepPidfiles))
+		for i, path := range s.config.KeepPidfiles {
+			reads[i] = fmt.Sprintf(`{ p=; read p < %s; } 2>/dev/null; keep="$keep$p "`, shellQuote(path))
+		}
+		keep = strings.Join(reads, "; ") + "; "
+	}
+	all := fmt.Sprintf(`[ -d /proc/1 ] || exit %d; keep=" "; %sfor dir in /proc/[0-9]*; do pid=${dir#/proc/}; case "$keep" in *" $pid "*) continue ;; esac; [ "$pid" = 1 ] || [ "$pid" = $$ ] && continue; kill -s %s $pid 2>/dev/null && echo $pid; done; true`, procUnavailable, keep, signal)
+	if !s.config.KillGroup {
+		return all
+	}
+	return fmt.Sprintf(`pgid=; { read pgid < %[1]s; } 2>/dev/null; if [ -n "$pgid" ] && [ "$pgid" != 1 ] && kill -s %[2]s -- -$pgid 2>/dev/null; then echo -$pgid; else %[3]s; fi`, shellQuote(s.groupPidfile()), signal, all)
+}
+
+// forceStop makes stopProcesses skip what's left of kill-sequence and KILL
+// everything, for a second Ctrl-C. Calling it again does nothing.
+func (s *WatchStep) forceStop() {
+	s.forcedOnce.Do(func() { close(s.forced) })
+}
+
+// stopWatchHandler finishes the step on the first Ctrl-C, it stays
+// registered so the second one cuts the stopping short. The second one
+// returns true too, so the handlers that clean up the build and its
+// containers and exit still run if the KILL hangs.
+func (s *WatchStep) stopWatchHandler(finishedStep chan<- struct{}) *util.SignalHandler {
+	interrupted := false
+	return &util.SignalHandler{
+		ID: "stop-watch",
+		F: func() bool {
+			if interrupted {
+				s.logger.Println("Second keyboard interrupt, killing the code and shutting down")
+				s.forceStop()
+				return true
+			}
+			interrupted = true
+			s.logger.Println("Keyboard interrupt detected, finishing step, press Ctrl-C again to kill the code right away")
+			// Dispatch holds the monkey's lock while we run, blocking here
+			// until the loop gets around to it would keep the second
+			// Ctrl-C from ever reaching us
+			select {
+			case finishedStep <- struct{}{}:
+			default:
+			}
+			return false
+		},
+		Persistent: true,
+	}
+}
+
+// stopProcesses walks kill-sequence, moving on to the next signal only if
+// something that got the previous one is still running after its wait
+func (s *WatchStep) stopProcesses(containerID string) error {
+	if s.config.DryRun {
+		s.dryRun.say("would stop the code with SIG" + s.config.KillSequence[0].Signal)
+		return nil
+	}
+	return s.walkKillSequence(containerID, func(signal string) (signalled, error) {
+		return s.signalProcesses(containerID, signal)
+	})
+}
+
+// walkKillSequence is stopProcesses for whatever signal signals, what got
+// a signal is checked on in between like stopProcesses does
+func (s *WatchStep) walkKillSequence(containerID string, signal func(signal string) (signalled, error)) error {
+	sequence := s.config.KillSequence
+	for i, step := range sequence {
+		select {
+		case <-s.forced:
+			_, err := signal("KILL")
+			return err
+		default:
+		}
+		sent, err := signal(step.Signal)
+		if err != nil {
+			return err
+		}
+		if i == len(sequence)-1 || len(sent.pids) == 0 {
+			return nil
+		}
+		deadline := s.clock.Now().Add(step.Wait)
+		for {
+			alive, err := s.alivePids(containerID, sent)
+			if err != nil {
+				return err
+			}
+			if len(alive) == 0 {
+				return nil
+			}
+			if !s.clock.Now().Before(deadline) {
+				s.logger.Debugf("PIDs %s still running %s after SIG%s", strings.Join(alive, " "), step.Wait, step.Signal)
+				break
+			}
+			select {
+			case <-s.clock.After(killPollInterval):
+			case <-s.forced:
+				_, err := signal("KILL")
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// alivePids returns the PIDs of sent that are still running, negative ones
+// are process groups
+func (s *WatchStep) alivePids(containerID string, sent signalled) ([]string, error) {
+	client, err := s.dockerClient()
+	if err != nil {
+		return nil, err
+	}
+	if sent.top {
+		running, err := topPids(client, containerID)
+		if err != nil {
+			return nil, err
+		}
+		alive := []string{}
+		for _, pid := range sent.pids {
+			for _, other := range running {
+				if pid == other {
+					alive = append(alive, pid)
+					break
+				}
+			}
+		}
+		return alive, nil
+	}
+	var output bytes.Buffer
+	cmd := []string{`/bin/sh`, `-c`, fmt.Sprintf(`for pid in %s; do kill -s 0 -- $pid 2>/dev/null && echo $pid; done`, strings.Join(sent.pids, " "))}
+	if err := client.ExecOne(containerID, cmd, &output); err != nil {
+		return nil, err
+	}
+	return parseKilledPids(output.String()), nil
+}
+
+// signalled is what signalProcesses sent a signal to. PIDs from docker top
+// are the docker host's, the shell pipelines echo the container's.
+type signalled struct {
+	pids []string
+	top  bool
+}
+
+// topPids lists the processes in the container through docker top, leaving
+// out PID 1. They're PIDs on the docker host, not in the container.
+func topPids(client watchClient, containerID string) ([]string, error) {
+	container, err := client.InspectContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	top, err := client.TopContainer(containerID, "")
+	if err != nil {
+		return nil, err
+	}
+	column := -1
+	for i, title := range top.Titles {
+		if title == "PID" {
+			column = i
+		}
+	}
+	if column < 0 {
+		return nil, fmt.Errorf("docker top has no PID column: %s", strings.Join(top.Titles, " "))
+	}
+	pid1 := ""
+	if container.State.Pid != 0 {
+		pid1 = strconv.Itoa(container.State.Pid)
+	}
+	pids := []string{}
+	for _, process := range top.Processes {
+		if column < len(process) && process[column] != pid1 {
+			pids = append(pids, process[column])
+		}
+	}
+	return pids, nil
+}
+
+// apiSignal signals everything in the container but PID 1 without a shell,
+// the processes are listed through docker top and signalled by running kill
+// in the container. docker top's PIDs aren't the container's, so kill gets
+// -1, which is everything but PID 1 and kill itself. Only kill is needed in
+// the image. kill-group and keep-pidfiles read files in the container, they
+// need the shell pipelines.
+func (s *WatchStep) apiSignal(client watchClient, containerID string, signal string) (signalled, error) {
+	if s.config.KillGroup || len(s.config.KeepPidfiles) > 0 {
+		return signalled{}, fmt.Errorf("kill-group and keep-pidfiles need a shell")
+	}
+	pids, err := topPids(client, containerID)
+	if err != nil {
+		return signalled{}, err
+	}
+	if len(pids) == 0 {
+		return signalled{top: true, pids: pids}, nil
+	}
+	codes, err := client.ExecAll(containerID, [][]string{{"kill", "-s", signal, "--", "-1"}}, ioutil.Discard)
+	if err != nil {
+		return signalled{}, err
+	}
+	if codes[0] != 0 {
+		return signalled{}, fmt.Errorf("kill exited with %d", codes[0])
+	}
+	return signalled{top: true, pids: pids}, nil
+}
@@ -0,0 +1,102 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// reloadLimitWindow is the rolling window max-reloads-per-minute counts in
+const reloadLimitWindow = time.Minute
+
+// reloadLimiter counts the reloads of the last window, for
+// max-reloads-per-minute. Something in the container rewriting files in the
+// project would otherwise reload us forever. Only the watch loop uses it.
+type reloadLimiter struct {
+	max     int
+	window  time.Duration
+	reloads []limitedReload
+}
+
+type limitedReload struct {
+	at    time.Time
+	files []string
+}
+
+func newReloadLimiter(max int, window time.Duration) *reloadLimiter {
+	return &reloadLimiter{max: max, window: window}
+}
+
+// allow records a reload of files at now if there's room for it in the
+// window, otherwise it returns how long until there is. A max of 0 allows
+// everything, so does a nil limiter.
+func (l *reloadLimiter) allow(now time.Time, files []string) (time.Duration, bool) {
+	if l == nil || l.max <= 0 {
+		return 0, true
+	}
+	start := now.Add(-l.window)
+	kept := l.reloads[:0]
+	for _, r := range l.reloads {
+		if r.at.After(start) {
+			kept = append(kept, r)
+		}
+	}
+	l.reloads = kept
+	if len(l.reloads) >= l.max {
+		return l.reloads[0].at.Add(l.window).Sub(now), false
+	}
+	l.reloads = append(l.reloads, limitedReload{at: now, files: files})
+	return 0, true
+}
+
+// busiest is the file that changed in the most reloads of the window,
+// counting files as well, ties go to the first name. It's empty if no
+// files were involved, e.g. for interval reloads.
+func (l *reloadLimiter) busiest(files []string) string {
+	counts := map[string]int{}
+	for _, r := range l.reloads {
+		for _, file := range r.files {
+			counts[file]++
+		}
+	}
+	for _, file := range files {
+		counts[file]++
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	busiest := ""
+	for _, name := range names {
+		if busiest == "" || counts[name] > counts[busiest] {
+			busiest = name
+		}
+	}
+	return busiest
+}
+
+// reloadLimitMessage tells the user reloads are held back for wait and which
+// file is behind it, if any
+func (s *WatchStep) reloadLimitMessage(wait time.Duration, busiest string) string {
+	wait -= wait % time.Second
+	message := fmt.Sprintf("more than %d reloads in a minute, pausing reloads for %s", s.config.MaxReloadsPerMinute, wait+time.Second)
+	if busiest != "" {
+		message += fmt.Sprintf(", %s keeps changing", busiest)
+	}
+	return message
+}
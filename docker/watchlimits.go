@@ -0,0 +1,92 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// cpuPeriod is the CFS period the cpu key's quota is a share of, the same
+// one `docker run --cpus` uses
+const cpuPeriod = 100000
+
+// oomKillsCmd prints how many processes the kernel has OOM killed in the
+// container's memory cgroup, cgroup v2 keeps it in memory.events and v1 in
+// memory.oom_control
+const oomKillsCmd = `cat /sys/fs/cgroup/memory.events /sys/fs/cgroup/memory/memory.oom_control 2>/dev/null | awk '$1 == "oom_kill" {print $2; exit}'`
+
+// resourceLimits turns the memory and cpu keys into a container update,
+// false if neither is set
+func (s *WatchStep) resourceLimits() (docker.UpdateContainerOptions, bool) {
+	opts := docker.UpdateContainerOptions{}
+	if s.config.Memory == 0 && s.config.CPU == 0 {
+		return opts, false
+	}
+	opts.Memory = int(s.config.Memory)
+	if s.config.CPU > 0 {
+		opts.CPUPeriod = cpuPeriod
+		opts.CPUQuota = int(s.config.CPU * cpuPeriod)
+	}
+	return opts, true
+}
+
+// applyLimits puts memory and cpu on the container. Docker can only limit
+// a whole container, not a single exec, so this covers everything running
+// in it, the shell and anything started next to the code included. It's
+// reapplied before every reload in case the container was restarted.
+func (s *WatchStep) applyLimits(containerID string) error {
+	opts, ok := s.resourceLimits()
+	if !ok {
+		return nil
+	}
+	client, err := s.dockerClient()
+	if err != nil {
+		return err
+	}
+	return client.UpdateContainer(containerID, opts)
+}
+
+// checkOOMKills warns when processes were OOM killed since the last check,
+// the first check only takes note of the count. It runs before every reload
+// and when the code exits non-zero. The cgroup is the container's, so the
+// process killed may not be the code itself.
+func (s *WatchStep) checkOOMKills(containerID string) {
+	if s.config.Memory == 0 {
+		return
+	}
+	s.oomMutex.Lock()
+	defer s.oomMutex.Unlock()
+	client, err := s.dockerClient()
+	if err != nil {
+		return
+	}
+	var output bytes.Buffer
+	if err := client.ExecOne(containerID, []string{"/bin/sh", "-c", oomKillsCmd}, &output); err != nil {
+		return
+	}
+	kills, err := strconv.Atoi(strings.TrimSpace(output.String()))
+	if err != nil {
+		return
+	}
+	if s.oomKills >= 0 && kills > s.oomKills {
+		s.logger.Warnf("%d process(es) were killed for going over the memory limit of %s", kills-s.oomKills, units.BytesSize(float64(s.config.Memory)))
+	}
+	s.oomKills = kills
+}
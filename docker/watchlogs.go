@@ -0,0 +1,90 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxBufferedLogs is how many lines of output we hold on to while the
+// emitter is busy before we start dropping the oldest ones
+const maxBufferedLogs = 1000
+
+// logBuffer sits between reading the container's output and emitting it,
+// so a slow consumer of our events never stops us from draining stdout
+type logBuffer struct {
+	mutex   sync.Mutex
+	lines   []string
+	max     int
+	dropped int
+	ready   chan struct{}
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{max: max, ready: make(chan struct{}, 1)}
+}
+
+// push adds a line without ever blocking, dropping the oldest line if the
+// buffer is full
+func (b *logBuffer) push(line string) {
+	b.mutex.Lock()
+	if len(b.lines) >= b.max {
+		b.lines = b.lines[1:]
+		b.dropped++
+	}
+	b.lines = append(b.lines, line)
+	b.mutex.Unlock()
+
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the buffer, returning its lines and how many were dropped
+// since the last take
+func (b *logBuffer) take() ([]string, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	lines, dropped := b.lines, b.dropped
+	b.lines = nil
+	b.dropped = 0
+	return lines, dropped
+}
+
+// run hands buffered lines to emit until stop is closed, then flushes
+// whatever is left. Dropped lines are replaced by a marker saying how
+// many went missing.
+func (b *logBuffer) run(emit func(string), stop <-chan struct{}) {
+	flush := func() {
+		lines, dropped := b.take()
+		if dropped > 0 {
+			emit(fmt.Sprintf("[dropped %d lines]\n", dropped))
+		}
+		for _, line := range lines {
+			emit(line)
+		}
+	}
+	for {
+		select {
+		case <-b.ready:
+			flush()
+		case <-stop:
+			flush()
+			return
+		}
+	}
+}
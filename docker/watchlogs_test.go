@@ -0,0 +1,81 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type LogBufferSuite struct {
+	*util.TestSuite
+}
+
+func TestLogBufferSuite(t *testing.T) {
+	suiteTester := &LogBufferSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *LogBufferSuite) TestDropsOldest() {
+	buf := newLogBuffer(2)
+	buf.push("a\n")
+	buf.push("b\n")
+	buf.push("c\n")
+	lines, dropped := buf.take()
+	s.Equal([]string{"b\n", "c\n"}, lines)
+	s.Equal(1, dropped)
+
+	lines, dropped = buf.take()
+	s.Equal(0, len(lines))
+	s.Equal(0, dropped)
+}
+
+func (s *LogBufferSuite) TestSlowEmitter() {
+	buf := newLogBuffer(10)
+	emitted := []string{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		buf.run(func(line string) {
+			time.Sleep(5 * time.Millisecond)
+			emitted = append(emitted, line)
+		}, stop)
+		close(done)
+	}()
+
+	// Pushing never waits on the emitter
+	start := time.Now()
+	for i := 0; i < 500; i++ {
+		buf.push(fmt.Sprintf("line %d\n", i))
+	}
+	s.True(time.Since(start) < time.Second, "push blocked on a slow emitter")
+
+	close(stop)
+	<-done
+	s.True(len(emitted) < 500)
+	s.Equal("line 499\n", emitted[len(emitted)-1], "the newest output should survive")
+	markers := 0
+	for _, line := range emitted {
+		if strings.HasPrefix(line, "[dropped ") {
+			markers++
+		}
+	}
+	s.True(markers > 0, "dropped lines should be reported")
+}
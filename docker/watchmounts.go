@@ -0,0 +1,115 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unreliableWatchFilesystems are filesystem types that are commonly used for
+// Docker for Mac/Windows and VM shared folders, where inotify events for
+// changes made on the other side of the mount usually never arrive.
+var unreliableWatchFilesystems = map[string]struct{}{
+	"fuse.osxfs":       struct{}{},
+	"fuse.grpcfuse":    struct{}{},
+	"fakeowner":        struct{}{},
+	"9p":               struct{}{},
+	"vboxsf":           struct{}{},
+	"prl_fs":           struct{}{},
+	"vmhgfs":           struct{}{},
+	"fuse.vmhgfs-fuse": struct{}{},
+	"nfs":              struct{}{},
+	"nfs4":             struct{}{},
+	"cifs":             struct{}{},
+	"smbfs":            struct{}{},
+}
+
+// mountInfo is the part of a /proc/self/mountinfo entry we care about
+type mountInfo struct {
+	MountPoint string
+	FSType     string
+}
+
+// parseMountInfo reads the mountinfo format described in proc(5)
+func parseMountInfo(r io.Reader) []mountInfo {
+	mounts := []mountInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw
+		parts := strings.SplitN(scanner.Text(), " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		fsFields := strings.Fields(parts[1])
+		if len(fields) < 5 || len(fsFields) < 1 {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			MountPoint: unescapeMountPath(fields[4]),
+			FSType:     fsFields[0],
+		})
+	}
+	return mounts
+}
+
+// unescapeMountPath undoes the octal escaping the kernel does for spaces,
+// tabs, newlines and backslashes in mount paths
+func unescapeMountPath(s string) string {
+	r := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	return r.Replace(s)
+}
+
+// mountFor finds the mount that path lives on, the longest matching mount
+// point wins
+func mountFor(mounts []mountInfo, path string) (mountInfo, bool) {
+	var found mountInfo
+	ok := false
+	for _, m := range mounts {
+		if m.MountPoint != "/" && path != m.MountPoint && !strings.HasPrefix(path, m.MountPoint+string(filepath.Separator)) {
+			continue
+		}
+		if !ok || len(m.MountPoint) > len(found.MountPoint) {
+			found = m
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// unreliableWatchMount returns the mount path lives on if it is one where
+// filesystem events are known to be unreliable. This is a heuristic and
+// only works where /proc/self/mountinfo exists (linux).
+func unreliableWatchMount(path string) (mountInfo, bool) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return mountInfo{}, false
+	}
+	defer file.Close()
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	m, ok := mountFor(parseMountInfo(file), path)
+	if !ok {
+		return mountInfo{}, false
+	}
+	_, unreliable := unreliableWatchFilesystems[m.FSType]
+	return m, unreliable
+}
@@ -0,0 +1,107 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Ways per-file-command deals with several changed files, for the
+// per-file-mode key
+const (
+	perFileList = "list"
+	perFileEach = "each"
+)
+
+// perFileData is what per-file-command templates get, File is shell quoted
+// already, in list mode it is every changed file separated by spaces
+type perFileData struct {
+	File string
+}
+
+// reloadFiles collects the changed files for the next reload, several
+// requests collapsing into one build get all of their files
+type reloadFiles struct {
+	mutex sync.Mutex
+	files []string
+	seen  map[string]bool
+}
+
+func (r *reloadFiles) add(files []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.seen == nil {
+		r.seen = map[string]bool{}
+	}
+	for _, file := range files {
+		if !r.seen[file] {
+			r.seen[file] = true
+			r.files = append(r.files, file)
+		}
+	}
+}
+
+func (r *reloadFiles) take() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	files := r.files
+	r.files = nil
+	r.seen = nil
+	return files
+}
+
+// projectRelative turns the changed paths into paths relative to the
+// project, which is where the code runs in the container
+func (s *WatchStep) projectRelative(paths []string) []string {
+	rel := []string{}
+	for _, path := range paths {
+		if r, err := filepath.Rel(s.options.ProjectPath, path); err == nil && !strings.HasPrefix(r, "..") {
+			rel = append(rel, filepath.ToSlash(r))
+		}
+	}
+	return rel
+}
+
+// commandFor is the command for a reload of files. Reloads without changed
+// files, like the first one, and steps without per-file-command run the
+// code.
+func (s *WatchStep) commandFor(files []string) (string, error) {
+	if s.config.PerFileCommand == nil || len(files) == 0 {
+		return s.command(), nil
+	}
+	quoted := make([]string, len(files))
+	for i, file := range files {
+		quoted[i] = shellQuote(file)
+	}
+	runs := []perFileData{{File: strings.Join(quoted, " ")}}
+	if s.config.PerFileMode == perFileEach {
+		runs = make([]perFileData, len(quoted))
+		for i, file := range quoted {
+			runs[i] = perFileData{File: file}
+		}
+	}
+	cmds := make([]string, len(runs))
+	for i, data := range runs {
+		var buf bytes.Buffer
+		if err := s.config.PerFileCommand.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		cmds[i] = buf.String()
+	}
+	return s.asUser(strings.Join(cmds, "; ")), nil
+}
@@ -0,0 +1,257 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/wercker/wercker/util"
+)
+
+// fileWatcher is what the watch loops read changes from, fsnotify or the
+// pollWatcher when file system events aren't available
+type fileWatcher interface {
+	pathWatcher
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// notifyWatcher is a fsnotify.Watcher as a fileWatcher
+type notifyWatcher struct {
+	watcher *fsnotify.Watcher
+}
+
+func (n notifyWatcher) Add(name string) error         { return n.watcher.Add(name) }
+func (n notifyWatcher) Remove(name string) error      { return n.watcher.Remove(name) }
+func (n notifyWatcher) Events() <-chan fsnotify.Event { return n.watcher.Events }
+func (n notifyWatcher) Errors() <-chan error          { return n.watcher.Errors }
+func (n notifyWatcher) Close() error                  { return n.watcher.Close() }
+
+// pollEntry is what pollWatcher compares between scans of a directory
+type pollEntry struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// pollWatcher finds changes by listing the watched directories every
+// interval and comparing, for file systems where inotify misses changes or
+// when it ran out of watches. Like inotify it only sees what is directly in
+// a watched directory. Changes show up an interval late at worst and every
+// scan stats every watched file.
+type pollWatcher struct {
+	interval  time.Duration
+	clock     util.Clock
+	mutex     sync.Mutex
+	dirs      map[string]map[string]pollEntry
+	events    chan fsnotify.Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPollWatcher(interval time.Duration, clock util.Clock) *pollWatcher {
+	p := &pollWatcher{
+		interval: interval,
+		clock:    clock,
+		dirs:     map[string]map[string]pollEntry{},
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Add starts polling dir
+func (p *pollWatcher) Add(dir string) error {
+	entries, err := scanPollDir(dir)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.dirs[dir] = entries
+	return nil
+}
+
+// Remove stops polling dir
+func (p *pollWatcher) Remove(dir string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.dirs[dir]; !ok {
+		return fmt.Errorf("can't remove non-existent poll watch for: %s", dir)
+	}
+	delete(p.dirs, dir)
+	return nil
+}
+
+func (p *pollWatcher) Events() <-chan fsnotify.Event { return p.events }
+func (p *pollWatcher) Errors() <-chan error          { return p.errors }
+
+// Close stops polling, the events and errors channels close once it has,
+// like fsnotify's. It can be called more than once.
+func (p *pollWatcher) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
+
+func (p *pollWatcher) run() {
+	defer close(p.errors)
+	defer close(p.events)
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.clock.After(p.interval):
+		}
+		for _, event := range p.poll() {
+			select {
+			case p.events <- event:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+// poll scans every watched directory once and returns what changed since
+// the last scan. A directory that is gone stops being polled.
+func (p *pollWatcher) poll() []fsnotify.Event {
+	p.mutex.Lock()
+	dirs := make([]string, 0, len(p.dirs))
+	for dir := range p.dirs {
+		dirs = append(dirs, dir)
+	}
+	p.mutex.Unlock()
+	sort.Strings(dirs)
+
+	events := []fsnotify.Event{}
+	for _, dir := range dirs {
+		entries, err := scanPollDir(dir)
+		if err != nil {
+			entries = map[string]pollEntry{}
+		}
+		p.mutex.Lock()
+		previous, ok := p.dirs[dir]
+		if !ok {
+			// removed while we were scanning
+			p.mutex.Unlock()
+			continue
+		}
+		if err != nil {
+			delete(p.dirs, dir)
+		} else {
+			p.dirs[dir] = entries
+		}
+		p.mutex.Unlock()
+		events = append(events, diffPollDir(dir, previous, entries)...)
+	}
+	return events
+}
+
+// diffPollDir turns the difference between two scans of dir into the
+// events inotify would have sent
+func diffPollDir(dir string, previous, current map[string]pollEntry) []fsnotify.Event {
+	names := []string{}
+	for name := range previous {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := previous[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	events := []fsnotify.Event{}
+	for _, name := range names {
+		before, existed := previous[name]
+		after, exists := current[name]
+		var op fsnotify.Op
+		switch {
+		case !existed:
+			op = fsnotify.Create
+		case !exists:
+			op = fsnotify.Remove
+		case !after.mode.IsDir() && (!after.modTime.Equal(before.modTime) || after.size != before.size):
+			op = fsnotify.Write
+		case after.mode != before.mode:
+			op = fsnotify.Chmod
+		default:
+			continue
+		}
+		events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: op})
+	}
+	return events
+}
+
+func scanPollDir(dir string) (map[string]pollEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]pollEntry, len(infos))
+	for _, info := range infos {
+		entries[info.Name()] = pollEntry{modTime: info.ModTime(), size: info.Size(), mode: info.Mode()}
+	}
+	return entries, nil
+}
+
+// newFileWatcher is fsnotify unless poll is set or fsnotify can't be used
+func (s *WatchStep) newFileWatcher() fileWatcher {
+	if s.config.Poll {
+		s.logger.Infof("Polling for changes every %s", s.config.PollInterval)
+		return newPollWatcher(s.config.PollInterval, s.clock)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return s.pollFallback(err)
+	}
+	return notifyWatcher{watcher: watcher}
+}
+
+// pollFallback is the pollWatcher we use when fsnotify failed with err
+func (s *WatchStep) pollFallback(err error) fileWatcher {
+	s.logger.Warnf("File system events are unavailable (%s), polling for changes every %s instead. Changes can take that long to be noticed, set poll-interval to change it", err, s.config.PollInterval)
+	return newPollWatcher(s.config.PollInterval, s.clock)
+}
+
+// watchLimitError explains inotify running out of watches, which it
+// reports as ENOSPC, no space left on device. Other errors are returned
+// as they are. watched is how many directories were watched by then.
+func watchLimitError(err error, watched int) error {
+	cause := err
+	switch e := err.(type) {
+	case *os.SyscallError:
+		cause = e.Err
+	case *os.PathError:
+		cause = e.Err
+	}
+	if cause != syscall.ENOSPC {
+		return err
+	}
+	return fmt.Errorf("the inotify watch limit was reached after watching %d directories, the disk isn't full. Raise fs.inotify.max_user_watches, e.g. sudo sysctl fs.inotify.max_user_watches=524288, or exclude more directories", watched)
+}
@@ -0,0 +1,96 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// progressIndicator shows that a reload is still going until it produces
+// output. On a terminal it draws a spinner on out, otherwise it writes a
+// "still building" line every interval.
+type progressIndicator struct {
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	mutex    sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newProgressIndicator(out io.Writer, tty bool) *progressIndicator {
+	interval := 10 * time.Second
+	if tty {
+		interval = 100 * time.Millisecond
+	}
+	return &progressIndicator{out: out, tty: tty, interval: interval}
+}
+
+// Start shows the indicator, restarting it if it was already running
+func (p *progressIndicator) Start() {
+	p.Stop()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run(time.Now(), p.stop, p.done)
+}
+
+// Stop hides the indicator, it is fine to call when it isn't running
+func (p *progressIndicator) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+}
+
+// running says whether the indicator is showing
+func (p *progressIndicator) running() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stop != nil
+}
+
+func (p *progressIndicator) run(start time.Time, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for frame := 0; ; frame++ {
+		select {
+		case <-ticker.C:
+			elapsed := time.Since(start) / time.Second
+			if p.tty {
+				fmt.Fprintf(p.out, "\r%s building... %ds", spinnerFrames[frame%len(spinnerFrames)], elapsed)
+			} else {
+				fmt.Fprintf(p.out, "still building... %ds\n", elapsed)
+			}
+		case <-stop:
+			if p.tty {
+				// clear the spinner line
+				fmt.Fprint(p.out, "\r\x1b[K")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,346 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// dirWatchSet is the directories the walk of root put a watch on, kept so
+// a later walk only has to add and remove the difference
+type dirWatchSet struct {
+	mutex   sync.Mutex
+	watched map[string]bool
+	// walking keeps rewatches in order so an older walk doesn't win
+	walking sync.Mutex
+}
+
+func newDirWatchSet() *dirWatchSet {
+	return &dirWatchSet{watched: map[string]bool{}}
+}
+
+// update makes dirs the watched directories, returning what it added and
+// removed
+func (d *dirWatchSet) update(watcher pathWatcher, dirs []string) ([]string, []string, error) {
+	want := map[string]bool{}
+	for _, dir := range dirs {
+		want[dir] = true
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	added := []string{}
+	removed := []string{}
+	for _, dir := range dirs {
+		if d.watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return added, removed, err
+		}
+		d.watched[dir] = true
+		added = append(added, dir)
+	}
+	for dir := range d.watched {
+		if !want[dir] {
+			watcher.Remove(dir)
+			delete(d.watched, dir)
+			removed = append(removed, dir)
+		}
+	}
+	sort.Strings(removed)
+	return added, removed, nil
+}
+
+// add watches dirs on top of what is watched, returning the ones that
+// weren't already
+func (d *dirWatchSet) add(watcher pathWatcher, dirs []string) ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	added := []string{}
+	for _, dir := range dirs {
+		if d.watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return added, err
+		}
+		d.watched[dir] = true
+		added = append(added, dir)
+	}
+	return added, nil
+}
+
+// removeUnder stops watching dir and everything below it, returning what
+// was watched
+func (d *dirWatchSet) removeUnder(watcher pathWatcher, dir string) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	removed := []string{}
+	for path := range d.watched {
+		if inDir(dir, path) {
+			// The watch may be gone already along with the directory
+			watcher.Remove(path)
+			delete(d.watched, path)
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// watching tells whether dir has a watch on it
+func (d *dirWatchSet) watching(dir string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.watched[dir]
+}
+
+func (d *dirWatchSet) count() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.watched)
+}
+
+// watchDirs walks root for the directories to watch, leaving out what the
+// filters exclude and, with extensions, directories without such files.
+// With paths only those subtrees of root are walked.
+func (s *WatchStep) watchDirs(root string) ([]string, error) {
+	filters := s.newDirFilters(root)
+	tops := s.watchPaths()
+	if len(tops) == 0 {
+		tops = []string{root}
+	}
+
+	dirs := []string{}
+	seen := map[string]bool{}
+	for _, top := range tops {
+		// Only directories with files we care about are worth a watch
+		var relevant map[string]bool
+		if len(s.config.Extensions) > 0 {
+			var err error
+			relevant, err = s.dirsWithExtensions(top, filters)
+			if err != nil {
+				return nil, err
+			}
+		}
+		found, err := s.walkDirs(top, filters, relevant)
+		if err != nil {
+			return nil, err
+		}
+		// paths can overlap, e.g. src and src/app
+		for _, dir := range found {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// walkDirs walks dir for the directories to watch, relevant is nil unless
+// extensions narrowed them down
+func (s *WatchStep) walkDirs(dir string, filters *dirFilters, relevant map[string]bool) ([]string, error) {
+	dirs := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() {
+			if err != nil {
+				return err
+			}
+
+			s.logger.Debugln("check path", path)
+			if pattern, excluded := filters.match(path); excluded {
+				s.logger.Debugf("exclude (%s): %s", pattern, path)
+				return filepath.SkipDir
+			}
+			if relevant != nil && !relevant[path] {
+				s.logger.Debugln("no matching extensions:", path)
+				return filepath.SkipDir
+			}
+			s.logger.Debugln("Watching:", path)
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// watchNewDir puts a watch on a directory created under root after the
+// walk, and on everything below it, if the filters let it through. Its
+// parent has to be watched already, which keeps it out of directories the
+// filters excluded. Extensions aren't checked, a new directory has no files
+// yet. Like rewatch it must not run on the goroutine reading the events.
+func (s *WatchStep) watchNewDir(watcher pathWatcher, root, dir string) error {
+	if s.dirWatch == nil || !s.dirWatch.watching(filepath.Dir(dir)) {
+		return nil
+	}
+	s.dirWatch.walking.Lock()
+	defer s.dirWatch.walking.Unlock()
+	dirs, err := s.walkDirs(dir, s.newDirFilters(root), nil)
+	if err != nil {
+		return err
+	}
+	added, err := s.dirWatch.add(watcher, dirs)
+	if err != nil {
+		return watchLimitError(err, s.dirWatch.count())
+	}
+	s.status.mutex.Lock()
+	s.status.watchedDirs = s.dirWatch.count()
+	s.status.mutex.Unlock()
+	for _, dir := range added {
+		s.logger.Debugln("Now watching new directory:", dir)
+	}
+	return nil
+}
+
+// dirQueue runs jobs one at a time in the order they came in, on a
+// goroutine that is only around while there are jobs
+type dirQueue struct {
+	mutex   sync.Mutex
+	jobs    []func()
+	running bool
+}
+
+func (q *dirQueue) run(job func()) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.jobs = append(q.jobs, job)
+	if !q.running {
+		q.running = true
+		go q.work()
+	}
+}
+
+func (q *dirQueue) work() {
+	for {
+		q.mutex.Lock()
+		if len(q.jobs) == 0 {
+			q.running = false
+			q.mutex.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		q.mutex.Unlock()
+		job()
+	}
+}
+
+// followDirs keeps the watches in step with directories created or renamed
+// under root, the event loops call it with every event. A renamed
+// directory keeps its inotify watch, so its old name has to be dropped
+// before the new name, which arrives as a create, is watched or dropping
+// it would take the new watch down too. That's why this goes through
+// dirJobs in event order rather than a goroutine per event. Nothing here
+// touches dirWatch on the loop's goroutine, see rewatch.
+func (s *WatchStep) followDirs(watcher pathWatcher, root string, event fsnotify.Event) {
+	if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+		s.dirJobs.run(func() {
+			s.unwatchDir(watcher, event.Name)
+		})
+	}
+	if isNewDir(event) {
+		s.dirJobs.run(func() {
+			if err := s.watchNewDir(watcher, root, event.Name); err != nil {
+				s.logger.Warnln("Unable to watch new directory:", err)
+			}
+		})
+	}
+}
+
+// unwatchDir drops the watches of a directory that was renamed or removed
+// and of everything below it, if it was watched
+func (s *WatchStep) unwatchDir(watcher pathWatcher, dir string) {
+	if s.dirWatch == nil || !s.dirWatch.watching(dir) {
+		return
+	}
+	s.dirWatch.walking.Lock()
+	defer s.dirWatch.walking.Unlock()
+	removed := s.dirWatch.removeUnder(watcher, dir)
+	s.status.mutex.Lock()
+	s.status.watchedDirs = s.dirWatch.count()
+	s.status.mutex.Unlock()
+	for _, dir := range removed {
+		s.logger.Debugln("No longer watching moved directory:", dir)
+	}
+}
+
+// isNewDir tells whether event is a directory being created
+func isNewDir(event fsnotify.Event) bool {
+	if event.Op&fsnotify.Create != fsnotify.Create {
+		return false
+	}
+	info, err := os.Stat(event.Name)
+	return err == nil && info.IsDir()
+}
+
+// isIgnoreFile tells whether path is one of the ignore-files that
+// watchFilters and dirFilters read, in the project root or any directory
+// under root. They're hidden so they never trigger a reload.
+func (s *WatchStep) isIgnoreFile(root, path string) bool {
+	dir := filepath.Dir(path)
+	if dir != s.options.ProjectPath && !inDir(root, dir) {
+		return false
+	}
+	for _, name := range s.config.IgnoreFiles {
+		if filepath.Base(path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewatch walks root again after an ignore file changed, watching the
+// directories that are no longer ignored and dropping the ones that now
+// are. It must not run on the goroutine reading the watcher's events,
+// fsnotify's Remove waits for pending events to be read.
+func (s *WatchStep) rewatch(watcher pathWatcher, root string) error {
+	s.eventFilters.reset()
+	if s.dirWatch == nil {
+		return nil
+	}
+	s.dirWatch.walking.Lock()
+	defer s.dirWatch.walking.Unlock()
+	dirs, err := s.watchDirs(root)
+	if err != nil {
+		return err
+	}
+	added, removed, err := s.dirWatch.update(watcher, dirs)
+	if err != nil {
+		return watchLimitError(err, s.dirWatch.count())
+	}
+	count := s.dirWatch.count()
+	s.status.mutex.Lock()
+	s.status.watchedDirs = count
+	s.status.mutex.Unlock()
+	if len(added) == 0 && len(removed) == 0 {
+		s.logger.Debugln("Ignore rules changed, watched directories are the same")
+		return nil
+	}
+	s.logger.Infof("Ignore rules changed, now watching %d directories (%d added, %d removed)", count, len(added), len(removed))
+	for _, dir := range added {
+		s.logger.Debugln("Now watching:", dir)
+	}
+	for _, dir := range removed {
+		s.logger.Debugln("No longer watching:", dir)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"github.com/wercker/wercker/core"
+)
+
+// watchDataKeys are the data keys of internal/watch, parseWatchConfig only
+// reads keys declared here. Defaults are written the way the key is. Keys
+// can also be spelled with underscores, kill_timeout is kill-timeout.
+var watchDataKeys = []core.StepDataKey{
+	{Name: "code", Type: "string", Usage: "The command to run in the container"},
+	{Name: "commands", Type: "lines", Usage: "Commands to run in order instead of code, one per line or a JSON list, a reload stops at the first that fails"},
+	{Name: "setup", Type: "string", Usage: "Command to run before the code until a run gets through it, e.g. npm install"},
+	{Name: "reload", Type: "bool", Default: "false", Usage: "Run the code again when files change"},
+	{Name: "root", Type: "string", Usage: "Directory to watch instead of the project"},
+	{Name: "root-outside-project", Type: "bool", Default: "false", Usage: "Allow root outside of the project"},
+	{Name: "paths", Type: "lines", Usage: "Only watch these directories, relative to the project root, separated by commas or newlines"},
+	{Name: "extensions", Type: "list", Usage: "Only reload for files with these extensions"},
+	{Name: "events", Type: "list", Default: "write, create, remove, rename", Usage: "File events that reload, any of write, create, remove, rename, chmod"},
+	{Name: "ignore-files", Type: "list", Default: ".gitignore, .werckerignore", Usage: "File names to read patterns to exclude from, in the project root or any directory under it"},
+	{Name: "ignore-writes", Type: "list", Usage: "Files the code writes itself, e.g. *.pid, *.log, changes to them never reload"},
+	{Name: "watch-hidden", Type: "bool", Default: "false", Usage: "Also watch dotfiles and hidden directories, except .git"},
+	{Name: "poll", Type: "bool", Default: "false", Usage: "Look for changes by scanning the watched directories instead of with file system events"},
+	{Name: "poll-interval", Type: "duration", Default: "1s", Usage: "How often poll scans, also used when file system events turn out to be unavailable"},
+	{Name: "explain-excludes", Type: "bool", Default: "false", Usage: "Log which top-level directories are watched and why"},
+	{Name: "dry-run", Type: "bool", Default: "false", Usage: "Log the changes and the reloads they would cause without running anything"},
+	{Name: "strict", Type: "bool", Default: "false", Usage: "Fail instead of warning when no directories end up watched"},
+	{Name: "max-trigger-size", Type: "size", Usage: "Ignore changes to files larger than this"},
+	{Name: "skip-binary", Type: "bool", Default: "false", Usage: "Ignore changes to files that look binary"},
+	{Name: "watch-from-command", Type: "string", Usage: "Host command that lists the paths to watch, needs --allow-host-commands"},
+	{Name: "git-trigger", Type: "bool", Default: "false", Usage: "Reload when git status changes instead of on file events"},
+	{Name: "git-trigger-interval", Type: "duration", Default: "2s", Usage: "How often git-trigger checks git status"},
+	{Name: "ssh-host", Type: "string", Usage: "Watch ssh-path on this host over ssh (experimental)"},
+	{Name: "ssh-path", Type: "string", Usage: "Remote path to watch with ssh-host"},
+	{Name: "ssh-key", Type: "string", Usage: "Identity file for ssh-host"},
+	{Name: "interval", Type: "duration", Default: "0s", Usage: "Also reload on this schedule, 0 turns it off"},
+	{Name: "trigger-port", Type: "int", Default: "0", Usage: "Port to listen on for reload webhooks"},
+	{Name: "trigger-token", Type: "string", Usage: "Token reload webhooks have to send"},
+	{Name: "lock-file", Type: "string", Usage: "Hold reloads while this file exists"},
+	{Name: "warmup", Type: "duration", Default: "0s", Usage: "Wait this long before the first build"},
+	{Name: "initial-retries", Type: "int", Default: "0", Usage: "Retry a failing first build this many times"},
+	{Name: "initial-retry-delay", Type: "duration", Default: "1s", Usage: "Wait between initial retries"},
+	{Name: "skip-unchanged-initial", Type: "bool", Default: "false", Usage: "Skip the first build if nothing changed since the last one that exited 0 in the same container"},
+	{Name: "debounce-mode", Type: "leading|trailing", Default: "leading", Usage: "Reload right away on the first change of a burst and once more after it if it went on, or only once it settles"},
+	{Name: "max-reloads-per-minute", Type: "int", Default: "0", Usage: "Hold reloads back once there were this many in the last minute, 0 turns it off"},
+	{Name: "reload-backoff", Type: "duration", Default: "1s", Usage: "Initial wait before reloading after a failed reload, 0 turns it off"},
+	{Name: "reload-backoff-max", Type: "duration", Default: "30s", Usage: "Longest wait reload-backoff grows to"},
+	{Name: "on-exit", Type: "wait|reload|finish", Default: "wait", Usage: "What to do when the code exits on its own"},
+	{Name: "restart-on-exit", Type: "bool", Usage: "Run the code again when it exits and restart the container when it stops, or finish the step for either, instead of waiting for changes"},
+	{Name: "wait-exit", Type: "bool", Default: "false", Usage: "Without reload, finish the step with the code's exit code once it exits"},
+	{Name: "kill-group", Type: "bool", Default: "false", Usage: "Only signal the code's process group on reload"},
+	{Name: "signal", Type: "string", Default: "INT", Usage: "Signal that stops the code on reloads and at the end, e.g. TERM or HUP"},
+	{Name: "kill-timeout", Type: "duration", Default: "5s", Usage: "Send KILL if the code is still running this long after signal, 0 turns it off"},
+	{Name: "kill-sequence", Type: "list", Usage: "Signals to stop the code with and how long to wait after each, e.g. INT:2s,TERM:3s,KILL, instead of signal and kill-timeout"},
+	{Name: "forward-signals", Type: "list", Usage: "Host signals to pass on to the code, any of HUP, USR2, WINCH, QUIT. Forwarding USR2 stops it from pausing the watch"},
+	{Name: "keep-pidfiles", Type: "list", Usage: "Processes in these pid files survive reloads"},
+	{Name: "wait-for-ports", Type: "list", Usage: "Container ports to wait for the previous run to free before reloading"},
+	{Name: "wait-for-ports-timeout", Type: "duration", Default: "10s", Usage: "How long to wait for wait-for-ports"},
+	{Name: "restart-container", Type: "bool", Default: "false", Usage: "Restart the container if it goes away"},
+	{Name: "wrapper", Type: "string", Usage: "Command the code runs in, " + wrapperPlaceholder + " is replaced with the code"},
+	{Name: "user", Type: "string", Usage: "User to run the code and setup as, the container needs gosu, su-exec or su"},
+	{Name: "tty", Type: "bool", Default: "false", Usage: "Run the code in a docker exec with a terminal of its own"},
+	{Name: "interactive", Type: "bool", Default: "false", Usage: "Pass what is typed in the terminal on to the code, a line at a time"},
+	{Name: "tmux-session", Type: "string", Usage: "Run the code in this tmux session in the container"},
+	{Name: "per-file-command", Type: "template", Usage: "Command for a reload of the changed files, {{.File}} is replaced with them"},
+	{Name: "per-file-mode", Type: "list|each", Default: "list", Usage: "Run per-file-command once for all files or once per file"},
+	{Name: "snapshot", Type: "list", Usage: "Paths or globs in the project copied in the container before the first build and restored before every reload"},
+	{Name: "groups", Type: "json", Usage: "Commands that only reload for their own paths"},
+	{Name: "host-command", Type: "string", Usage: "Command to run on the host after each reload whose code exits 0, needs --allow-host-commands"},
+	{Name: "memory", Type: "size", Usage: "Memory limit for the whole container, not only the code"},
+	{Name: "cpu", Type: "float", Usage: "CPU limit for the whole container, not only the code"},
+	{Name: "profile", Type: "dir|node", Usage: "Collect profiles for each reload"},
+	{Name: "artifact-concurrency", Type: "int", Default: "2", Usage: "How many reloads' profiles are collected at once"},
+	{Name: "artifact-retention", Type: "int", Default: "10", Usage: "Keep the profiles of this many reloads on the host, 0 keeps all"},
+	{Name: "log-file", Type: "string", Usage: "Also write the code's output to this file"},
+	{Name: "log-file-truncate", Type: "bool", Default: "false", Usage: "Truncate log-file when the step starts"},
+	{Name: "log-filter", Type: "regexp", Usage: "Only show output lines matching this"},
+	{Name: "log-exclude", Type: "regexp", Usage: "Hide output lines matching this"},
+	{Name: "group-logs", Type: "bool", Default: "false", Usage: "Put a header and footer around each reload's output"},
+	{Name: "show-changes", Type: "bool", Default: "false", Usage: "List the changed files on each reload"},
+	{Name: "clear", Type: "bool", Default: "false", Usage: "Clear the terminal before each reload, only when the output goes to one"},
+	{Name: "progress", Type: "bool", Default: "false", Usage: "Show progress until a reload prints something"},
+	{Name: "notify", Type: "bool", Default: "false", Usage: "Send a desktop notification when a reload finishes"},
+	{Name: "event-socket", Type: "string", Usage: "Unix socket to stream reload events on as JSON"},
+}
+
+var watchDataKeyNames = map[string]bool{}
+
+func init() {
+	for _, key := range watchDataKeys {
+		watchDataKeyNames[key.Name] = true
+	}
+}
+
+// StepDataKeys returns the data keys the internal step id declares, steps
+// that read their data without declaring it aren't known
+func StepDataKeys(id string) ([]core.StepDataKey, bool) {
+	switch id {
+	case "internal/watch":
+		return watchDataKeys, true
+	}
+	return nil, false
+}
+
+// DescribedSteps are the step ids StepDataKeys knows
+func DescribedSteps() []string {
+	return []string{"internal/watch"}
+}
@@ -0,0 +1,152 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// snapshotPatternRe limits snapshot patterns to plain paths and globs, the
+// shell expands them unquoted
+var snapshotPatternRe = regexp.MustCompile(`^[A-Za-z0-9._/*?\[\]-]+$`)
+
+// validSnapshotPattern checks one pattern of the snapshot key, they have
+// to stay inside the directory the code runs in
+func validSnapshotPattern(pattern string) error {
+	if !snapshotPatternRe.MatchString(pattern) {
+		return fmt.Errorf("%q may only contain letters, digits and . _ - / * ? [ ]", pattern)
+	}
+	if path.IsAbs(pattern) {
+		return fmt.Errorf("%q must be relative to the project", pattern)
+	}
+	for _, part := range strings.Split(pattern, "/") {
+		if part == ".." {
+			return fmt.Errorf("%q must stay inside the project", pattern)
+		}
+	}
+	return nil
+}
+
+// snapshotDir is where the snapshot is kept in the container
+func (s *WatchStep) snapshotDir() string {
+	return fmt.Sprintf("/tmp/wercker-watch-%s.snapshot", s.SafeID())
+}
+
+// snapshotCommands copies the paths matching the snapshot patterns to
+// snapshotDir the first time and puts them back every time after that,
+// removing whatever matches the patterns first so generated files that
+// weren't there at first are gone too. Everything happens inside the
+// container, Validate doesn't allow it with a direct mount of the project.
+func (s *WatchStep) snapshotCommands() []string {
+	if len(s.config.Snapshot) == 0 {
+		return nil
+	}
+	dir := shellQuote(s.snapshotDir())
+	patterns := strings.Join(s.config.Snapshot, " ")
+	if !s.snapshotTaken {
+		s.snapshotTaken = true
+		return []string{fmt.Sprintf(`rm -rf %[1]s && mkdir -p %[1]s && for p in %[2]s; do [ -e "$p" ] && tar -cf - "$p" | tar -xf - -C %[1]s; done; true`, dir, patterns)}
+	}
+	return []string{fmt.Sprintf(`for p in %[2]s; do [ -e "$p" ] && rm -rf -- "$p"; done; cp -a %[1]s/. .`, dir, patterns)}
+}
+
+// copyChanges brings the container's copy of the project up to date with
+// the changed files, paths relative to the project. Snapshot can't run with
+// a direct mount, so without this the edits never reach the container and
+// there would be nothing to restore. Files gone from the checkout are
+// removed from the copy. A dry-run leaves the copy alone.
+func (s *WatchStep) copyChanges(containerID string, files []string) error {
+	if len(files) == 0 || s.config.DryRun {
+		return nil
+	}
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	removed := []string{}
+	added := 0
+	for _, file := range files {
+		if _, err := os.Lstat(filepath.Join(s.options.ProjectPath, file)); os.IsNotExist(err) {
+			removed = append(removed, path.Join(s.options.BasePath(), filepath.ToSlash(file)))
+			continue
+		}
+		err := filepath.Walk(filepath.Join(s.options.ProjectPath, file), func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			added++
+			return addToTar(archive, p, s.options.ProjectPath, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	client, err := s.dockerClient()
+	if err != nil {
+		return err
+	}
+	if len(removed) > 0 {
+		if err := client.ExecOne(containerID, append([]string{"rm", "-rf", "--"}, removed...), &bytes.Buffer{}); err != nil {
+			return err
+		}
+	}
+	if added == 0 {
+		return nil
+	}
+	return client.UploadToContainer(containerID, docker.UploadToContainerOptions{InputStream: &buf, Path: s.options.BasePath()})
+}
+
+// addToTar writes p to archive under its path relative to root
+func addToTar(archive *tar.Writer, p, root string, info os.FileInfo) error {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(archive, file)
+	return err
+}
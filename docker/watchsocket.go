@@ -0,0 +1,178 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wercker/wercker/core"
+)
+
+// Types of the events written to event-socket
+const (
+	socketChanged        = "changed"
+	socketReloadStarted  = "reload-started"
+	socketReloadFinished = "reload-finished"
+	socketReloadComplete = "reload-complete"
+	socketError          = "error"
+)
+
+// socketWriteTimeout is how long a client gets to take an event before we
+// hang up on it, a stuck editor shouldn't hold up reloads
+const socketWriteTimeout = time.Second
+
+// socketEvent is written to event-socket clients as a line of JSON.
+// reload-finished is sent when the code of a reload exited, with its exit
+// code, or with an error if it couldn't be started. reload-complete is sent
+// when the code of a reload has ended, its exit code is left out if the
+// code was stopped instead.
+type socketEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Reload     int       `json:"reload,omitempty"`
+	Files      []string  `json:"files,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   float64   `json:"duration,omitempty"`
+	ExitCode   *int      `json:"exit-code,omitempty"`
+	Successful *bool     `json:"successful,omitempty"`
+}
+
+// reloadCompleteEvent is the event-socket version of WatchReloadComplete
+func reloadCompleteEvent(args *core.WatchReloadCompleteArgs) socketEvent {
+	successful := args.Successful
+	event := socketEvent{
+		Type:       socketReloadComplete,
+		Reload:     args.Reload,
+		Files:      args.Files,
+		Error:      args.Error,
+		Duration:   args.Duration.Seconds(),
+		Successful: &successful,
+	}
+	if args.Exited {
+		code := args.ExitCode
+		event.ExitCode = &code
+	}
+	return event
+}
+
+// announceReload sends reload-started to the event socket and
+// WatchReloadStarted to e, the func it returns sends the finished events
+// and the desktop notification.
+// That's called with the exit code the sentinel reported, or with a nil one
+// if the code couldn't be started or there is no exit line to wait for.
+func (s *WatchStep) announceReload(e *core.NormalizedEmitter, reload int, files []string) func(err error, code *int) {
+	start := s.clock.Now()
+	s.events.publish(socketEvent{Type: socketReloadStarted, Reload: reload, Files: files})
+	e.Emit(core.WatchReloadStarted, &core.WatchReloadStartedArgs{Reload: reload, Files: files})
+	return func(err error, code *int) {
+		duration := s.clock.Now().Sub(start)
+		socket := socketEvent{Type: socketReloadFinished, Reload: reload, Files: files, Duration: duration.Seconds()}
+		finished := &core.WatchReloadFinishedArgs{Reload: reload, Files: files, Duration: duration, ExitCode: -1}
+		if err != nil {
+			socket.Error = err.Error()
+			finished.Error = err.Error()
+		}
+		if code != nil {
+			socket.ExitCode = code
+			finished.Exited = true
+			finished.ExitCode = *code
+		}
+		s.notifyReload(duration, code, err)
+		s.events.publish(socket)
+		e.Emit(core.WatchReloadFinished, finished)
+	}
+}
+
+// eventSocket is a Unix socket every connected client gets our events on,
+// anything clients send is ignored
+type eventSocket struct {
+	path     string
+	listener net.Listener
+	mutex    sync.Mutex
+	clients  map[net.Conn]bool
+}
+
+// listenEventSocket starts listening on path, replacing a socket a previous
+// run left behind. Anything else already at path is left alone.
+func listenEventSocket(path string) (*eventSocket, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("event-socket %s exists and isn't a socket", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	sock := &eventSocket{path: path, listener: listener, clients: map[net.Conn]bool{}}
+	go sock.accept()
+	return sock, nil
+}
+
+func (e *eventSocket) accept() {
+	for {
+		conn, err := e.listener.Accept()
+		if err != nil {
+			return
+		}
+		e.mutex.Lock()
+		e.clients[conn] = true
+		e.mutex.Unlock()
+	}
+}
+
+// publish sends event to every client, dropping the ones it can't reach.
+// It does nothing on a nil socket so callers don't have to check.
+func (e *eventSocket) publish(event socketEvent) {
+	if e == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for conn := range e.clients {
+		conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			conn.Close()
+			delete(e.clients, conn)
+		}
+	}
+}
+
+// Close hangs up on every client and removes the socket file
+func (e *eventSocket) Close() error {
+	err := e.listener.Close()
+	e.mutex.Lock()
+	for conn := range e.clients {
+		conn.Close()
+	}
+	e.clients = map[net.Conn]bool{}
+	e.mutex.Unlock()
+	os.Remove(e.path)
+	return err
+}
@@ -0,0 +1,116 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bufio"
+	"strings"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// sshRetryDelay is how long we wait before starting ssh again after the
+// connection went away
+const sshRetryDelay = 5 * time.Second
+
+// sshArgs is the ssh command line that streams changes under ssh-path on
+// ssh-host, the remote host needs inotifywait from inotify-tools
+func (s *WatchStep) sshArgs() []string {
+	args := []string{"-o", "BatchMode=yes", "-o", "ServerAliveInterval=15"}
+	if s.config.SSHKey != "" {
+		args = append(args, "-i", s.config.SSHKey)
+	}
+	remote := "inotifywait -m -r -q -e close_write,create,delete,move --format '%e %w%f' " + shellQuote(s.config.SSHPath)
+	return append(args, s.config.SSHHost, remote)
+}
+
+// parseInotifyLine reads a line of `inotifywait --format '%e %w%f'`, e.g.
+// "CLOSE_WRITE,CLOSE /srv/app/main.go"
+func parseInotifyLine(line string) (fsnotify.Event, bool) {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fsnotify.Event{}, false
+	}
+	var op fsnotify.Op
+	for _, name := range strings.Split(parts[0], ",") {
+		switch name {
+		case "CREATE", "MOVED_TO":
+			op |= fsnotify.Create
+		case "CLOSE_WRITE", "MODIFY":
+			op |= fsnotify.Write
+		case "DELETE":
+			op |= fsnotify.Remove
+		case "MOVED_FROM":
+			op |= fsnotify.Rename
+		}
+	}
+	if op == 0 {
+		return fsnotify.Event{}, false
+	}
+	return fsnotify.Event{Name: parts[1], Op: op}, true
+}
+
+// watchSSH streams the changes on the remote host to changes until stop is
+// closed, starting ssh again whenever it exits. It gives up if ssh can't be
+// started at all. This is experimental, it
+// runs ssh on the host so it needs --allow-host-commands.
+func (s *WatchStep) watchSSH(changes chan<- []fsnotify.Event, stop <-chan struct{}) {
+	for {
+		cmd := execCommand("ssh", s.sshArgs()...)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			s.logger.Warnln("Unable to start ssh for remote watching:", err)
+			return
+		}
+		exited := make(chan struct{})
+		go func() {
+			select {
+			case <-stop:
+				cmd.Process.Kill()
+			case <-exited:
+			}
+		}()
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			event, ok := parseInotifyLine(scanner.Text())
+			if !ok || event.Op&s.config.Events == 0 || s.hidden(event.Name) || (len(s.config.Extensions) > 0 && !s.hasExtension(event.Name)) {
+				continue
+			}
+			select {
+			case changes <- []fsnotify.Event{event}:
+			case <-stop:
+				return
+			}
+		}
+		err = cmd.Wait()
+		close(exited)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		s.logger.Warnf("Remote watching over ssh stopped (%v), trying again in %s", err, sshRetryDelay)
+		select {
+		case <-s.clock.After(sshRetryDelay):
+		case <-stop:
+			return
+		}
+	}
+}
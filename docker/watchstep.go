@@ -16,41 +16,101 @@ package dockerlocal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/fsnotify.v1"
 
+	"github.com/fsouza/go-dockerclient"
 	"github.com/pborman/uuid"
 	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
 	"golang.org/x/net/context"
 )
 
-// test TODO (mh)
-// 1. change multiple files simultaneously and show that build only happens
-//    once
-// 2. what happens when files written while build running. queue build?
-//    make sure we don't run multiple builds in parallel
-
 // WatchStep needs to implemenet IStep
 type WatchStep struct {
 	*core.BaseStep
-	Code          string
-	reload        bool
+	config        WatchConfig
+	configErr     error
+	hostCmd       *exec.Cmd
+	hostCmdMutex  sync.Mutex
+	client        watchClient
+	ids           IDSource
+	clock         util.Clock
+	status        watchStatus
+	commandWatch  *commandWatchSet
+	oomKills      int
+	oomMutex      sync.Mutex
+	events        *eventSocket
+	reloadFiles   reloadFiles
+	copyFiles     reloadFiles
+	limiter       *reloadLimiter
+	decider       ReloadDecider
+	snapshotTaken bool
+	dirWatch      *dirWatchSet
+	eventFilters  eventFilters
+	dirJobs       dirQueue
+	artifacts     *reloadCollector
+	ttyScripts    ttyScripts
+	progress      *progressIndicator
+	dryRun        *dryRunLog
+	ready         chan struct{}
+	readyOnce     sync.Once
+	forced        chan struct{}
+	forcedOnce    sync.Once
 	data          map[string]string
 	logger        *util.LogEntry
 	options       *core.PipelineOptions
 	dockerOptions *Options
 }
 
+// IDSource hands out the unique parts of the watch step's safe ID and
+// report path
+type IDSource interface {
+	NewID() string
+}
+
+// randomIDSource is the default, a new random UUID every time
+type randomIDSource struct{}
+
+func (randomIDSource) NewID() string {
+	return uuid.NewRandom().String()
+}
+
+// StaticIDSource always returns the same ID, for tests and anything else
+// that needs stable step output paths
+type StaticIDSource string
+
+// NewID returns the static ID
+func (s StaticIDSource) NewID() string {
+	return string(s)
+}
+
 // NewWatchStep is a special step for doing docker pushes
 func NewWatchStep(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *Options) (*WatchStep, error) {
+	return NewWatchStepWithIDs(stepConfig, options, dockerOptions, randomIDSource{})
+}
+
+// NewWatchStepWithIDs is NewWatchStep with the IDs coming from ids
+func NewWatchStepWithIDs(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *Options, ids IDSource) (*WatchStep, error) {
 	name := "watch"
 	displayName := "watch"
 	if stepConfig.Name != "" {
@@ -58,7 +118,7 @@ func NewWatchStep(stepConfig *core.StepConfig, options *core.PipelineOptions, do
 	}
 
 	// Add a random number to the name to prevent collisions on disk
-	stepSafeID := fmt.Sprintf("%s-%s", name, uuid.NewRandom().String())
+	stepSafeID := fmt.Sprintf("%s-%s", name, ids.NewID())
 
 	baseStep := core.NewBaseStep(core.BaseStepOptions{
 		DisplayName: displayName,
@@ -76,21 +136,300 @@ func NewWatchStep(stepConfig *core.StepConfig, options *core.PipelineOptions, do
 		dockerOptions: dockerOptions,
 		data:          stepConfig.Data,
 		logger:        util.RootLogger().WithField("Logger", "WatchStep"),
+		config:        defaultWatchConfig(),
+		ids:           ids,
+		clock:         util.RealClock,
+		ready:         make(chan struct{}),
+		forced:        make(chan struct{}),
+		oomKills:      -1,
 	}, nil
 }
 
+// Ready is closed once the watcher has walked the project and the loop is
+// waiting for changes, a file written after that is guaranteed to be seen.
+// It's never closed when reload is off since nothing gets watched.
+func (s *WatchStep) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// markReady closes Ready, it's safe to call more than once
+func (s *WatchStep) markReady() {
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
 // InitEnv parses our data into our config
 func (s *WatchStep) InitEnv(env *util.Environment) {
-	if code, ok := s.data["code"]; ok {
-		s.Code = code
+	s.config, s.configErr = parseWatchConfig(s.data)
+	if env != nil {
+		s.interpolate(env)
 	}
-	if reload, ok := s.data["reload"]; ok {
-		if v, err := strconv.ParseBool(reload); err == nil {
-			s.reload = v
-		} else {
-			s.logger.Panic(err)
+	s.limiter = newReloadLimiter(s.config.MaxReloadsPerMinute, reloadLimitWindow)
+	for _, warning := range s.config.Warnings {
+		s.logger.Warnln(warning)
+	}
+}
+
+// interpolate fills the pipeline environment into the commands we run,
+// variables it doesn't have are left to the container's shell
+func (s *WatchStep) interpolate(env *util.Environment) {
+	s.config.Setup = env.InterpolateDefined(s.config.Setup)
+	if len(s.config.Commands) == 0 {
+		s.config.Code = env.InterpolateDefined(s.config.Code)
+		return
+	}
+	for i, cmd := range s.config.Commands {
+		s.config.Commands[i] = env.InterpolateDefined(cmd)
+	}
+	s.config.Code = commandsScript(s.config.Commands)
+}
+
+// validatePublishedPorts checks --publish values look like what
+// portBindings understands: port, host:container or ip:host:container,
+// with an optional protocol on the container port
+func validatePublishedPorts(published []string) error {
+	for _, portdef := range published {
+		parts := strings.Split(portdef, ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("publish: %q has too many parts", portdef)
+		}
+		ports := parts
+		if len(parts) == 3 {
+			if net.ParseIP(parts[0]) == nil {
+				return fmt.Errorf("publish: %q doesn't start with an IP address", portdef)
+			}
+			ports = parts[1:]
+		}
+		for i, port := range ports {
+			if i == len(ports)-1 {
+				port = strings.SplitN(port, "/", 2)[0]
+			}
+			if port == "" && i == 0 && len(ports) == 2 {
+				// docker picks the host port
+				continue
+			}
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("publish: %q has an invalid port %q", portdef, port)
+			}
+		}
+	}
+	return nil
+}
+
+// watchRoot is the directory we watch, the root key resolved against the
+// project or the whole project if it isn't set
+func (s *WatchStep) watchRoot() string {
+	if s.config.Root == "" {
+		return s.options.ProjectPath
+	}
+	if filepath.IsAbs(s.config.Root) {
+		return filepath.Clean(s.config.Root)
+	}
+	return filepath.Join(s.options.ProjectPath, s.config.Root)
+}
+
+// insideProject checks that path is the project directory or below it
+func (s *WatchStep) insideProject(path string) bool {
+	rel, err := filepath.Rel(s.options.ProjectPath, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Validate returns any problems found in our data by InitEnv. A blank code
+// is one of them unless groups are set, they bring their own commands, a
+// watch with nothing to run would only ever kill processes it never
+// started.
+func (s *WatchStep) Validate() error {
+	if s.configErr != nil {
+		return s.configErr
+	}
+	if strings.TrimSpace(s.config.Code) == "" && len(s.config.Groups) == 0 {
+		return WatchConfigError{fmt.Errorf("code: is empty and there are no commands, nothing to run on reload")}
+	}
+	if err := validatePublishedPorts(s.options.PublishPorts); err != nil {
+		return WatchConfigError{err}
+	}
+	if s.dockerOptions != nil && s.dockerOptions.Host != "" {
+		if _, err := url.Parse(s.dockerOptions.Host); err != nil {
+			return WatchConfigError{fmt.Errorf("docker host: %s", err)}
+		}
+	}
+	if len(s.config.Snapshot) > 0 && s.options.DirectMount {
+		return WatchConfigError{fmt.Errorf("snapshot: would restore files in your checkout, it only works on the container's copy, run with --direct-mount=false")}
+	}
+	if s.config.Root != "" && !s.config.RootOutsideProject && !s.insideProject(s.watchRoot()) {
+		return WatchConfigError{fmt.Errorf("root: %s is outside of the project, set root-outside-project to watch it anyway", s.watchRoot())}
+	}
+	for _, path := range s.watchPaths() {
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			return WatchConfigError{fmt.Errorf("paths: %s", err)}
+		case !info.IsDir():
+			return WatchConfigError{fmt.Errorf("paths: %s is not a directory", path)}
+		case path != s.watchRoot() && !strings.HasPrefix(path, s.watchRoot()+string(filepath.Separator)):
+			return WatchConfigError{fmt.Errorf("paths: %s is outside of root %s", path, s.watchRoot())}
+		}
+	}
+	return nil
+}
+
+// watchPaths are the directories of the paths key resolved against the
+// project, empty if the whole root is watched
+func (s *WatchStep) watchPaths() []string {
+	paths := []string{}
+	for _, path := range s.config.Paths {
+		paths = append(paths, filepath.Join(s.options.ProjectPath, path))
+	}
+	return paths
+}
+
+// command is the code we send to the container, run under the wrapper if
+// one is configured, e.g. `dlv exec --headless --listen=:2345 -- {{cmd}}`.
+//
+// The wrapper is killed and started again with the code on every reload, so
+// only one debug session is alive at a time and debuggers have to
+// reconnect after a reload. The debugger's port is forwarded like any other
+// port, publish it with --publish when starting wercker dev.
+//
+// With tty the whole thing runs in an exec with a terminal, see
+// ttyCommand.
+//
+// With user all of it runs as that user, see asUser.
+func (s *WatchStep) command() string {
+	cmd := s.config.Code
+	if s.config.Wrapper != "" {
+		cmd = strings.Replace(s.config.Wrapper, wrapperPlaceholder, cmd, -1)
+	}
+	return s.asUser(cmd)
+}
+
+// commandsScript runs cmds one after the other, the first to fail ends the
+// run and says so. The run exits with the status of the failed command or of
+// the last one.
+func commandsScript(cmds []string) string {
+	script := fmt.Sprintf("{ %s\n}", cmds[len(cmds)-1])
+	for i := len(cmds) - 2; i >= 0; i-- {
+		failed := fmt.Sprintf(`wercker_status=$?; echo "Command %d of %d failed with exit code $wercker_status:" %s >&2; (exit $wercker_status)`, i+1, len(cmds), shellQuote(cmds[i]))
+		script = fmt.Sprintf("if { %s\n}; then %s; else %s; fi", cmds[i], script, failed)
+	}
+	return script
+}
+
+// profilePath is where profiles are written in the container, each reload
+// gets its own reload-N directory below it
+func (s *WatchStep) profilePath(p ...string) string {
+	return s.options.ReportPath(append([]string{s.SafeID(), "profiles"}, p...)...)
+}
+
+// profileCommands prepare the shell for profiling a reload. Every mode
+// exports WERCKER_PROFILE_DIR for programs that write their own profiles,
+// e.g. with runtime/pprof, node also gets its CPU and heap profilers turned
+// on through NODE_OPTIONS.
+func (s *WatchStep) profileCommands(reload int) []string {
+	if s.config.Profile == "" {
+		return nil
+	}
+	dir := shellQuote(s.profilePath(fmt.Sprintf("reload-%d", reload)))
+	cmds := []string{
+		fmt.Sprintf("mkdir -p %s", dir),
+		fmt.Sprintf("export WERCKER_PROFILE_DIR=%s", dir),
+	}
+	if s.config.Profile == profileNode {
+		cmds = append(cmds, `export NODE_OPTIONS="$NODE_OPTIONS --cpu-prof --cpu-prof-dir=$WERCKER_PROFILE_DIR --heap-prof --heap-prof-dir=$WERCKER_PROFILE_DIR"`)
+	}
+	return cmds
+}
+
+// reloadCommands are the lines sent to the container for a reload of the
+// changed files, per-file-command decides what they're used for
+func (s *WatchStep) reloadCommands(reload int, files ...string) []string {
+	cmd, err := s.commandFor(files)
+	if err != nil {
+		s.logger.Warnln("Unable to fill in per-file-command, running the code:", err)
+		cmd = s.command()
+	}
+	cmds := append(s.snapshotCommands(), s.profileCommands(reload)...)
+	if s.config.TmuxSession != "" {
+		script := append(cmds, s.setupCommand(reload, cmd), fmt.Sprintf("echo $? > %s", shellQuote(s.tmuxExitFile(reload))))
+		return []string{"set +e", s.tmuxCommand(strings.Join(script, "\n")) + "; " + s.tmuxExitCommand(reload)}
+	}
+	if s.config.TTY {
+		return append(append([]string{"set +e"}, cmds...), s.ttyCommand(reload, cmd))
+	}
+	cmd = s.setupCommand(reload, cmd)
+	if s.config.KillGroup {
+		cmd = s.groupCommand(cmd)
+	}
+	return append(append([]string{"set +e"}, cmds...), s.withExit(reload, cmd))
+}
+
+// setupCommand puts setup in front of cmd until a run got through it, cmd
+// only runs if setup succeeds and a failing setup is what the run exits
+// with. A run that is stopped or fails during setup leaves it to the next
+// one. The shell says setup is done with setupSentinel, tmux panes don't
+// show us that so there setup only runs with the first run.
+func (s *WatchStep) setupCommand(reload int, cmd string) string {
+	if s.config.Setup == "" {
+		return cmd
+	}
+	if s.config.TmuxSession != "" {
+		if reload != 1 {
+			return cmd
+		}
+		return fmt.Sprintf("{ %s\n} && { %s\n}", s.asUser(s.config.Setup), cmd)
+	}
+	if s.status.setupDone() {
+		return cmd
+	}
+	return fmt.Sprintf("{ %s\n} && echo %s && { %s\n}", s.asUser(s.config.Setup), s.setupSentinel(), cmd)
+}
+
+// setupSentinel is the line the shell prints once setup succeeded
+func (s *WatchStep) setupSentinel() string {
+	return "wercker-watch-setup-" + s.SafeID()
+}
+
+// parseSetupDone takes the setupSentinel lines out of some output and says
+// whether there were any
+func (s *WatchStep) parseSetupDone(output string) (string, bool) {
+	sentinel := s.setupSentinel()
+	if !strings.Contains(output, sentinel) {
+		return output, false
+	}
+	kept := []string{}
+	done := false
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if strings.TrimSpace(line) == sentinel {
+			done = true
+			continue
 		}
+		kept = append(kept, line)
 	}
+	return strings.Join(kept, ""), done
+}
+
+// groupPidfile is where kill-group keeps the process group of the code
+func (s *WatchStep) groupPidfile() string {
+	return fmt.Sprintf("/tmp/wercker-watch-%s.pgid", s.SafeID())
+}
+
+// groupCommand starts cmd in a process group of its own with setsid and
+// writes down its id, then waits for it so the session behaves as if cmd
+// ran in the foreground. Without setsid in the box cmd just runs as is and
+// the kill falls back to signalling everything.
+func (s *WatchStep) groupCommand(cmd string) string {
+	pidfile := shellQuote(s.groupPidfile())
+	return fmt.Sprintf(`if command -v setsid >/dev/null 2>&1; then setsid sh -c %[2]s & echo $! > %[1]s; wait $!; else rm -f %[1]s; %[3]s; fi`, pidfile, shellQuote(cmd), cmd)
+}
+
+// tmuxCommand runs script in the pane of our tmux session, creating the
+// session the first time and replacing whatever ran there before on later
+// reloads, so users can `docker exec -it <container> tmux attach` to it.
+// The box needs to have tmux installed. The output goes to the session
+// rather than to our logs, and the pane stays around after the command
+// exits so it can still be read.
+func (s *WatchStep) tmuxCommand(script string) string {
+	session := shellQuote(s.config.TmuxSession)
+	return fmt.Sprintf(`tmux has-session -t %[1]s 2>/dev/null || { tmux new-session -d -s %[1]s && tmux set-option -t %[1]s remain-on-exit on; }; tmux respawn-pane -k -t %[1]s %[2]s`, session, shellQuote(script))
 }
 
 // Fetch NOP
@@ -99,18 +438,19 @@ func (s *WatchStep) Fetch() (string, error) {
 	return "", nil
 }
 
-// filterGitignore tries to exclude patterns defined in gitignore
-func (s *WatchStep) filterGitignore(root string) []string {
+// loadIgnoreFile tries to exclude patterns defined in the ignore file
+// name, .gitignore or anything else written in its syntax like
+// .werckerignore
+func (s *WatchStep) loadIgnoreFile(root, name string) []string {
 	filters := []string{}
-	gitignorePath := filepath.Join(root, ".gitignore")
-	file, err := os.Open(gitignorePath)
+	file, err := os.Open(filepath.Join(root, name))
 	if err == nil {
-		s.logger.Debug("Excluding file patterns in .gitignore")
+		s.logger.Debug("Excluding file patterns in ", name)
 		defer file.Close()
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			t := strings.Trim(scanner.Text(), " ")
-			if t == "" || strings.HasPrefix(t, "#") {
+			t, ok := parseGitignoreLine(scanner.Text())
+			if !ok {
 				continue
 			}
 			filters = append(filters, filepath.Join(root, t))
@@ -119,218 +459,2117 @@ func (s *WatchStep) filterGitignore(root string) []string {
 	return filters
 }
 
-func (s *WatchStep) watch(root string) (*fsnotify.Watcher, error) {
-	// Set up the filesystem watcher
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, err
+// parseGitignoreLine turns a line of a .gitignore into a pattern following
+// gitignore(5): blank lines and comments are skipped, trailing spaces are
+// dropped unless escaped with a backslash, and a leading \# or \! is taken
+// literally. Escapes are left in place for filepath.Match to handle. We
+// don't support re-including files, so negated patterns are skipped.
+func parseGitignoreLine(line string) (string, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") {
+		trimmed := strings.TrimSuffix(line, " ")
+		escapes := len(trimmed) - len(strings.TrimRight(trimmed, `\`))
+		if escapes%2 == 1 {
+			break
+		}
+		line = trimmed
 	}
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+		return "", false
+	}
+	return line, true
+}
 
+// defaultIgnoreFiles are read for patterns to exclude, .werckerignore is
+// for what shouldn't reload but still belongs in version control
+var defaultIgnoreFiles = []string{".gitignore", ".werckerignore"}
+
+// watchFilters returns the exclusion patterns used when walking root
+func (s *WatchStep) watchFilters(root string) []string {
+	// wercker's own directories are left out by internalDir. With
+	// watch-hidden .git still is, it changes on every commit
+	hidden := ".*"
+	if s.config.WatchHidden {
+		hidden = ".git"
+	}
 	filters := []string{
-		fmt.Sprintf("%s*", s.options.StepPath()),
-		fmt.Sprintf("%s*", s.options.ProjectDownloadPath()),
-		fmt.Sprintf("%s*", s.options.BuildPath()),
-		".*",
+		hidden,
 		"_*",
 	}
 
-	watchCount := 0
+	// import the ignore files that exist, .gitignore and .werckerignore by
+	// default. The project's own still apply when watching a root below it
+	for _, name := range s.config.IgnoreFiles {
+		if root != s.options.ProjectPath {
+			filters = append(filters, s.loadIgnoreFile(s.options.ProjectPath, name)...)
+		}
+		filters = append(filters, s.loadIgnoreFile(root, name)...)
+	}
+	return filters
+}
+
+// internalDirs are the directories wercker writes to during a build,
+// watching them would have every build trigger the next one
+func (s *WatchStep) internalDirs() []string {
+	if s.options == nil {
+		return nil
+	}
+	return []string{
+		s.options.StepPath(),
+		s.options.ProjectDownloadPath(),
+		s.options.BuildPath(),
+	}
+}
 
-	// import a .gitignore if it exists
-	filters = append(filters, s.filterGitignore(root)...)
+// internalDir returns the internal directory path is in, if any. Paths are
+// compared made absolute and cleaned so a relative working dir or a
+// trailing slash doesn't keep them from matching.
+func (s *WatchStep) internalDir(path string) (string, bool) {
+	path = absPath(path)
+	for _, dir := range s.internalDirs() {
+		abs := absPath(dir)
+		if path == abs || strings.HasPrefix(path, abs+string(filepath.Separator)) {
+			return dir, true
+		}
+	}
+	return "", false
+}
 
-	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			if err != nil {
-				return err
-			}
-			partialPath := filepath.Base(path)
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
 
-			s.logger.Debugln("check path", path, partialPath)
-			for _, pattern := range filters {
-				matchFull, err := filepath.Match(pattern, path)
-				if err != nil {
-					s.logger.Warnln("Bad exclusion pattern: %s", pattern)
-				}
-				if matchFull {
-					s.logger.Debugf("exclude (%s): %s", pattern, path)
-					return filepath.SkipDir
-				}
-				matchPartial, _ := filepath.Match(pattern, partialPath)
-				if matchPartial {
-					s.logger.Debugf("exclude (%s): %s", pattern, partialPath)
-					return filepath.SkipDir
-				}
-			}
-			s.logger.Debugln("Watching:", path)
-			watchCount = watchCount + 1
-			if err := watcher.Add(path); err != nil {
-				return err
-			}
+// matchFilters returns the first pattern in filters that excludes path,
+// checking both the full path and its base name. wercker's internal
+// directories are always excluded.
+func (s *WatchStep) matchFilters(filters []string, path string) (string, bool) {
+	if dir, ok := s.internalDir(path); ok {
+		return dir, true
+	}
+	partialPath := filepath.Base(path)
+	for _, pattern := range filters {
+		matchFull, err := filepath.Match(pattern, path)
+		if err != nil {
+			s.logger.Warnf("Bad exclusion pattern: %s", pattern)
 		}
-		return nil
-	})
+		if matchFull {
+			return pattern, true
+		}
+		matchPartial, _ := filepath.Match(pattern, partialPath)
+		if matchPartial {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// excludeDecision records whether a directory would be watched, and if not
+// which pattern excluded it
+type excludeDecision struct {
+	Path     string
+	Excluded bool
+	Pattern  string
+}
+
+// explainExcludeDecisions runs the same filter logic as watch over the
+// top-level directories of root and records the decision for each one
+func (s *WatchStep) explainExcludeDecisions(root string) ([]excludeDecision, error) {
+	filters := s.watchFilters(root)
+	entries, err := ioutil.ReadDir(root)
 	if err != nil {
 		return nil, err
 	}
-	s.logger.Debugf("Watching %d directories", watchCount)
-	return watcher, nil
+	decisions := []excludeDecision{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(root, entry.Name())
+		pattern, excluded := s.matchFilters(filters, path)
+		decisions = append(decisions, excludeDecision{
+			Path:     path,
+			Excluded: excluded,
+			Pattern:  pattern,
+		})
+	}
+	return decisions, nil
 }
 
-// killProcesses sends a signal to all the processes on the machine except
-// for PID 1, somewhat naive but seems to work
-func (s *WatchStep) killProcesses(containerID string, signal string) error {
-	client, err := NewDockerClient(s.dockerOptions)
+// reportExcludes prints the exclude decisions for root to the log
+func (s *WatchStep) reportExcludes(root string, f *util.Formatter) error {
+	decisions, err := s.explainExcludeDecisions(root)
 	if err != nil {
 		return err
 	}
-	cmd := []string{`/bin/sh`, `-c`, fmt.Sprintf(`ps | grep -v PID | awk "{if (\$1 != 1) print \$1}" | xargs -n 1 kill -s %s`, signal)}
-	err = client.ExecOne(containerID, cmd, os.Stdout)
-	if err != nil {
-		return err
+	s.logger.Info(f.Info("Watch exclusions for", root))
+	for _, d := range decisions {
+		rel, err := filepath.Rel(root, d.Path)
+		if err != nil {
+			rel = d.Path
+		}
+		if d.Excluded {
+			s.logger.Info(f.Fail("  excluded", fmt.Sprintf("%s (%s)", rel, d.Pattern)))
+		} else {
+			s.logger.Info(f.Success("  watched", rel))
+		}
 	}
 	return nil
 }
 
-// Execute runs a command and optionally reloads it
-func (s *WatchStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
-	e, err := core.EmitterFromContext(ctx)
-	if err != nil {
-		return -1, err
-	}
+func (s *WatchStep) watch(root string) (fileWatcher, error) {
+	// Set up the filesystem watcher
+	watcher := s.newFileWatcher()
 
-	// TODO(termie): PACKAGING make this a feature of session and remove
-	//               the calls into its struct
-	// Start watching our stdout
-	stopListening := make(chan struct{})
-	defer func() { stopListening <- struct{}{} }()
-	go func() {
-		for {
-			select {
-			case line := <-sess.Recv():
-				e.Emit(core.Logs, &core.LogsArgs{
-					// Hidden: sess.logsHidden,
-					Logs: line,
-				})
-			// We need to make sure we stop eating the stdout from the container
-			// promiscuously when we finish out step
-			case <-stopListening:
-				return
+	// Let a command tell us what to watch instead of walking everything
+	if s.config.WatchFromCommand != "" {
+		if s.options.AllowHostCommands {
+			s.commandWatch = newCommandWatchSet()
+			if err := s.watchFromCommand(watcher); err != nil {
+				watcher.Close()
+				return nil, fmt.Errorf("watch-from-command failed: %s", err)
 			}
+			return watcher, nil
 		}
-	}()
+		s.logger.Warnln("Ignoring watch-from-command, run with --allow-host-commands to enable it")
+	}
 
-	// cheating to get containerID
-	// TODO(termie): we should deal with this eventually
-	dt := sess.Transport().(*DockerTransport)
-	containerID := dt.containerID
-
-	// Set up a signal handler to end our step.
-	finishedStep := make(chan struct{})
-	stopWatchHandler := &util.SignalHandler{
-		ID: "stop-watch",
-		// Signal our stuff to stop and finish the step, return false to
-		// signify that we've handled the signal and don't process further
-		F: func() bool {
-			s.logger.Println("Keyboard interrupt detected, finishing step")
-			finishedStep <- struct{}{}
-			return false
-		},
+	dirs, err := s.watchDirs(root)
+	if err != nil {
+		watcher.Close()
+		return nil, err
 	}
-	util.GlobalSigint().Add(stopWatchHandler)
-	// NOTE(termie): I think the only way to exit this code is via this
-	//               signal handler and the signal monkey removes handlers
-	//               after it processes them, so this may be superfluous
-	defer util.GlobalSigint().Remove(stopWatchHandler)
+	s.dirWatch = newDirWatchSet()
+	if added, _, err := s.dirWatch.update(watcher, dirs); err != nil {
+		watcher.Close()
+		if _, polling := watcher.(*pollWatcher); polling {
+			return nil, err
+		}
+		// inotify runs out of watches on big trees
+		err = watchLimitError(err, len(added))
+		watcher = s.pollFallback(err)
+		s.dirWatch = newDirWatchSet()
+		if _, _, err := s.dirWatch.update(watcher, dirs); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	watchCount := len(dirs)
+	s.logger.Debugf("Watching %d directories", watchCount)
+	// git and the remote host find changes without the watcher
+	if watchCount == 0 && !s.config.GitTrigger && s.config.SSHHost == "" {
+		err := fmt.Errorf("no directories under %s are watched, nothing will trigger a reload. Check root, extensions and your excludes, explain-excludes lists why each directory was left out", root)
+		if s.config.Strict {
+			watcher.Close()
+			return nil, err
+		}
+		s.logger.Warnln(err)
+	}
+	s.status.mutex.Lock()
+	s.status.watchedDirs = watchCount
+	s.status.mutex.Unlock()
+	return watcher, nil
+}
 
-	// If we're not going to reload just run the thing once, synchronously
-	if !s.reload {
-		err := sess.Send(ctx, false, "set +e", s.Code)
-		if err != nil {
-			return 0, err
+// hasExtension checks path against the extensions key
+func (s *WatchStep) hasExtension(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, want := range s.config.Extensions {
+		if ext == strings.ToLower(want) {
+			return true
 		}
-		<-finishedStep
-		// ignoring errors
-		s.killProcesses(containerID, "INT")
-		return 0, nil
 	}
-	f := &util.Formatter{s.options.GlobalOptions.ShowColors}
-	s.logger.Info(f.Info("Reloading on file changes"))
-	doCmd := func() {
-		err := sess.Send(ctx, false, "set +e", s.Code)
+	return false
+}
+
+// dirsWithExtensions finds the directories under root that contain, at any
+// depth, a file matching the extensions key. Directories without one aren't
+// watched at all, so files of that kind created there later are missed
+// until the watch is restarted.
+func (s *WatchStep) dirsWithExtensions(root string, filters *dirFilters) (map[string]bool, error) {
+	relevant := map[string]bool{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			s.logger.Errorln(err)
-			return
+			return err
 		}
-		open, err := exposedPortMaps(s.dockerOptions.Host, s.options.PublishPorts)
-		if err != nil {
-			s.logger.Warnf(f.Info("There was a problem parsing your docker host."), err)
-			return
+		if info.IsDir() {
+			if _, excluded := filters.match(path); excluded {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		for _, uri := range open {
-			s.logger.Infof(f.Info("Forwarding %s to %s on the container."), uri.HostURI, uri.ContainerPort)
+		if !s.hasExtension(path) {
+			return nil
 		}
+		for dir := filepath.Dir(path); !relevant[dir]; dir = filepath.Dir(dir) {
+			relevant[dir] = true
+			if dir == root || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+		return nil
+	})
+	return relevant, err
+}
+
+// maxStatusTriggers is how many triggering files we remember for the
+// status dump
+const maxStatusTriggers = 10
+
+// watchStatus is what we know about a running watch loop, it is dumped to
+// the log on SIGUSR1
+type watchStatus struct {
+	mutex        sync.Mutex
+	building     bool
+	pending      bool
+	triggers     []string
+	watchedDirs  int
+	reloadStart  time.Time
+	lastDuration time.Duration
+	reloads      int
+	superseded   int
+	// lastExit is the exit code of the last run that ended on its own
+	lastExit *int
+	// setup is set once a run got through setup
+	setup bool
+}
+
+// trigger records a file that triggered a reload
+func (w *watchStatus) trigger(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = true
+	w.triggers = append(w.triggers, path)
+	if len(w.triggers) > maxStatusTriggers {
+		w.triggers = w.triggers[len(w.triggers)-maxStatusTriggers:]
 	}
+}
 
-	// Otherwise set up a watcher and do some magic
-	watcher, err := s.watch(s.options.ProjectPath)
-	if err != nil {
-		return -1, err
+// settle marks the pending reload as handed off to the build
+func (w *watchStatus) settle() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = false
+}
+
+// startReload marks a build in flight and returns which reload it is,
+// starting at 1
+func (w *watchStatus) startReload() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.building = true
+	w.reloadStart = time.Now()
+	w.reloads++
+	w.lastExit = nil
+	return w.reloads
+}
+
+// supersede marks the runs so far as ones we're about to kill, their exits
+// aren't the code exiting on its own
+func (w *watchStatus) supersede() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.superseded = w.reloads
+}
+
+// current says whether reload is the run we'd expect to see exit
+func (w *watchStatus) current(reload int) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return reload > w.superseded && reload == w.reloads
+}
+
+// running says whether a run was started that hasn't exited and isn't
+// about to be killed
+func (w *watchStatus) running() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.reloads > w.superseded && w.lastExit == nil
+}
+
+// exited records the exit code of a run that ended on its own, it is
+// ignored unless the run is current
+func (w *watchStatus) exited(reload, code int) bool {
+	if !w.current(reload) {
+		return false
 	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.lastExit = &code
+	return true
+}
 
-	debounce := util.NewDebouncer(2 * time.Second)
-	done := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case event := <-watcher.Events:
-				s.logger.Debugln("fsnotify event", event.String())
-				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Remove == fsnotify.Remove {
-					if !strings.HasPrefix(filepath.Base(event.Name), ".") {
-						s.logger.Debug(f.Info("Modified file", event.Name))
-						debounce.Trigger()
-					}
-				}
-			case <-debounce.C:
-				err := s.killProcesses(containerID, "INT")
-				if err != nil {
-					s.logger.Panic(err)
-					return
-				}
-				s.logger.Info(f.Info("Reloading"))
-				go doCmd()
-			case err := <-watcher.Errors:
-				s.logger.Error(err)
-				done <- struct{}{}
-				return
-			case <-finishedStep:
-				s.killProcesses(containerID, "INT")
-				done <- struct{}{}
-				return
-			}
-		}
-	}()
+// exitCode is the exit code of the last run that ended on its own, if any
+// did since it was started
+func (w *watchStatus) exitCode() (int, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.lastExit == nil {
+		return 0, false
+	}
+	return *w.lastExit, true
+}
 
-	// Run build on first run
-	debounce.Trigger()
-	<-done
-	return 0, nil
+// sent marks the code of the current reload as sent to the shell, its
+// duration counts from here
+func (w *watchStatus) sent() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.reloadStart = time.Now()
 }
 
-// CollectFile NOP
-func (s *WatchStep) CollectFile(a, b, c string, dst io.Writer) error {
-	return nil
+// finishReload marks reload as done, once its code exited or couldn't be
+// sent. Only the latest reload counts.
+func (w *watchStatus) finishReload(reload int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if reload != w.reloads || !w.building {
+		return
+	}
+	w.building = false
+	w.lastDuration = time.Since(w.reloadStart)
 }
 
-// CollectArtifact NOP
-func (s *WatchStep) CollectArtifact(string) (*core.Artifact, error) {
-	return nil, nil
+// setupDone says whether a run got through setup
+func (w *watchStatus) setupDone() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.setup
 }
 
-// ReportPath getter
-func (s *WatchStep) ReportPath(...string) string {
-	// for now we just want something that doesn't exist
-	return uuid.NewRandom().String()
+// finishSetup records that a run got through setup
+func (w *watchStatus) finishSetup() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.setup = true
+}
+
+// dump writes the current state to the log
+func (w *watchStatus) dump(logger *util.LogEntry, f *util.Formatter) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	logger.Println(f.Info("Watch status"))
+	logger.Println(f.Info("  Build in flight:", strconv.FormatBool(w.building)))
+	logger.Println(f.Info("  Reload pending:", strconv.FormatBool(w.pending)))
+	logger.Println(f.Info("  Watched directories:", strconv.Itoa(w.watchedDirs)))
+	logger.Println(f.Info("  Last reload duration:", w.lastDuration.String()))
+	if len(w.triggers) == 0 {
+		logger.Println(f.Info("  Last triggering files: none"))
+		return
+	}
+	logger.Println(f.Info("  Last triggering files:"))
+	for _, path := range w.triggers {
+		logger.Println(f.Info("   ", path))
+	}
+}
+
+// maxShownChanges is how many changed files show-changes lists before
+// summarizing the rest
+const maxShownChanges = 10
+
+// changeSet collects the files changed since the last reload with git-style
+// markers, A for added, M for modified and D for deleted
+type changeSet struct {
+	paths   []string
+	markers map[string]string
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{markers: map[string]string{}}
+}
+
+// add records an event, a file that was added and then modified is still
+// just added
+func (c *changeSet) add(event fsnotify.Event) {
+	marker := "M"
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		marker = "A"
+	} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		marker = "D"
+	}
+	previous, seen := c.markers[event.Name]
+	if !seen {
+		c.paths = append(c.paths, event.Name)
+	} else if previous == "A" && marker == "M" {
+		return
+	}
+	c.markers[event.Name] = marker
+}
+
+// present are the changed paths that weren't deleted
+func (c *changeSet) present() []string {
+	paths := []string{}
+	for _, path := range c.paths {
+		if c.markers[path] != "D" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// lines describes the changes, listing at most limit of them
+func (c *changeSet) lines(limit int) []string {
+	lines := []string{}
+	for i, path := range c.paths {
+		if i == limit {
+			lines = append(lines, fmt.Sprintf("and %d more", len(c.paths)-limit))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", c.markers[path], path))
+	}
+	return lines
+}
+
+// binarySniffLen is how much of a file we look at to guess if it is binary,
+// the same amount git uses
+const binarySniffLen = 8000
+
+// isBinaryFile guesses whether a file is binary by looking for a null byte
+// near its start
+func isBinaryFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	buf := make([]byte, binarySniffLen)
+	n, _ := io.ReadFull(file, buf)
+	for _, b := range buf[:n] {
+		if b == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// skipTrigger checks whether changes to a file should be ignored because it
+// is too large or looks like a binary, files that no longer exist always
+// trigger
+func (s *WatchStep) skipTrigger(path string) bool {
+	if s.config.MaxTriggerSize == 0 && !s.config.SkipBinary {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	if s.config.MaxTriggerSize > 0 && info.Size() > s.config.MaxTriggerSize {
+		s.logger.Debugf("Ignoring change to large file (%d bytes): %s", info.Size(), path)
+		return true
+	}
+	if s.config.SkipBinary && isBinaryFile(path) {
+		s.logger.Debugln("Ignoring change to binary file:", path)
+		return true
+	}
+	return false
+}
+
+// ignoredWrite checks path against ignore-writes, the patterns match the
+// path relative to the project, one of its directories or its base name
+func (s *WatchStep) ignoredWrite(path string) (string, bool) {
+	if len(s.config.IgnoreWrites) == 0 {
+		return "", false
+	}
+	rel := filepath.Base(path)
+	if s.options != nil {
+		if r, err := filepath.Rel(s.options.ProjectPath, path); err == nil && !strings.HasPrefix(r, "..") {
+			rel = r
+		}
+	}
+	base := filepath.Base(rel)
+	for _, pattern := range s.config.IgnoreWrites {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return pattern, true
+		}
+		for p := rel; p != "." && p != "/" && p != ""; p = filepath.Dir(p) {
+			if ok, _ := filepath.Match(pattern, p); ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// shouldTrigger checks whether an event is one that should cause a reload
+func (s *WatchStep) shouldTrigger(event fsnotify.Event) bool {
+	if event.Op&s.config.Events == 0 {
+		return false
+	}
+	if s.commandWatch != nil && !s.commandWatch.matches(event.Name) {
+		return false
+	}
+	if pattern, excluded := s.excludedLocation(event.Name); excluded {
+		s.logger.Debugf("Ignoring change in an excluded directory (%s): %s", pattern, event.Name)
+		return false
+	}
+	if pattern, ok := s.ignoredWrite(event.Name); ok {
+		s.logger.Debugf("Ignoring change to a file the code writes (%s): %s", pattern, event.Name)
+		return false
+	}
+	if len(s.config.Extensions) > 0 && !s.hasExtension(event.Name) {
+		s.logger.Debugln("Ignoring change to a file without one of the extensions:", event.Name)
+		return false
+	}
+	return !s.hidden(event.Name) && !s.skipTrigger(event.Name)
+}
+
+// hidden tells whether path is a dotfile we leave alone, watch-hidden
+// turns that off
+func (s *WatchStep) hidden(path string) bool {
+	return !s.config.WatchHidden && strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// filterOutput keeps the lines of some container output that pass
+// log-filter and log-exclude, the log file still gets everything
+func (s *WatchStep) filterOutput(output string) string {
+	if s.config.LogFilter == nil && s.config.LogExclude == nil {
+		return output
+	}
+	kept := []string{}
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if line == "" {
+			continue
+		}
+		if s.config.LogFilter != nil && !s.config.LogFilter.MatchString(line) {
+			continue
+		}
+		if s.config.LogExclude != nil && s.config.LogExclude.MatchString(line) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "")
+}
+
+// openLogFile opens the file the command output is copied to, appending
+// to it unless log-file-truncate is set
+func (s *WatchStep) openLogFile() (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if s.config.LogFileTruncate {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	return os.OpenFile(s.config.LogFile, flags, 0644)
+}
+
+// runHostCommand runs host-command on the host (not in the container) from
+// the project directory once the code of a reload exited 0, stopping a
+// previous run if it is still going.
+// This is only allowed when wercker was started with --allow-host-commands.
+func (s *WatchStep) runHostCommand() {
+	if s.config.HostCommand == "" {
+		return
+	}
+	if !s.options.AllowHostCommands {
+		s.logger.Warnln("Ignoring host-command, run with --allow-host-commands to enable it")
+		return
+	}
+
+	s.hostCmdMutex.Lock()
+	defer s.hostCmdMutex.Unlock()
+	s.stopHostCommandLocked()
+
+	cmd := exec.Command("/bin/sh", "-c", s.config.HostCommand)
+	cmd.Dir = s.options.ProjectPath
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	s.logger.Debugln("Running host command:", s.config.HostCommand)
+	if err := cmd.Start(); err != nil {
+		s.logger.Errorln("Unable to run host command:", err)
+		return
+	}
+	s.hostCmd = cmd
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			s.logger.Debugln("Host command finished:", err)
+		}
+	}()
+}
+
+// execCommand and lookPath are swapped out in tests so we don't pop up real
+// notifications
+var execCommand = exec.Command
+var lookPath = exec.LookPath
+
+// notifyArgs is the host command that shows a desktop notification
+func notifyArgs(goos, title, message string) []string {
+	switch goos {
+	case "darwin":
+		return []string{"osascript", "-e", fmt.Sprintf(`display notification %s with title %s`, appleScriptQuote(message), appleScriptQuote(title))}
+	case "windows":
+		return []string{"powershell", "-NoProfile", "-Command", fmt.Sprintf(`New-BurntToastNotification -Text %s, %s`, powershellQuote(title), powershellQuote(message))}
+	default:
+		return []string{"notify-send", title, message}
+	}
+}
+
+func appleScriptQuote(value string) string {
+	return `"` + strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func powershellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// notifyReload tells the desktop how a reload went if notify is set, once
+// its code exited with code or couldn't be started. code is nil when there
+// is no exit line to wait for. Having no notifier installed is not an
+// error.
+func (s *WatchStep) notifyReload(duration time.Duration, code *int, err error) {
+	if !s.config.Notify {
+		return
+	}
+	title := "wercker: reload finished"
+	message := fmt.Sprintf("Reloaded in %.1fs", duration.Seconds())
+	if err != nil {
+		title = "wercker: reload failed"
+		message = err.Error()
+	} else if code != nil && *code != 0 {
+		title = "wercker: reload failed"
+		message = fmt.Sprintf("The code exited with %d after %.1fs", *code, duration.Seconds())
+	}
+	args := notifyArgs(runtime.GOOS, title, message)
+	if _, lookErr := lookPath(args[0]); lookErr != nil {
+		s.logger.Debugln("No notifier found:", args[0])
+		return
+	}
+	if notifyErr := execCommand(args[0], args[1:]...).Run(); notifyErr != nil {
+		s.logger.Debugln("Notification failed:", notifyErr)
+	}
+}
+
+// stopHostCommand kills the host command if it is still running
+func (s *WatchStep) stopHostCommand() {
+	s.hostCmdMutex.Lock()
+	defer s.hostCmdMutex.Unlock()
+	s.stopHostCommandLocked()
+}
+
+func (s *WatchStep) stopHostCommandLocked() {
+	if s.hostCmd == nil {
+		return
+	}
+	// Kill errors out harmlessly if the command has already finished
+	s.hostCmd.Process.Kill()
+	s.hostCmd = nil
+}
+
+// killProcesses sends a signal to all the processes on the machine except
+// for PID 1, somewhat naive but seems to work
+func (s *WatchStep) killProcesses(containerID string, signal string) error {
+	if s.config.DryRun {
+		s.dryRun.say("would send SIG" + signal + " to the code")
+		return nil
+	}
+	_, err := s.signalProcesses(containerID, signal)
+	return err
+}
+
+// signalProcesses is killProcesses handing back what got the signal. It
+// goes through the docker API first, that works in images without a shell,
+// and only runs the shell pipelines if that fails.
+func (s *WatchStep) signalProcesses(containerID string, signal string) (signalled, error) {
+	client, err := s.dockerClient()
+	if err != nil {
+		return signalled{}, err
+	}
+	sent, err := s.apiSignal(client, containerID, signal)
+	if err == nil {
+		if len(sent.pids) > 0 {
+			s.logger.Debugf("Sent SIG%s to PIDs %s, found through docker top", signal, strings.Join(sent.pids, " "))
+		} else {
+			s.logger.Debugf("Sent SIG%s to no processes, looked through docker top", signal)
+		}
+		return sent, nil
+	}
+	if isContainerGone(err) {
+		return signalled{}, err
+	}
+	s.logger.Debugf("Unable to signal through the docker API, falling back to the shell: %s", err)
+
+	var output bytes.Buffer
+	// Look the processes up in /proc, only ps if the container has no /proc
+	found := "/proc"
+	codes, err := client.ExecAll(containerID, [][]string{{`/bin/sh`, `-c`, s.procKillCommand(signal)}}, &output)
+	if err != nil {
+		return signalled{}, err
+	}
+	if codes[0] != 0 {
+		s.logger.Debugf("Unable to list processes through /proc (exit code %d), falling back to ps", codes[0])
+		found = "ps"
+		output.Reset()
+		cmd := []string{`/bin/sh`, `-c`, s.killCommand(signal)}
+		if err := client.ExecOne(containerID, cmd, &output); err != nil {
+			return signalled{}, err
+		}
+	}
+	pids := parseKilledPids(output.String())
+	if len(pids) > 0 {
+		s.logger.Debugf("Sent SIG%s to PIDs %s, found through %s", signal, strings.Join(pids, " "), found)
+	} else {
+		s.logger.Debugf("Sent SIG%s to no processes, looked through %s", signal, found)
+	}
+	return signalled{pids: pids}, nil
+}
+
+// parseKilledPids picks the PIDs killCommand echoed out of its output
+func parseKilledPids(output string) []string {
+	pids := []string{}
+	for _, field := range strings.Fields(output) {
+		if _, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, field)
+		}
+	}
+	return pids
+}
+
+// killCommand is the shell pipeline that signals everything in the
+// container except PID 1 and the processes named in keep-pidfiles. Only the
+// PIDs in the files are kept, children of those processes are still killed.
+// Every PID that took the signal is echoed so we can log it.
+//
+// With kill-group only the code's process group is signalled, which gets
+// the children it left behind too, that group is echoed as a negative PID.
+// If there's no group to signal we fall back to everything.
+func (s *WatchStep) killCommand(signal string) string {
+	all := s.killAllCommand(signal)
+	if !s.config.KillGroup {
+		return all
+	}
+	pidfile := shellQuote(s.groupPidfile())
+	return fmt.Sprintf(`pgid=$(cat %[1]s 2>/dev/null); if [ -n "$pgid" ] && [ "$pgid" != 1 ] && kill -s %[2]s -- -$pgid 2>/dev/null; then echo -$pgid; else %[3]s; fi`, pidfile, signal, all)
+}
+
+// killAllCommand is killCommand without kill-group. It needs ps, awk and
+// grep in the container, procKillCommand doesn't and is tried first.
+func (s *WatchStep) killAllCommand(signal string) string {
+	if len(s.config.KeepPidfiles) == 0 {
+		return fmt.Sprintf(`ps | grep -v PID | awk "{if (\$1 != 1) print \$1}" | while read pid; do kill -s %s $pid 2>/dev/null && echo $pid; done`, signal)
+	}
+	quoted := make([]string, len(s.config.KeepPidfiles))
+	for i, path := range s.config.KeepPidfiles {
+		quoted[i] = shellQuote(path)
+	}
+	return fmt.Sprintf(`keep=" $(cat %s 2>/dev/null | tr '\n' ' ') "; ps | grep -v PID | awk "{if (\$1 != 1) print \$1}" | while read pid; do case "$keep" in *" $pid "*) ;; *) kill -s %s $pid 2>/dev/null && echo $pid ;; esac; done`, strings.Join(quoted, " "), signal)
+}
+
+// shellQuote single quotes a string for /bin/sh
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// listeningPortsCmd prints the local address of every listening TCP socket
+// in the container, e.g. 00000000:1F90
+const listeningPortsCmd = `cat /proc/net/tcp /proc/net/tcp6 2>/dev/null | awk '$4 == "0A" {print $2}'`
+
+// parseListeningPorts reads the output of listeningPortsCmd
+func parseListeningPorts(output string) map[int]bool {
+	ports := map[int]bool{}
+	for _, addr := range strings.Fields(output) {
+		i := strings.LastIndex(addr, ":")
+		if i == -1 {
+			continue
+		}
+		port, err := strconv.ParseInt(addr[i+1:], 16, 32)
+		if err != nil {
+			continue
+		}
+		ports[int(port)] = true
+	}
+	return ports
+}
+
+// waitForPorts polls the container until none of the wait-for-ports are
+// being listened on anymore so the new process can bind them, giving up
+// after wait-for-ports-timeout.
+func (s *WatchStep) waitForPorts(containerID string) error {
+	if len(s.config.WaitForPorts) == 0 {
+		return nil
+	}
+	client, err := s.dockerClient()
+	if err != nil {
+		return err
+	}
+	deadline := s.clock.Now().Add(s.config.WaitForPortsTimeout)
+	for {
+		var output bytes.Buffer
+		cmd := []string{`/bin/sh`, `-c`, listeningPortsCmd}
+		if err := client.ExecOne(containerID, cmd, &output); err != nil {
+			return err
+		}
+		listening := parseListeningPorts(output.String())
+		busy := []string{}
+		for _, port := range s.config.WaitForPorts {
+			if listening[port] {
+				busy = append(busy, strconv.Itoa(port))
+			}
+		}
+		if len(busy) == 0 {
+			return nil
+		}
+		if s.clock.Now().After(deadline) {
+			return fmt.Errorf("Ports still in use after %s: %s", s.config.WaitForPortsTimeout, strings.Join(busy, ", "))
+		}
+		s.logger.Debugln("Waiting for ports to be released:", strings.Join(busy, ", "))
+		<-s.clock.After(200 * time.Millisecond)
+	}
+}
+
+// triggerHandler accepts POSTs from external tools, e.g. a sync tool that
+// finished copying files, and asks for a reload. If token is set requests
+// must pass it in the X-Wercker-Token header.
+func triggerHandler(token string, trigger chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Wercker-Token")), []byte(token)) != 1 {
+			http.Error(w, "Invalid token", http.StatusForbidden)
+			return
+		}
+		select {
+		case trigger <- struct{}{}:
+		default:
+			// a reload is already on its way
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// startTriggerServer listens on the loopback interface for trigger-port
+// webhooks, closing the returned listener shuts it down
+func (s *WatchStep) startTriggerServer(trigger chan<- struct{}) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", s.config.TriggerPort))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := http.Serve(listener, triggerHandler(s.config.TriggerToken, trigger))
+		s.logger.Debugln("Trigger webhook stopped:", err)
+	}()
+	return listener, nil
+}
+
+// watchClient is the part of the docker client the watch step uses to
+// manage its container
+type watchClient interface {
+	ExecOne(containerID string, cmd []string, output io.Writer) error
+	ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error)
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+	UpdateContainer(id string, opts docker.UpdateContainerOptions) error
+	UploadToContainer(id string, opts docker.UploadToContainerOptions) error
+	InspectContainer(id string) (*docker.Container, error)
+	TopContainer(id string, psArgs string) (docker.TopResult, error)
+	ExecTTY(containerID string, cmd []string, output io.Writer) (int, error)
+}
+
+// containerTransport is a transport whose session runs in a container,
+// DockerTransport is the one we get outside of the tests
+type containerTransport interface {
+	ContainerID() string
+}
+
+// dockerClient returns the client for talking to our container
+func (s *WatchStep) dockerClient() (watchClient, error) {
+	if s.client == nil {
+		client, err := NewDockerClient(s.dockerOptions)
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+// errContainerGone is returned when the container stopped underneath us
+// and we were not asked to bring it back
+var errContainerGone = errors.New("The build container stopped during the watch, set restart-container to restart it automatically")
+
+// errWatcherClosed is what the loops report when the watcher's channels
+// close without us closing it, a closed channel would otherwise spin them
+var errWatcherClosed = errors.New("The file watcher stopped, changes are no longer seen")
+
+// errNotDockerTransport is returned when the session doesn't talk to a
+// docker container, we need the container for everything but the commands
+var errNotDockerTransport = errors.New("watch step requires the docker transport")
+
+// isContainerGone checks whether an error means our container was removed
+// or is no longer running
+func isContainerGone(err error) bool {
+	switch e := err.(type) {
+	case *docker.NoSuchContainer, *docker.ContainerNotRunning:
+		return true
+	case *docker.Error:
+		// exec against a stopped container is a conflict
+		return e.Status == http.StatusConflict
+	}
+	return false
+}
+
+// recoverContainer handles our container going away, when restart-container
+// is set it starts the container again and attaches the session to it,
+// returning the new session context.
+func (s *WatchStep) recoverContainer(e *core.NormalizedEmitter, sess *core.Session, containerID string) (context.Context, error) {
+	if !s.config.RestartContainer {
+		return nil, errContainerGone
+	}
+	client, err := s.dockerClient()
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Warnln("The build container stopped, restarting it")
+	if err := client.StartContainer(containerID, nil); err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			return nil, fmt.Errorf("The build container %s was removed and cannot be restarted", containerID)
+		}
+		return nil, err
+	}
+	s.logger.Warnln("Environment exported by earlier steps is not restored in the restarted container")
+	return sess.Attach(core.WithEmitter(context.Background(), e))
+}
+
+// reloadQueue runs builds one at a time. A build requested while another is
+// in flight is remembered and run when that one finishes, however many
+// requests came in meanwhile.
+type reloadQueue struct {
+	mutex     sync.Mutex
+	running   bool
+	pending   bool
+	requested chan struct{}
+	build     func()
+}
+
+func newReloadQueue(build func()) *reloadQueue {
+	return &reloadQueue{build: build, requested: make(chan struct{}, 1)}
+}
+
+// Request a build, it runs in the background
+func (q *reloadQueue) Request() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.running {
+		q.pending = true
+		select {
+		case q.requested <- struct{}{}:
+		default:
+		}
+		return
+	}
+	q.running = true
+	go q.run()
+}
+
+// Requested is told when a build is requested while one is in flight, a
+// build waiting on something can stop and let the next one run
+func (q *reloadQueue) Requested() <-chan struct{} {
+	return q.requested
+}
+
+func (q *reloadQueue) run() {
+	for {
+		q.build()
+		q.mutex.Lock()
+		if !q.pending {
+			q.running = false
+			q.mutex.Unlock()
+			return
+		}
+		q.pending = false
+		select {
+		case <-q.requested:
+		default:
+		}
+		q.mutex.Unlock()
+	}
+}
+
+// reloadBackoff is how long to wait before the next reload after failures
+// in a row: base doubled for every failure after the first, capped at max,
+// then jittered to somewhere in its upper half so a stream of saves doesn't
+// line up with it. rnd is rand.Int63n outside of tests.
+func reloadBackoff(failures int, base, max time.Duration, rnd func(int64) int64) time.Duration {
+	if failures == 0 || base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rnd(int64(delay-half)+1))
+}
+
+const (
+	// watchDebounce is the longest changes are collected before we reload,
+	// a stream of them never holds a reload up for longer
+	watchDebounce = 2 * time.Second
+	// watchSettle is how quiet the files have to be for a reload to start
+	// before watchDebounce is up
+	watchSettle = 300 * time.Millisecond
+	// stopSignal is what the running processes get before a reload unless
+	// signal or kill-sequence say otherwise
+	stopSignal = "INT"
+	// stoppedExitTimeout is how long a reload waits for the run it stopped
+	// to report its exit, the shell only gets to the new run after that
+	stoppedExitTimeout = 5 * time.Second
+)
+
+// newDebouncer decides when changes reload. Leading reloads on the first
+// change and holds the rest for watchDebounce, trailing waits for them to
+// settle first.
+func (s *WatchStep) newDebouncer() *util.Debouncer {
+	if s.config.DebounceMode == debounceTrailing {
+		return util.NewCoalescingDebouncer(watchSettle, watchDebounce, s.clock)
+	}
+	return util.NewThrottler(watchDebounce, s.clock)
+}
+
+// configSummary describes the settings this step ended up with, shell is
+// whatever the container runs our commands in
+func (s *WatchStep) configSummary(shell string) *core.WatchConfiguredArgs {
+	root := s.watchRoot()
+	includes := len(s.config.Extensions)
+	for _, group := range s.config.Groups {
+		includes += len(group.Paths)
+	}
+	return &core.WatchConfiguredArgs{
+		Reload:   s.config.Reload,
+		Debounce: watchDebounce,
+		Root:     root,
+		Includes: includes,
+		Excludes: len(s.watchFilters(root)),
+		Signal:   s.config.KillSequence[0].Signal,
+		Shell:    shell,
+	}
+}
+
+// formatConfigSummary is the one line version of configSummary for the logs
+func formatConfigSummary(c *core.WatchConfiguredArgs) string {
+	return fmt.Sprintf("reload=%t debounce=%s root=%s includes=%d excludes=%d signal=SIG%s shell=%s",
+		c.Reload, c.Debounce, c.Root, c.Includes, c.Excludes, c.Signal, c.Shell)
+}
+
+// containerShell is the command the container was started with, our
+// commands are sent to its stdin
+func containerShell(client watchClient, containerID string) string {
+	container, err := client.InspectContainer(containerID)
+	if err != nil || container.Config == nil {
+		return "unknown"
+	}
+	return strings.Join(container.Config.Cmd, " ")
+}
+
+// watchStop is a reason for the watch loop not to act on a reload
+type watchStop int
+
+const (
+	watchContinue watchStop = iota
+	watchFinished
+	watchSessionDone
+)
+
+// pendingStop checks, without blocking, whether we were asked to finish or
+// lost our session. select picks randomly between ready cases, so the loop
+// asks this before acting on a debounce fire, that way Ctrl-C in the middle
+// of a burst of changes doesn't sneak in one last reload.
+func pendingStop(ctx context.Context, finishedStep <-chan struct{}) watchStop {
+	select {
+	case <-finishedStep:
+		return watchFinished
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return watchSessionDone
+	default:
+	}
+	return watchContinue
+}
+
+// lockFilePollInterval is how often we look for the lock file to go away
+const lockFilePollInterval = 500 * time.Millisecond
+
+// lockFile is the absolute path of lock-file, empty if it isn't set.
+//
+// The contract with external tools is just the file's existence: create it
+// before touching anything and remove it when done, a codegen run or a
+// migration for example. Reloads due while it exists are held back and
+// after it's gone the changes from the whole run are reloaded once. The
+// first build doesn't wait. Relative paths are relative to the project.
+func (s *WatchStep) lockFile() string {
+	if s.config.LockFile == "" || filepath.IsAbs(s.config.LockFile) {
+		return s.config.LockFile
+	}
+	return filepath.Join(s.options.ProjectPath, s.config.LockFile)
+}
+
+// locked says whether an external tool is holding the lock file
+func (s *WatchStep) locked() bool {
+	path := s.lockFile()
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// pausable says whether SIGUSR2 pauses the watch, it doesn't when
+// forward-signals passes it on to the code instead
+func (s *WatchStep) pausable() bool {
+	for _, name := range s.config.ForwardSignals {
+		if name == "USR2" {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForRemoval closes the returned channel once path no longer exists,
+// checking every interval on clock until stop is closed
+func waitForRemoval(clock util.Clock, path string, interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	removed := make(chan struct{})
+	go func() {
+		for {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				close(removed)
+				return
+			}
+			select {
+			case <-clock.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return removed
+}
+
+// Execute runs a command and optionally reloads it
+func (s *WatchStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := s.Validate(); err != nil {
+		return -1, err
+	}
+
+	f := &util.Formatter{ShowColors: s.options.GlobalOptions.ShowColors, Timestamps: s.options.GlobalOptions.LogTimestamps}
+
+	// Only report what would be watched, don't run anything
+	if s.config.ExplainExcludes {
+		if err := s.reportExcludes(s.watchRoot(), f); err != nil {
+			return -1, err
+		}
+		return 0, nil
+	}
+
+	// Only say what would run, see dryRunLog
+	if s.config.DryRun {
+		s.dryRun = &dryRunLog{logger: s.logger, f: f}
+	}
+
+	// cheating to get containerID
+	// TODO(termie): we should deal with this eventually
+	dt, ok := sess.Transport().(containerTransport)
+	if !ok {
+		return -1, errNotDockerTransport
+	}
+	client, err := s.dockerClient()
+	if err != nil {
+		return -1, err
+	}
+
+	// Optionally keep a copy of the output on disk, this is deferred before
+	// the stdout pump is stopped so we only close once it stops writing
+	var logFile *os.File
+	if s.config.LogFile != "" {
+		logFile, err = s.openLogFile()
+		if err != nil {
+			return -1, err
+		}
+		defer func() {
+			logFile.Sync()
+			logFile.Close()
+		}()
+	}
+
+	// TODO(termie): PACKAGING make this a feature of session and remove
+	//               the calls into its struct
+	// Emit output from its own goroutine so a slow consumer doesn't stop us
+	// reading from the container
+	logs := newLogBuffer(maxBufferedLogs)
+	exited := make(chan commandExit, 1)
+	stopEmitting := make(chan struct{})
+	emitterDone := make(chan struct{})
+	go func() {
+		logs.run(func(line string) {
+			e.Emit(core.Logs, &core.LogsArgs{
+				// Hidden: sess.logsHidden,
+				Logs: line,
+			})
+		}, stopEmitting)
+		close(emitterDone)
+	}()
+	defer func() {
+		close(stopEmitting)
+		<-emitterDone
+	}()
+
+	// Every run of the code ends in a WatchReloadComplete event, with
+	// group-logs its output also goes between a header and a footer
+	cycles := &logCycles{completed: func(args *core.WatchReloadCompleteArgs) {
+		e.Emit(core.WatchReloadComplete, args)
+		s.events.publish(reloadCompleteEvent(args))
+	}}
+	beginCycle := func(reload int, files []string) {
+		lines := cycles.begin(reload, files, s.clock.Now())
+		if !s.config.GroupLogs {
+			return
+		}
+		for _, line := range lines {
+			logs.push(f.Info(line) + "\n")
+		}
+	}
+	defer func() {
+		if footer := cycles.end(s.clock.Now()); s.config.GroupLogs && footer != "" {
+			logs.push(f.Info(footer) + "\n")
+		}
+	}()
+
+	// Every exit the sentinel reports, ones of runs we stopped too
+	exits := newRunExits()
+
+	// Let people know a reload is still going until it says something
+	progress := newProgressIndicator(os.Stderr, f.IsTerminal())
+	s.progress = progress
+	defer progress.Stop()
+
+	containerID := dt.ContainerID()
+
+	// What the code prints when it runs on a terminal of its own
+	ttyLines := make(chan string, 100)
+	ttyDone := make(chan struct{})
+	defer close(ttyDone)
+
+	// Start watching our stdout, this is restarted if the session is attached
+	// to a restarted container
+	listen := func() chan struct{} {
+		stop := make(chan struct{})
+		recv := sess.Recv()
+		go func() {
+			for {
+				var line string
+				select {
+				case line = <-recv:
+				case line = <-ttyLines:
+				// We need to make sure we stop eating the stdout from the container
+				// promiscuously when we finish out step
+				case <-stop:
+					return
+				}
+				line, starts := s.parseTTYStarts(line)
+				for _, reload := range starts {
+					go s.runTTY(client, containerID, reload, ttyLines, ttyDone)
+				}
+				line, setup := s.parseSetupDone(line)
+				if setup {
+					s.status.finishSetup()
+				}
+				line, parsed := s.parseCommandExits(line)
+				if line != "" {
+					progress.Stop()
+				}
+				for _, exit := range parsed {
+					// A run we stopped can exit after the next one started,
+					// that one is still going
+					if s.status.current(exit.reload) {
+						progress.Stop()
+					}
+					s.status.finishReload(exit.reload)
+					cycles.exited(exit.reload, exit.code, s.clock.Now())
+					// Builds wait on this, the run is complete by now
+					exits.exited(exit.reload, exit.code)
+					if !s.status.exited(exit.reload, exit.code) {
+						continue
+					}
+					if !s.actsOnExit() {
+						if s.config.Reload {
+							s.logger.Info(f.Info(fmt.Sprintf("Command exited with %d, waiting for changes", exit.code)))
+						} else {
+							s.logger.Info(f.Info(fmt.Sprintf("Command exited with %d, the step finishes with it on Ctrl-C", exit.code)))
+						}
+						continue
+					}
+					select {
+					case exited <- exit:
+					default:
+					}
+				}
+				if shown := s.filterOutput(line); shown != "" {
+					logs.push(f.Prefix(shown))
+				}
+				if logFile != nil {
+					logFile.WriteString(line)
+				}
+			}
+		}()
+		return stop
+	}
+	stopListening := listen()
+	defer func() {
+		if stopListening != nil {
+			stopListening <- struct{}{}
+		}
+	}()
+
+	// Say what we're about to do so it can be pasted into a bug report
+	summary := s.configSummary(containerShell(client, containerID))
+	s.logger.Info(f.Info("Watch config", formatConfigSummary(summary)))
+	e.Emit(core.WatchConfigured, summary)
+
+	if err := s.checkUser(containerID); err != nil {
+		return -1, err
+	}
+
+	// Set up a signal handler to end our step, buffered so the handler
+	// doesn't wait on a loop that's busy reloading
+	finishedStep := make(chan struct{}, 1)
+	stopWatchHandler := s.stopWatchHandler(finishedStep)
+	util.GlobalSigint().Add(stopWatchHandler)
+	defer util.GlobalSigint().Remove(stopWatchHandler)
+
+	// Reading stdin can't be interrupted, the forwarding goroutine notices
+	// it should stop on the next line it reads
+	if s.config.Interactive && !s.config.DryRun {
+		s.logger.Info(f.Info("Passing what you type on to the code, Ctrl-C still finishes the step"))
+		stopInput := make(chan struct{})
+		defer close(stopInput)
+		go s.forwardInput(os.Stdin, func(line string) error {
+			return sess.Send(ctx, true, line)
+		}, stopInput)
+	}
+
+	// If we're not going to reload just run the thing once, synchronously
+	if !s.config.Reload {
+		for {
+			reload := s.status.startReload()
+			beginCycle(reload, nil)
+			s.status.sent()
+			if s.config.DryRun {
+				s.dryRunCommand(reload, nil)
+			} else {
+				line := s.withExit(reload, s.setupCommand(reload, s.command()))
+				if s.config.TTY {
+					line = s.ttyCommand(reload, s.command())
+				}
+				err := sess.Send(ctx, false, "set +e", line)
+				if err != nil {
+					cycles.failed(reload, err)
+					return 0, err
+				}
+			}
+			select {
+			case <-finishedStep:
+			case <-ctx.Done():
+				return -1, errContainerGone
+			case exit := <-exited:
+				if exit.code != 0 {
+					s.checkOOMKills(containerID)
+				}
+				if s.config.OnExit == onExitFinish {
+					s.logger.Info(f.Info(fmt.Sprintf("Command exited with %d, finishing step", exit.code)))
+					return exit.code, nil
+				}
+				s.logger.Info(f.Info(fmt.Sprintf("Command exited with %d, running it again", exit.code)))
+				continue
+			}
+			// ignoring errors
+			s.stopProcesses(containerID)
+			// A run that already ended decides how the step went
+			code, _ := s.status.exitCode()
+			return code, nil
+		}
+	}
+	s.logger.Info(f.Info("Reloading on file changes"))
+	if s.config.Interval > 0 {
+		s.logger.Info(f.Info("Also reloading every", s.config.Interval.String()))
+	}
+	if s.config.TmuxSession != "" {
+		s.logger.Info(f.Info(fmt.Sprintf("Running in tmux, attach with: docker exec -it %s tmux attach -t %s", containerID, s.config.TmuxSession)))
+	}
+	// Each reload's profiles are collected once the next one has stopped it
+	if s.config.Profile != "" && !s.config.DryRun {
+		s.artifacts = s.newProfileCollector(containerID)
+	}
+	// Ports published on a remote docker host are relayed to localhost, for
+	// each run of the code
+	forwards := newPortForwarder(s.logger)
+	defer forwards.stop()
+	doCmd := func(ctx context.Context, files ...string) (reload int, err error) {
+		forwards.stop()
+		reload = s.status.startReload()
+		if s.artifacts != nil && reload > 1 {
+			s.artifacts.queue(reload - 1)
+		}
+		finished := s.announceReload(e, reload, files)
+		// Nothing runs, so the reload is over as soon as it's said
+		if s.config.DryRun {
+			s.dryRunCommand(reload, files)
+			s.status.finishReload(reload)
+			finished(nil, nil)
+			return reload, nil
+		}
+		if s.config.Progress {
+			progress.Start()
+		}
+		s.checkOOMKills(containerID)
+		if err := s.applyLimits(containerID); err != nil {
+			s.logger.Warnln(f.Fail("Unable to apply the memory and cpu limits"), err)
+		}
+		if err := s.waitForPorts(containerID); err != nil {
+			s.logger.Warnln(f.Info("Not waiting for ports any longer:"), err)
+		}
+		beginCycle(reload, files)
+		s.status.sent()
+		err = sess.Send(ctx, false, s.reloadCommands(reload, files...)...)
+		if err != nil {
+			s.status.finishReload(reload)
+			cycles.failed(reload, err)
+			finished(err, nil)
+			s.logger.Errorln(err)
+			return reload, err
+		}
+		// The reload lasts until the exit line. A tmux pane respawned for
+		// the next reload never reports one, so there it ends here.
+		if s.config.TmuxSession != "" {
+			s.status.finishReload(reload)
+			finished(nil, nil)
+			s.runHostCommand()
+		} else {
+			exits.onExit(reload, func(code int) {
+				finished(nil, &code)
+				// Only a reload that went through, not one we stopped
+				if code == 0 && s.status.current(reload) {
+					s.runHostCommand()
+				}
+			})
+		}
+		// The command is running already, not knowing the forwards is no
+		// reason to call the reload a failure
+		open, portErr := exposedPortMaps(s.dockerOptions.Host, s.options.PublishPorts)
+		if portErr != nil {
+			s.logger.Warnln(f.Info("There was a problem parsing your docker host, not listing forwarded ports:"), portErr)
+			return reload, nil
+		}
+		for _, uri := range open {
+			if isLocalHostURI(uri.HostURI) {
+				s.logger.Infof(f.Info("Forwarding %s to %s on the container."), uri.HostURI, uri.ContainerPort)
+				continue
+			}
+			_, port, _ := net.SplitHostPort(uri.HostURI)
+			local, forwardErr := forwards.forward(net.JoinHostPort("127.0.0.1", port), uri.HostURI)
+			if forwardErr != nil {
+				s.logger.Warnln(f.Info(fmt.Sprintf("Unable to forward localhost:%s, %s still reaches %s on the container:", port, uri.HostURI, uri.ContainerPort)), forwardErr)
+				continue
+			}
+			s.logger.Infof(f.Info("Forwarding %s to %s on the container, through %s."), local, uri.ContainerPort, uri.HostURI)
+		}
+		return reload, nil
+	}
+	defer s.stopHostCommand()
+
+	// Otherwise set up a watcher and do some magic
+	root := s.watchRoot()
+	if m, ok := unreliableWatchMount(root); ok {
+		s.logger.Warnln(f.Fail("Watching a path on a", m.FSType, "mount"))
+		s.logger.Warnf("%s is mounted from %s, file system events for changes made outside of this machine often do not arrive and reloads may never trigger. Set poll: true to look for changes without them", root, m.MountPoint)
+	}
+	watcher, err := s.watch(root)
+	if err != nil {
+		return -1, err
+	}
+	defer watcher.Close()
+	if s.config.DryRun {
+		s.status.mutex.Lock()
+		watched := s.status.watchedDirs
+		s.status.mutex.Unlock()
+		s.dryRun.say(fmt.Sprintf("watching %d directories under %s, nothing runs in the container", watched, root))
+	}
+
+	// Groups have their own loop with a debouncer per group
+	if len(s.config.Groups) > 0 {
+		return s.executeGroups(ctx, sess, watcher, finishedStep, containerID, f)
+	}
+
+	// Set up a signal handler to dump our state without stopping anything,
+	// the signal monkey removes handlers as it calls them so the loop below
+	// puts it back every time it is used.
+	dumpStatus := make(chan struct{})
+	statusHandler := &util.SignalHandler{
+		ID: "status-watch",
+		F: func() bool {
+			select {
+			case dumpStatus <- struct{}{}:
+			default:
+			}
+			return false
+		},
+	}
+	util.GlobalSigusr1().Add(statusHandler)
+	defer util.GlobalSigusr1().Remove(statusHandler)
+
+	// SIGUSR2 pauses reloads and resumes them, changes made while paused
+	// are kept and reloaded in one go on resume. Like the status handler
+	// it has to be put back after every use. Forwarding USR2 turns this off.
+	togglePause := make(chan struct{})
+	pauseHandler := &util.SignalHandler{
+		ID: "pause-watch",
+		F: func() bool {
+			select {
+			case togglePause <- struct{}{}:
+			default:
+			}
+			return false
+		},
+	}
+	if s.pausable() {
+		util.GlobalSigusr2().Add(pauseHandler)
+		defer util.GlobalSigusr2().Remove(pauseHandler)
+	}
+
+	// Let external tools ask for reloads too
+	externalTrigger := make(chan struct{}, 1)
+	if s.config.TriggerPort != 0 {
+		listener, err := s.startTriggerServer(externalTrigger)
+		if err != nil {
+			return -1, err
+		}
+		defer listener.Close()
+		s.logger.Info(f.Info("Listening for reload webhooks on", listener.Addr().String()))
+	}
+
+	// Tell editors what we're up to
+	if s.config.EventSocket != "" {
+		sock, err := listenEventSocket(s.config.EventSocket)
+		if err != nil {
+			return -1, err
+		}
+		defer sock.Close()
+		s.events = sock
+		s.logger.Info(f.Info("Writing events to", s.config.EventSocket))
+	}
+
+	// While git or the remote host decide what counts as a change the
+	// watcher's events are ignored, if they give up we go back to them. Only
+	// one of them runs, Validate doesn't allow both.
+	remote := false
+	remoteStopped := make(chan struct{}, 1)
+
+	// Optionally let git tell us when things changed
+	gitTrigger := make(chan []fsnotify.Event)
+	if s.config.GitTrigger {
+		remote = true
+		stopGit := make(chan struct{})
+		defer close(stopGit)
+		go func() {
+			s.watchGit(s.options.ProjectPath, gitTrigger, stopGit)
+			remoteStopped <- struct{}{}
+		}()
+	}
+
+	// Or, experimentally, a remote host over ssh
+	sshTrigger := make(chan []fsnotify.Event)
+	if s.config.SSHHost != "" {
+		if s.options.AllowHostCommands {
+			s.logger.Info(f.Info("Watching remote path (experimental)", s.config.SSHHost+":"+s.config.SSHPath))
+			remote = true
+			stopSSH := make(chan struct{})
+			defer close(stopSSH)
+			go func() {
+				s.watchSSH(sshTrigger, stopSSH)
+				remoteStopped <- struct{}{}
+			}()
+		} else {
+			s.logger.Warnln("Ignoring ssh-host, run with --allow-host-commands to enable it")
+		}
+	}
+
+	// Pass the configured host signals on to the container without
+	// reloading anything
+	forwarded := make(chan os.Signal, 1)
+	signalNames := map[os.Signal]string{}
+	for _, name := range s.config.ForwardSignals {
+		sig := forwardableSignals[name]
+		signalNames[sig] = name
+		signal.Notify(forwarded, sig)
+	}
+	defer signal.Stop(forwarded)
+
+	debounce := s.newDebouncer()
+	defer debounce.Stop()
+	done := make(chan struct{})
+	changes := newChangeSet()
+	// Why the loop ended if it wasn't the step finishing, the container
+	// going away or the watcher failing
+	var loopErr error
+
+	// ctx is replaced when the container is restarted, builds run outside
+	// the loop so they get it through currentCtx
+	var ctxMutex sync.Mutex
+	currentCtx := func() context.Context {
+		ctxMutex.Lock()
+		defer ctxMutex.Unlock()
+		return ctx
+	}
+	// recoverOrFinish brings the container back if we can, otherwise it
+	// records why we are stopping and ends the loop
+	recoverOrFinish := func() bool {
+		stopListening <- struct{}{}
+		newCtx, err := s.recoverContainer(e, sess, containerID)
+		if err != nil {
+			s.logger.Errorln(f.Fail("Container gone"), err)
+			loopErr = err
+			stopListening = nil
+			done <- struct{}{}
+			return false
+		}
+		ctxMutex.Lock()
+		ctx = newCtx
+		ctxMutex.Unlock()
+		stopListening = listen()
+		return true
+	}
+	finish := func() {
+		s.status.supersede()
+		s.stopProcesses(containerID)
+		done <- struct{}{}
+	}
+	// Set by on-exit finish before it finishes the step
+	exitCode := 0
+
+	// Builds run one at a time, changes during a build queue up a single
+	// follow-up build
+	containerLost := make(chan struct{}, 1)
+	initial := true
+	failures := 0
+	loopDone := make(chan struct{})
+	// The last run a build started, 0 before the first one
+	lastRun := 0
+	var builds *reloadQueue
+	// The first build gets a few extra chances in case something from a
+	// previous run is still hanging around, later reloads are not retried.
+	// Code that exits non-zero before anything else happens failed to start
+	// as well, code that keeps running started fine.
+	doInitialCmd := func(ctx context.Context) (int, error) {
+		for attempt := 1; ; attempt++ {
+			reload, err := doCmd(ctx)
+			if err == nil && attempt <= s.config.InitialRetries && s.waitsForExit() {
+				select {
+				case <-exits.wait(reload):
+				case <-builds.Requested():
+					return reload, nil
+				case <-loopDone:
+					return reload, nil
+				}
+				if code, _ := exits.code(reload); code != 0 {
+					err = fmt.Errorf("the code exited with %d", code)
+				}
+			}
+			if err == nil || attempt > s.config.InitialRetries {
+				return reload, err
+			}
+			s.logger.Warnf(f.Info("Initial build failed, retrying in %s (attempt %d of %d)"), s.config.InitialRetryDelay, attempt, s.config.InitialRetries)
+			select {
+			case <-s.clock.After(s.config.InitialRetryDelay):
+			case <-loopDone:
+				return reload, err
+			}
+		}
+	}
+	builds = newReloadQueue(func() {
+		// Broken code fails every reload, don't hammer away at it
+		if delay := reloadBackoff(failures, s.config.ReloadBackoff, s.config.ReloadBackoffMax, rand.Int63n); delay > 0 {
+			s.logger.Info(f.Info("Backing off", fmt.Sprintf("%d failed reloads in a row, next one in %s", failures, delay)))
+			select {
+			case <-s.clock.After(delay):
+			case <-loopDone:
+				return
+			}
+		}
+		// The changes so far are this build's, ones made while it waits on
+		// the previous run add up to a single follow-up build
+		files := s.reloadFiles.take()
+		copied := s.copyFiles.take()
+		// With tmux the session replaces its own process, killing
+		// everything would take the tmux server down with it
+		if s.config.TmuxSession == "" {
+			s.status.supersede()
+			if err := s.stopProcesses(containerID); err != nil {
+				if isContainerGone(err) {
+					select {
+					case containerLost <- struct{}{}:
+					default:
+					}
+				} else {
+					s.logger.Errorln(f.Fail("Unable to stop the previous build"), err)
+				}
+				return
+			}
+			// Only one run at a time, the next one starts once the shell
+			// says the stopped one is done
+			if lastRun > 0 {
+				select {
+				case <-exits.wait(lastRun):
+				case <-s.clock.After(stoppedExitTimeout):
+					s.logger.Warnln(f.Fail("The previous run didn't exit"), "reloading anyway, the code runs once it does")
+				case <-loopDone:
+					return
+				}
+			}
+		}
+		ctx := currentCtx()
+		// Hash before building, changes made during the build are for
+		// the next one
+		hash := ""
+		if s.config.SkipUnchangedInitial {
+			var err error
+			if hash, err = s.treeHash(root); err != nil {
+				s.logger.Debugln("Unable to hash the watched files:", err)
+			}
+		}
+		var reload int
+		var err error
+		if initial {
+			initial = false
+			if hash != "" && s.unchangedSinceLastBuild(root, hash, containerID) {
+				s.logger.Info(f.Info("Nothing changed since the last successful build, skipping the initial build"))
+				return
+			}
+			reload, err = doInitialCmd(ctx)
+		} else {
+			if err := s.copyChanges(containerID, copied); err != nil {
+				s.logger.Warnln(f.Fail("Unable to copy the changes into the container"), err)
+			}
+			reload, err = doCmd(ctx, files...)
+		}
+		// The build lasts until its run ends, a change coming in meanwhile
+		// lets the next build stop it, see waitsForExit for the ones that
+		// don't wait.
+		if err == nil && s.waitsForExit() {
+			lastRun = reload
+			select {
+			case <-exits.wait(reload):
+			case <-builds.Requested():
+			case <-loopDone:
+			}
+		}
+		// Code exiting non-zero while its build waits on it failed too, a
+		// run the next change has to stop didn't
+		code, exited := exits.code(reload)
+		if err != nil || exited && code != 0 {
+			failures++
+		} else {
+			failures = 0
+		}
+		// The limits cover the whole container, an OOM kill of anything in
+		// it may be what the code exited with
+		if exited && code != 0 {
+			s.checkOOMKills(containerID)
+		}
+		// Only code that ran to the end and exited 0 counts as a successful
+		// build, a run that's still going may yet fail
+		if hash != "" && err == nil && exited && code == 0 {
+			if err := s.recordBuild(root, hash, containerID); err != nil {
+				s.logger.Debugln("Unable to record the build:", err)
+			}
+		}
+		// The reload may have brought in new dependencies, they're there
+		// once its code is done. A run the next build stops leaves that to
+		// the next build.
+		if s.commandWatch != nil && (exited || s.config.TmuxSession != "") {
+			if err := s.watchFromCommand(watcher); err != nil {
+				s.logger.Warnln("watch-from-command failed, keeping the previous paths:", err)
+			}
+		}
+	})
+
+	go func() {
+		first := true
+		paused := false
+		skipped := false
+		// Set while we wait for an external tool to drop lock-file
+		var unlocked <-chan struct{}
+		// Set while max-reloads-per-minute holds reloads back
+		var unlimited <-chan time.Time
+		defer close(loopDone)
+		schedule := newReloadSchedule(s.clock, s.config.Interval)
+		defer schedule.stop()
+		s.markReady()
+		for {
+			select {
+			case <-unlocked:
+				unlocked = nil
+				s.logger.Info(f.Info("Lock file removed", s.config.LockFile))
+				if skipped {
+					skipped = false
+					debounce.Trigger()
+				}
+			case <-unlimited:
+				unlimited = nil
+				s.logger.Info(f.Info("Resuming reloads"))
+				if skipped {
+					skipped = false
+					debounce.Trigger()
+				}
+			case <-dumpStatus:
+				s.status.dump(s.logger, f)
+				util.GlobalSigusr1().Add(statusHandler)
+			case <-togglePause:
+				paused = !paused
+				util.GlobalSigusr2().Add(pauseHandler)
+				if paused {
+					s.logger.Info(f.Info("Paused, changes won't reload until the next SIGUSR2"))
+					continue
+				}
+				s.logger.Info(f.Info("Resumed"))
+				if skipped {
+					skipped = false
+					debounce.Trigger()
+				}
+			case event, ok := <-watcher.Events():
+				if !ok {
+					s.logger.Error(errWatcherClosed)
+					s.events.publish(socketEvent{Type: socketError, Error: errWatcherClosed.Error()})
+					loopErr = errWatcherClosed
+					done <- struct{}{}
+					return
+				}
+				s.logger.Debugln("fsnotify event", event.String())
+				if remote {
+					// git or the remote host decide what counts as a change
+					continue
+				}
+				if s.isIgnoreFile(root, event.Name) {
+					s.dryRun.event(event, s.options.ProjectPath, "walking the project again for the new ignore rules")
+					go func() {
+						if err := s.rewatch(watcher, root); err != nil {
+							s.logger.Warnln("Unable to apply the changed ignore rules:", err)
+						}
+					}()
+					continue
+				}
+				s.followDirs(watcher, root, event)
+				if s.reloadDecider().ShouldReload(event, changes.paths) {
+					s.logger.Debug(f.Info("Modified file", event.Name))
+					s.status.trigger(event.Name)
+					changes.add(event)
+					debounce.Trigger()
+					s.dryRun.event(event, s.options.ProjectPath, "reload pending")
+				} else {
+					s.dryRun.event(event, s.options.ProjectPath, "ignored")
+				}
+			case events := <-gitTrigger:
+				for _, event := range events {
+					s.logger.Debug(f.Info("Changed in git", event.Name))
+					s.status.trigger(event.Name)
+					changes.add(event)
+				}
+				debounce.Trigger()
+			case events := <-sshTrigger:
+				for _, event := range events {
+					s.logger.Debug(f.Info("Changed on remote", event.Name))
+					s.status.trigger(event.Name)
+					changes.add(event)
+				}
+				debounce.Trigger()
+			case <-remoteStopped:
+				remote = false
+				s.logger.Warnln("Reloading on the watched files' changes instead")
+			case <-schedule.C():
+				s.logger.Debug(f.Info("Scheduled reload"))
+				s.status.trigger("(interval)")
+				debounce.Trigger()
+				schedule.restart()
+			case <-externalTrigger:
+				s.logger.Debug(f.Info("Reload requested by webhook"))
+				s.status.trigger("(webhook)")
+				debounce.Trigger()
+			case <-debounce.C:
+				s.status.settle()
+				switch pendingStop(ctx, finishedStep) {
+				case watchFinished:
+					finish()
+					return
+				case watchSessionDone:
+					if !recoverOrFinish() {
+						return
+					}
+				}
+				if paused && !first {
+					// Keep the changes for when we resume
+					skipped = true
+					continue
+				}
+				if !first && s.locked() {
+					// Keep the changes until the lock is gone
+					skipped = true
+					if unlocked == nil {
+						s.logger.Info(f.Info("Waiting for lock file", s.config.LockFile))
+						unlocked = waitForRemoval(s.clock, s.lockFile(), lockFilePollInterval, loopDone)
+					}
+					continue
+				}
+				files := s.projectRelative(changes.present())
+				if !first {
+					if wait, ok := s.limiter.allow(s.clock.Now(), files); !ok {
+						// Keep the changes until the window has room again
+						skipped = true
+						if unlimited == nil {
+							s.logger.Warnln(f.Fail("Too many reloads"), s.reloadLimitMessage(wait, s.limiter.busiest(files)))
+							unlimited = s.clock.After(wait)
+						}
+						continue
+					}
+				}
+				if first {
+					first = false
+				} else {
+					// Cleared before anything about the reload is said
+					if clear := f.ClearScreen(); s.config.Clear && clear != "" {
+						e.Emit(core.Logs, &core.LogsArgs{Logs: clear})
+					}
+					// files leaves out the deleted ones, the message doesn't
+					s.logger.Info(f.Info(reloadMessage(s.projectRelative(changes.paths))))
+					s.events.publish(socketEvent{Type: socketChanged, Files: changes.paths})
+					if s.config.ShowChanges {
+						for _, line := range changes.lines(maxShownChanges) {
+							s.logger.Info(f.Info("  " + line))
+						}
+					}
+				}
+				s.reloadFiles.add(files)
+				if len(s.config.Snapshot) > 0 {
+					// Deleted files too, they go from the container's copy
+					s.copyFiles.add(s.projectRelative(changes.paths))
+				}
+				changes = newChangeSet()
+				schedule.restart()
+				builds.Request()
+			case sig := <-forwarded:
+				s.logger.Info(f.Info("Forwarding signal", "SIG"+signalNames[sig]))
+				go func(name string) {
+					if err := s.killProcesses(containerID, name); err != nil {
+						s.logger.Errorln(f.Fail("Unable to forward signal"), err)
+					}
+				}(signalNames[sig])
+			case exit := <-exited:
+				switch s.config.OnExit {
+				case onExitFinish:
+					s.logger.Info(f.Info(fmt.Sprintf("Command exited with %d, finishing step", exit.code)))
+					exitCode = exit.code
+					finish()
+					return
+				case onExitReload:
+					s.logger.Info(f.Info(fmt.Sprintf("Command exited with %d, reloading", exit.code)))
+					builds.Request()
+				}
+			case <-containerLost:
+				if !recoverOrFinish() {
+					return
+				}
+				debounce.Trigger()
+			case <-ctx.Done():
+				// The transport closes the session context when the container
+				// exits
+				if !recoverOrFinish() {
+					return
+				}
+				debounce.Trigger()
+			case err, ok := <-watcher.Errors():
+				if !ok {
+					err = errWatcherClosed
+				}
+				s.logger.Error(err)
+				s.events.publish(socketEvent{Type: socketError, Error: err.Error()})
+				loopErr = err
+				done <- struct{}{}
+				return
+			case <-finishedStep:
+				finish()
+				return
+			}
+		}
+	}()
+
+	// Give the container a moment to settle before we first exec into it,
+	// then run build on first run
+	if s.config.Warmup > 0 {
+		s.logger.Debugln("Warming up for", s.config.Warmup)
+	}
+	select {
+	case <-s.clock.After(s.config.Warmup):
+		debounce.Trigger()
+		<-done
+	case <-done:
+	}
+	if loopErr != nil {
+		return -1, loopErr
+	}
+	return exitCode, nil
+}
+
+// CollectFile NOP
+func (s *WatchStep) CollectFile(a, b, c string, dst io.Writer) error {
+	return nil
+}
+
+// CollectArtifact gathers the profiles written by each reload when profile
+// is set, otherwise there is nothing to collect. The reloads collected
+// during the step are under reloads/ on the host, this gets the rest.
+func (s *WatchStep) CollectArtifact(containerID string) (*core.Artifact, error) {
+	if s.config.Profile == "" || s.config.DryRun {
+		return nil, nil
+	}
+	// Reloads collected along the way are already on the host
+	if s.artifacts != nil {
+		s.artifacts.wait()
+	}
+	artificer := NewArtificer(s.options, s.dockerOptions)
+
+	artifact := &core.Artifact{
+		ContainerID:   containerID,
+		GuestPath:     s.profilePath(),
+		HostTarPath:   s.options.HostPath(s.SafeID(), "profiles.tar"),
+		HostPath:      s.options.HostPath(s.SafeID(), "profiles"),
+		ApplicationID: s.options.ApplicationID,
+		RunID:         s.options.RunID,
+		RunStepID:     s.SafeID(),
+		Bucket:        s.options.S3Bucket,
+		ContentType:   "application/x-tar",
+	}
+
+	fullArtifact, err := artificer.Collect(artifact)
+	if err != nil {
+		if err == util.ErrEmptyTarball {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fullArtifact, nil
+}
+
+// ReportPath getter
+func (s *WatchStep) ReportPath(...string) string {
+	// for now we just want something that doesn't exist
+	return s.ids.NewID()
 }
 
 // ShouldSyncEnv before running this step = FALSE
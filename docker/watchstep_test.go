@@ -0,0 +1,3700 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+type WatchStepSuite struct {
+	*util.TestSuite
+}
+
+func TestWatchStepSuite(t *testing.T) {
+	suiteTester := &WatchStepSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *WatchStepSuite) TestSkipTrigger() {
+	step := &WatchStep{
+		logger: util.RootLogger().WithField("Logger", "WatchStep"),
+		config: WatchConfig{MaxTriggerSize: 16, SkipBinary: true},
+	}
+	dir := s.WorkingDir()
+
+	small := filepath.Join(dir, "small.go")
+	large := filepath.Join(dir, "large.go")
+	binary := filepath.Join(dir, "binary")
+	s.Require().Nil(ioutil.WriteFile(small, []byte("package main\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(large, []byte("package main\n\nfunc main() {}\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(binary, []byte{0x7f, 'E', 'L', 'F', 0x00}, 0644))
+
+	s.False(step.skipTrigger(small))
+	s.True(step.skipTrigger(large), "files over max-trigger-size should be skipped")
+	s.True(step.skipTrigger(binary), "binary files should be skipped")
+	s.False(step.skipTrigger(filepath.Join(dir, "removed.go")), "removed files should still trigger")
+}
+
+func (s *WatchStepSuite) TestUnreliableMount() {
+	mountinfo := strings.NewReader(`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+35 22 0:31 / /Users rw,relatime - fuse.osxfs osxfs rw,user_id=0
+36 22 0:32 / /Users/dev/local\040copy rw,relatime - ext4 /dev/sdb1 rw
+`)
+	mounts := parseMountInfo(mountinfo)
+	s.Equal(3, len(mounts))
+
+	m, ok := mountFor(mounts, "/Users/dev/project")
+	s.True(ok)
+	s.Equal("fuse.osxfs", m.FSType)
+
+	m, ok = mountFor(mounts, "/Users/dev/local copy/project")
+	s.True(ok)
+	s.Equal("ext4", m.FSType, "the longest mount point should win")
+
+	m, ok = mountFor(mounts, "/Usersfoo")
+	s.True(ok)
+	s.Equal("/", m.MountPoint)
+}
+
+func (s *WatchStepSuite) TestParseWatchEvents() {
+	mask, err := parseWatchEvents("write, create")
+	s.Nil(err)
+	s.Equal(fsnotify.Write|fsnotify.Create, mask)
+
+	mask, err = parseWatchEvents("chmod")
+	s.Nil(err)
+	s.Equal(fsnotify.Chmod, mask)
+
+	_, err = parseWatchEvents("write,touch")
+	s.NotNil(err)
+
+	_, err = parseWatchEvents("")
+	s.NotNil(err)
+}
+
+// fakeWatchClient pretends to be a container that can disappear
+type fakeWatchClient struct {
+	gone     bool
+	removed  bool
+	execs    int
+	restarts int
+	// top is what docker top answers, without it docker top fails
+	top *docker.TopResult
+}
+
+func (c *fakeWatchClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	c.execs++
+	if c.removed {
+		return &docker.NoSuchContainer{ID: containerID}
+	}
+	if c.gone {
+		return &docker.Error{Status: http.StatusConflict, Message: "Container is not running"}
+	}
+	return nil
+}
+
+func (c *fakeWatchClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	codes := []int{}
+	for _, cmd := range cmds {
+		if err := c.ExecOne(containerID, cmd, output); err != nil {
+			return codes, err
+		}
+		codes = append(codes, 0)
+	}
+	return codes, nil
+}
+
+func (c *fakeWatchClient) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	if c.removed {
+		return &docker.NoSuchContainer{ID: id}
+	}
+	c.restarts++
+	c.gone = false
+	return nil
+}
+
+func (c *fakeWatchClient) UpdateContainer(id string, opts docker.UpdateContainerOptions) error {
+	return nil
+}
+
+func (c *fakeWatchClient) UploadToContainer(id string, opts docker.UploadToContainerOptions) error {
+	return nil
+}
+
+func (c *fakeWatchClient) InspectContainer(id string) (*docker.Container, error) {
+	return &docker.Container{ID: id, Config: &docker.Config{Cmd: []string{"/bin/sh"}}}, nil
+}
+
+func (c *fakeWatchClient) TopContainer(id string, psArgs string) (docker.TopResult, error) {
+	if c.removed {
+		return docker.TopResult{}, &docker.NoSuchContainer{ID: id}
+	}
+	if c.gone {
+		return docker.TopResult{}, &docker.Error{Status: http.StatusConflict, Message: "Container is not running"}
+	}
+	if c.top == nil {
+		return docker.TopResult{}, &docker.Error{Status: http.StatusInternalServerError, Message: "top isn't faked"}
+	}
+	return *c.top, nil
+}
+
+func (c *fakeWatchClient) ExecTTY(containerID string, cmd []string, output io.Writer) (int, error) {
+	return 0, c.ExecOne(containerID, cmd, output)
+}
+
+type fakeWatchTransport struct{}
+
+func (t *fakeWatchTransport) Attach(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (context.Context, error) {
+	return ctx, nil
+}
+
+func (s *WatchStepSuite) TestContainerGone() {
+	s.True(isContainerGone(&docker.NoSuchContainer{ID: "abc"}))
+	s.True(isContainerGone(&docker.ContainerNotRunning{ID: "abc"}))
+	s.True(isContainerGone(&docker.Error{Status: http.StatusConflict}))
+	s.False(isContainerGone(&docker.Error{Status: http.StatusInternalServerError}))
+	s.False(isContainerGone(errors.New("something else")))
+}
+
+func (s *WatchStepSuite) TestContainerDisappears() {
+	client := &fakeWatchClient{}
+	step := &WatchStep{client: client, logger: util.RootLogger().WithField("Logger", "Test")}
+	sess := core.NewSession(nil, &fakeWatchTransport{})
+	e := core.NewNormalizedEmitter()
+
+	s.Nil(step.killProcesses("abc", "INT"))
+
+	// The container stops mid-session and we aren't allowed to restart it
+	client.gone = true
+	err := step.killProcesses("abc", "INT")
+	s.True(isContainerGone(err))
+	_, err = step.recoverContainer(e, sess, "abc")
+	s.Equal(errContainerGone, err)
+
+	// With restart-container we bring it back and carry on
+	step.config.RestartContainer = true
+	ctx, err := step.recoverContainer(e, sess, "abc")
+	s.Nil(err)
+	s.Equal(1, client.restarts)
+	_, err = core.EmitterFromContext(ctx)
+	s.Nil(err, "the new session context should keep our emitter")
+	s.Nil(step.killProcesses("abc", "INT"))
+
+	// A removed container can't be brought back
+	client.removed = true
+	_, err = step.recoverContainer(e, sess, "abc")
+	s.NotNil(err)
+	s.Equal(1, client.restarts)
+}
+
+func (s *WatchStepSuite) TestCommandWrapper() {
+	step := &WatchStep{config: WatchConfig{Code: "./server"}}
+	s.Equal("./server", step.command())
+
+	step.config.Wrapper = "dlv exec --headless --listen=:2345 -- {{cmd}}"
+	s.Equal("dlv exec --headless --listen=:2345 -- ./server", step.command())
+
+}
+
+func (s *WatchStepSuite) TestTTYCommand() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "npm start", "setup": "npm install", "tty": "true"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	cmds := step.reloadCommands(2)
+	s.Equal("set +e", cmds[0])
+	s.Equal("{ { npm install\n} && echo wercker-watch-setup-watch-test && { export -p > '/tmp/wercker-watch-watch-test.tty-2.env'; pwd > '/tmp/wercker-watch-watch-test.tty-2.dir'; echo \"wercker-watch-tty-watch-test 2\"\n}\n} || echo \"wercker-watch-exit-watch-test 2 $?\"", cmds[1], "our shell only runs setup")
+	script, ok := step.ttyScripts.take(2)
+	s.True(ok)
+	s.Equal(". '/tmp/wercker-watch-watch-test.tty-2.env'; cd \"$(cat '/tmp/wercker-watch-watch-test.tty-2.dir')\"; rm -f '/tmp/wercker-watch-watch-test.tty-2.env' '/tmp/wercker-watch-watch-test.tty-2.dir'\nnpm start", script)
+	_, ok = step.ttyScripts.take(2)
+	s.False(ok, "once")
+
+	output, starts := step.parseTTYStarts("installed\nwercker-watch-tty-watch-test 2\n")
+	s.Equal("installed\n", output)
+	s.Equal([]int{2}, starts)
+	s.Nil(step.Validate())
+	step, err = NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "npm start", "tty": "true", "interactive": "true"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.NotNil(step.Validate(), "stdin goes to our shell, not the exec")
+}
+
+func (s *WatchStepSuite) TestKillCommandKeepsPidfiles() {
+	step := &WatchStep{}
+	s.NotContains(step.killCommand("INT"), "keep=")
+
+	step.config.KeepPidfiles = []string{"/var/run/db.pid", "/tmp/it's.pid"}
+	cmd := step.killCommand("TERM")
+	s.Contains(cmd, `cat '/var/run/db.pid' '/tmp/it'\''s.pid'`)
+	s.Contains(cmd, "kill -s TERM $pid")
+	s.Contains(cmd, "&& echo $pid")
+}
+
+func (s *WatchStepSuite) TestParseKilledPids() {
+	s.Equal([]string{"12", "40"}, parseKilledPids("12\n40\n"))
+	s.Equal([]string{}, parseKilledPids(""))
+	s.Equal([]string{"7"}, parseKilledPids("sh: oops\n7\n"))
+}
+
+func (s *WatchStepSuite) TestParseListeningPorts() {
+	ports := parseListeningPorts("00000000:1F90\n0100007F:0CEA\n00000000000000000000000000000000:01BB\ngarbage\n")
+	s.True(ports[8080])
+	s.True(ports[3306])
+	s.True(ports[443])
+	s.False(ports[80])
+}
+
+func (s *WatchStepSuite) TestTriggerHandler() {
+	trigger := make(chan struct{}, 1)
+	handler := triggerHandler("sekrit", trigger)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	s.Equal(http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/", nil))
+	s.Equal(http.StatusForbidden, w.Code)
+	s.Equal(0, len(trigger))
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("X-Wercker-Token", "sekrit")
+	handler(w, r)
+	s.Equal(http.StatusAccepted, w.Code)
+	s.Equal(1, len(trigger))
+
+	// A second trigger while one is pending doesn't block
+	w = httptest.NewRecorder()
+	handler(w, r)
+	s.Equal(http.StatusAccepted, w.Code)
+}
+
+func (s *WatchStepSuite) TestChangeSet() {
+	changes := newChangeSet()
+	changes.add(fsnotify.Event{Name: "new.go", Op: fsnotify.Create})
+	changes.add(fsnotify.Event{Name: "new.go", Op: fsnotify.Write})
+	changes.add(fsnotify.Event{Name: "main.go", Op: fsnotify.Write})
+	changes.add(fsnotify.Event{Name: "old.go", Op: fsnotify.Remove})
+	s.Equal([]string{"A new.go", "M main.go", "D old.go"}, changes.lines(10))
+	s.Equal([]string{"A new.go", "and 2 more"}, changes.lines(1))
+}
+
+func (s *WatchStepSuite) TestNotifyReload() {
+	defer func() {
+		execCommand = exec.Command
+		lookPath = exec.LookPath
+	}()
+	var ran [][]string
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		ran = append(ran, append([]string{name}, args...))
+		return exec.Command("true")
+	}
+	lookPath = func(file string) (string, error) {
+		return "/usr/bin/" + file, nil
+	}
+
+	step := &WatchStep{logger: util.RootLogger().WithField("Logger", "Test")}
+	step.notifyReload(time.Second, nil, nil)
+	s.Equal(0, len(ran), "notify is off by default")
+
+	step.config.Notify = true
+	ok, failed := 0, 3
+	step.notifyReload(1500*time.Millisecond, &ok, nil)
+	step.notifyReload(time.Second, &failed, nil)
+	step.notifyReload(0, nil, errors.New("no such file"))
+	s.Require().Equal(3, len(ran))
+	s.Contains(strings.Join(ran[0], " "), "reload finished")
+	s.Contains(strings.Join(ran[0], " "), "1.5s")
+	s.Contains(strings.Join(ran[1], " "), "exited with 3")
+	s.Contains(strings.Join(ran[2], " "), "no such file")
+
+	// No notifier installed, nothing happens
+	lookPath = func(file string) (string, error) {
+		return "", errors.New("not found")
+	}
+	step.notifyReload(time.Second, &ok, nil)
+	s.Equal(3, len(ran))
+}
+
+func (s *WatchStepSuite) TestNotifyOnExit() {
+	defer func() {
+		execCommand = exec.Command
+		lookPath = exec.LookPath
+	}()
+	var mutex sync.Mutex
+	var ran []string
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ran = append(ran, strings.Join(append([]string{name}, args...), " "))
+		return exec.Command("true")
+	}
+	lookPath = func(file string) (string, error) {
+		return "/usr/bin/" + file, nil
+	}
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 0.3; sh -c 'exit 3'", "reload": "true", "notify": "true"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	mutex.Lock()
+	s.Empty(ran, "not while the code runs")
+	mutex.Unlock()
+	run.waitFor("reload-finished", func() bool { return len(run.finished) > 0 })
+	mutex.Lock()
+	defer mutex.Unlock()
+	s.Require().Len(ran, 1)
+	s.Contains(ran[0], "reload failed")
+	s.Contains(ran[0], "exited with 3")
+}
+
+func (s *WatchStepSuite) TestHostCommandOnExit() {
+	out, err := ioutil.TempDir("", "wercker-host-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(out)
+	for _, code := range []string{"sleep 0.3", "sleep 0.3; sh -c 'exit 3'"} {
+		ran := filepath.Join(out, "ran")
+		os.Remove(ran)
+		options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), AllowHostCommands: true, GlobalOptions: &core.GlobalOptions{}}
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": code, "reload": "true", "host-command": "touch " + ran}}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+
+		run := s.startWatch(step)
+		run.waitForReloads(1)
+		_, err = os.Stat(ran)
+		s.True(os.IsNotExist(err), "not while the code runs")
+		run.waitForRuns(1)
+		// The host command runs on its own, give it a moment
+		for i := 0; i < 50; i++ {
+			if _, err = os.Stat(ran); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		run.stop()
+		if code == "sleep 0.3" {
+			s.Nil(err, "the code exited 0")
+		} else {
+			s.True(os.IsNotExist(err), "the code exited 3")
+		}
+	}
+}
+
+func (s *WatchStepSuite) TestWatchFromCommandAfterExit() {
+	root := s.WorkingDir()
+	release := filepath.Join(root, "release")
+	out, err := ioutil.TempDir("", "wercker-deps-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(out)
+	runs := filepath.Join(out, "runs")
+	countRuns := func() int {
+		data, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(data), "\n")
+	}
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "a.go"), nil, 0644))
+	options := &core.PipelineOptions{ProjectPath: root, AllowHostCommands: true, GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": stubbornCode(release), "reload": "true", "watch-from-command": "echo >> " + runs + "; echo a.go"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	s.Equal(1, countRuns(), "to set the watcher up")
+	// The change stops the first run, it goes on until release
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "a.go"), []byte("package a"), 0644))
+	time.Sleep(watchSettle + 500*time.Millisecond)
+	s.Equal(1, countRuns(), "not while the stopped run is still going")
+
+	s.Require().Nil(ioutil.WriteFile(release, nil, 0644))
+	run.waitForRuns(2)
+	for i := 0; i < 50 && countRuns() < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.Equal(2, countRuns(), "after the second build's exit")
+}
+
+func (s *WatchStepSuite) TestNotifyArgs() {
+	s.Equal([]string{"notify-send", "title", "msg"}, notifyArgs("linux", "title", "msg"))
+	s.Equal(`display notification "say \"hi\"" with title "title"`, notifyArgs("darwin", "title", `say "hi"`)[2])
+	s.Contains(notifyArgs("windows", "it's", "msg")[3], `'it''s'`)
+}
+
+func (s *WatchStepSuite) TestDirsWithExtensions() {
+	root := s.WorkingDir()
+	for _, dir := range []string{"cmd/server", "web/static", "docs"} {
+		s.Require().Nil(os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "cmd/server/main.go"), []byte("package main\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "web/static/app.js"), []byte("\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "docs/index.TMPL"), []byte("\n"), 0644))
+
+	step := &WatchStep{
+		config: WatchConfig{Extensions: []string{".go", ".tmpl"}},
+		logger: util.RootLogger().WithField("Logger", "Test"),
+	}
+	relevant, err := step.dirsWithExtensions(root, &dirFilters{step: step, root: root, byDir: map[string][]string{}})
+	s.Nil(err)
+	s.True(relevant[root])
+	s.True(relevant[filepath.Join(root, "cmd")])
+	s.True(relevant[filepath.Join(root, "cmd/server")])
+	s.True(relevant[filepath.Join(root, "docs")])
+	s.False(relevant[filepath.Join(root, "web")])
+	s.False(relevant[filepath.Join(root, "web/static")])
+}
+
+func (s *WatchStepSuite) TestExtensionsTrigger() {
+	root := s.WorkingDir()
+	write := func(path string) fsnotify.Event {
+		return fsnotify.Event{Name: filepath.Join(root, path), Op: fsnotify.Write}
+	}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "go run .", "extensions": "go, .tmpl"}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.True(step.shouldTrigger(write("main.go")))
+	s.True(step.shouldTrigger(write("web/index.TMPL")))
+	s.False(step.shouldTrigger(write("README.md")), "next to a .go file")
+	s.False(step.shouldTrigger(write("Makefile")))
+	s.True(step.shouldTrigger(fsnotify.Event{Name: filepath.Join(root, "old.go"), Op: fsnotify.Remove}))
+
+	step, err = NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "go run ."}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.True(step.shouldTrigger(write("README.md")), "everything without extensions")
+}
+
+func (s *WatchStepSuite) TestFinishBeatsDebounce() {
+	ctx := context.Background()
+	s.Equal(watchContinue, pendingStop(ctx, make(chan struct{})))
+
+	// Both a debounce fire and a finish are ready, whichever the select
+	// picks we must never reload
+	for i := 0; i < 100; i++ {
+		fire := make(chan time.Time, 1)
+		fire <- time.Now()
+		finished := make(chan struct{}, 1)
+		finished <- struct{}{}
+
+		select {
+		case <-fire:
+			s.Require().Equal(watchFinished, pendingStop(ctx, finished), "reloaded after finish was signaled")
+		case <-finished:
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	s.Equal(watchSessionDone, pendingStop(ctx, make(chan struct{})))
+}
+
+func (s *WatchStepSuite) TestFinishBeatsDebounceInLoop() {
+	// Whichever of the two the loop's select picks, the step finishes
+	// without reloading. Each round is a coin flip without the check.
+	for round := 0; round < 4; round++ {
+		root := s.WorkingDir()
+		path := filepath.Join(root, "events.sock")
+		options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "echo run", "reload": "true", "event-socket": path}}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		// Deciding on b.go holds the loop up, so the debounce fire and the
+		// finish are both waiting for it once it's let go
+		release := make(chan bool)
+		step.decider = ReloadDeciderFunc(func(event fsnotify.Event, changed []string) bool {
+			switch filepath.Base(event.Name) {
+			case "a.go":
+				return true
+			case "b.go":
+				return <-release
+			}
+			return false
+		})
+
+		run := s.startWatch(step)
+		conn, err := net.Dial("unix", path)
+		s.Require().Nil(err)
+		run.waitForRuns(1)
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "a.go"), []byte("package a"), 0644))
+		time.Sleep(50 * time.Millisecond)
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "b.go"), []byte("package b"), 0644))
+		time.Sleep(watchSettle + 400*time.Millisecond)
+		go util.GlobalSigint().Dispatch()
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+
+		select {
+		case <-run.done:
+		case <-time.After(5 * time.Second):
+			s.Require().FailNow("the step didn't finish")
+		}
+		run.shell.close()
+		// The socket is closed with the step, a reload would have said
+		// what changed first
+		events, err := ioutil.ReadAll(conn)
+		conn.Close()
+		s.Nil(err)
+		s.NotContains(string(events), `"type":"changed"`, "round %d", round)
+	}
+}
+
+func (s *WatchStepSuite) TestProfileCommands() {
+	options := &core.PipelineOptions{ReportRoot: "/report"}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, options, &Options{})
+	s.Require().Nil(err)
+	s.Nil(step.profileCommands(1))
+
+	step.config.Profile = profileNode
+	cmds := step.profileCommands(2)
+	dir := "/report/" + step.SafeID() + "/profiles/reload-2"
+	s.Equal("mkdir -p '"+dir+"'", cmds[0])
+	s.Equal("export WERCKER_PROFILE_DIR='"+dir+"'", cmds[1])
+	s.Contains(cmds[2], "--cpu-prof-dir=$WERCKER_PROFILE_DIR")
+}
+
+func (s *WatchStepSuite) TestParseGitignoreLine() {
+	tests := []struct {
+		line    string
+		pattern string
+		ok      bool
+		matches string
+	}{
+		{"", "", false, ""},
+		{"   ", "", false, ""},
+		{"# a comment", "", false, ""},
+		{"!important.log", "", false, ""},
+		{"*.log", "*.log", true, "debug.log"},
+		{"*.log   ", "*.log", true, "debug.log"},
+		{"build\r", "build", true, "build"},
+		{"  spaced", "  spaced", true, "  spaced"},
+		{`\#notes`, `\#notes`, true, "#notes"},
+		{`\!bang`, `\!bang`, true, "!bang"},
+		{`trailing\ `, `trailing\ `, true, "trailing "},
+		{`trailing\   `, `trailing\ `, true, "trailing "},
+		{`backslash\\ `, `backslash\\`, true, `backslash\`},
+	}
+	for _, test := range tests {
+		pattern, ok := parseGitignoreLine(test.line)
+		s.Equal(test.ok, ok, "line %q", test.line)
+		s.Equal(test.pattern, pattern, "line %q", test.line)
+		if test.matches != "" {
+			matched, err := filepath.Match(pattern, test.matches)
+			s.Nil(err)
+			s.True(matched, "%q should match %q", pattern, test.matches)
+		}
+	}
+}
+
+func (s *WatchStepSuite) TestReloadCommands() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.Equal([]string{"set +e", "{ ./server\n}; echo \"wercker-watch-exit-watch-test 1 $?\""}, step.reloadCommands(1))
+
+	step.config.TmuxSession = "dev"
+	cmds := step.reloadCommands(1)
+	s.Equal(2, len(cmds))
+	s.Contains(cmds[1], "tmux new-session -d -s 'dev'")
+	s.Contains(cmds[1], "tmux respawn-pane -k -t 'dev' './server\necho $? > '\\''/tmp/wercker-watch-watch-test.exit-1'\\'''")
+	s.Contains(cmds[1], `echo "wercker-watch-exit-watch-test 1 $(cat '/tmp/wercker-watch-watch-test.exit-1')"`, "our shell reports the pane's exit")
+}
+
+func (s *WatchStepSuite) TestTmuxExitCode() {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		s.T().Skip("no tmux")
+	}
+	session := fmt.Sprintf("wercker-test-%d", os.Getpid())
+	defer exec.Command("tmux", "kill-session", "-t", session).Run()
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 0.3; sh -c 'exit 3'", "reload": "true", "tmux-session": session}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	complete := run.waitForRuns(1)
+	s.True(complete[0].Exited)
+	s.Equal(3, complete[0].ExitCode)
+	// The exit is recorded after its cycle completes
+	code, ok := step.status.exitCode()
+	for i := 0; i < 50 && !ok; i++ {
+		time.Sleep(20 * time.Millisecond)
+		code, ok = step.status.exitCode()
+	}
+	s.True(ok)
+	s.Equal(3, code)
+}
+
+func (s *WatchStepSuite) TestSetup() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "npm start", "setup": "npm install"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.Require().Nil(step.Validate())
+	s.Equal([]string{"set +e", "{ { npm install\n} && echo wercker-watch-setup-watch-test && { npm start\n}\n}; echo \"wercker-watch-exit-watch-test 1 $?\""}, step.reloadCommands(1), "setup runs before the first run")
+	s.Contains(step.reloadCommands(2)[1], "npm install", "until a run gets through it")
+
+	output, done := step.parseSetupDone("installed\nwercker-watch-setup-watch-test\nstarted\n")
+	s.True(done)
+	s.Equal("installed\nstarted\n", output)
+	step.status.finishSetup()
+	s.Equal([]string{"set +e", "{ npm start\n}; echo \"wercker-watch-exit-watch-test 2 $?\""}, step.reloadCommands(2), "reloads only run the code")
+
+	// tmux panes don't tell us, setup goes with the first run
+	step.status.setup = false
+	step.config.TmuxSession = "dev"
+	s.Contains(step.reloadCommands(1)[1], "npm install")
+	s.NotContains(step.reloadCommands(2)[1], "npm install")
+	step.config.TmuxSession = ""
+
+	step.config.Setup = ""
+	s.Equal("{ npm start\n}; echo \"wercker-watch-exit-watch-test 1 $?\"", step.reloadCommands(1)[1])
+}
+
+func (s *WatchStepSuite) TestSetupInterrupted() {
+	root := s.WorkingDir()
+	out, err := ioutil.TempDir("", "wercker-setup-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(out)
+	runs := filepath.Join(out, "runs")
+	countRuns := func() int {
+		data, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(data), "\n")
+	}
+	options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 5", "setup": "echo >> " + runs + "; sleep 1", "reload": "true", "debounce-mode": "trailing"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	// Stopped during setup, the next run goes through it again
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "a.go"), []byte("package a"), 0644))
+	run.waitForReloads(2)
+	time.Sleep(1500 * time.Millisecond)
+	s.Equal(2, countRuns())
+	s.True(step.status.setupDone())
+
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "b.go"), []byte("package b"), 0644))
+	run.waitForReloads(3)
+	time.Sleep(200 * time.Millisecond)
+	s.Equal(2, countRuns(), "setup is done")
+}
+
+func (s *WatchStepSuite) TestReloadLimiter() {
+	start := time.Unix(1000, 0)
+	limiter := newReloadLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		_, ok := limiter.allow(start.Add(time.Duration(i)*10*time.Second), []string{"gen/out.go", fmt.Sprintf("edit%d.go", i)})
+		s.True(ok)
+	}
+	wait, ok := limiter.allow(start.Add(30*time.Second), []string{"gen/out.go"})
+	s.False(ok, "a fourth reload within the minute")
+	s.Equal(30*time.Second, wait, "until the first reload leaves the window")
+	s.Equal("gen/out.go", limiter.busiest([]string{"gen/out.go"}))
+
+	_, ok = limiter.allow(start.Add(time.Minute+time.Second), nil)
+	s.True(ok, "the window rolled on")
+	s.Equal("", newReloadLimiter(1, time.Minute).busiest(nil))
+
+	var off *reloadLimiter
+	_, ok = off.allow(start, nil)
+	s.True(ok)
+	_, ok = newReloadLimiter(0, time.Minute).allow(start, nil)
+	s.True(ok)
+
+	step := &WatchStep{config: WatchConfig{MaxReloadsPerMinute: 3}}
+	s.Equal("more than 3 reloads in a minute, pausing reloads for 30s, gen/out.go keeps changing", step.reloadLimitMessage(29500*time.Millisecond, "gen/out.go"))
+}
+
+func (s *WatchStepSuite) TestCommandsScript() {
+	run := func(cmds ...string) (string, int) {
+		cmd := exec.Command("sh", "-c", commandsScript(cmds))
+		output, err := cmd.CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return string(output), exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		s.Require().Nil(err)
+		return string(output), 0
+	}
+	output, code := run("echo one", "echo two")
+	s.Equal("one\ntwo\n", output)
+	s.Equal(0, code)
+
+	output, code = run("echo one", "echo 'it''s' && (exit 3)", "echo three")
+	s.Equal("one\nits\nCommand 2 of 3 failed with exit code 3: echo 'it''s' && (exit 3)\n", output, "stops at the failure and names it")
+	s.Equal(3, code)
+
+	_, code = run("true", "(exit 4)")
+	s.Equal(4, code, "the last command's status")
+}
+
+func (s *WatchStepSuite) TestAsUser() {
+	run := func(user, code string) (string, int) {
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": code, "user": user}}, &core.PipelineOptions{}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		output, err := exec.Command("sh", "-c", step.command()).CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return string(output), exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		s.Require().Nil(err)
+		return string(output), 0
+	}
+	current, err := exec.Command("id", "-un").Output()
+	s.Require().Nil(err)
+	me := strings.TrimSpace(string(current))
+
+	output, code := run(me, "echo \"it's $0\"; id -un")
+	s.Equal(0, code)
+	s.Equal(fmt.Sprintf("it's sh\n%s\n", me), output, "already that user, runs as is")
+
+	output, code = run("wercker-no-such-user", "echo ran")
+	s.Equal(userMissing, code)
+	s.Equal("user: wercker-no-such-user doesn't exist in the container\n", output)
+
+	// Switching for real needs root and su
+	if _, err := exec.LookPath("su"); me != "root" || err != nil {
+		return
+	}
+	output, code = run("nobody", "id -un; echo \"it's fine\"")
+	s.Equal(0, code, output)
+	s.Equal("nobody\nit's fine\n", output)
+}
+
+// userClient answers checkUser's id with code
+type userClient struct {
+	fakeWatchClient
+	code int
+}
+
+func (c *userClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	return []int{c.code}, nil
+}
+
+func (s *WatchStepSuite) TestCheckUser() {
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "node server.js", "user": "node"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	step.client = &userClient{code: 0}
+	s.Nil(step.checkUser("container"))
+	step.client = &userClient{code: 127}
+	s.Nil(step.checkUser("container"), "no id to ask, the runs say it")
+	step.client = &userClient{code: 1}
+	err = step.checkUser("container")
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "user: node doesn't exist in the container")
+
+	step.config.User = ""
+	s.Nil(step.checkUser("container"))
+}
+
+func (s *WatchStepSuite) TestInterpolate() {
+	env := util.NewEnvironment("PORT=8080", "NODE_ENV=development")
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server -port $PORT; echo $?", "setup": "npm install --only=${NODE_ENV}"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(env)
+	s.Equal("./server -port 8080; echo $?", step.config.Code, "unset ones are left for the shell")
+	s.Equal("npm install --only=development", step.config.Setup)
+
+	step, err = NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"commands": "go build\n./app -port $PORT -cost $$5"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(env)
+	s.Equal([]string{"go build", "./app -port 8080 -cost $5"}, step.config.Commands)
+	s.Equal(commandsScript(step.config.Commands), step.config.Code)
+}
+
+func (s *WatchStepSuite) TestGitChanges() {
+	previous := parseGitStatus(" M main.go\nA  new.go\n")
+	s.Equal(gitStatus{"main.go": " M", "new.go": "A "}, previous)
+
+	current := parseGitStatus(" M main.go\nAM new.go\n D gone.go\nR  old.go -> renamed.go\n")
+	s.Equal("R ", current["renamed.go"])
+
+	events := gitChanges("/src", previous, current)
+	s.Equal([]fsnotify.Event{
+		{Name: "/src/gone.go", Op: fsnotify.Remove},
+		{Name: "/src/new.go", Op: fsnotify.Create},
+		{Name: "/src/renamed.go", Op: fsnotify.Write},
+	}, events)
+
+	// Committing everything clears the status, which is a change too
+	events = gitChanges("/src", current, gitStatus{})
+	s.Equal(4, len(events))
+	s.Equal(0, len(gitChanges("/src", current, current)))
+}
+
+func (s *WatchStepSuite) TestStaticIDs() {
+	config := &core.StepConfig{ID: "internal/watch", Data: map[string]string{}}
+	step, err := NewWatchStepWithIDs(config, &core.PipelineOptions{}, &Options{}, StaticIDSource("fixed"))
+	s.Require().Nil(err)
+	s.Equal("watch-fixed", step.SafeID())
+	s.Equal("fixed", step.ReportPath("message.txt"))
+
+	step, err = NewWatchStep(config, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	s.NotEqual(step.ReportPath(), step.ReportPath(), "random by default")
+}
+
+func (s *WatchStepSuite) TestProgressIndicator() {
+	var out bytes.Buffer
+	progress := newProgressIndicator(&out, false)
+	progress.interval = 5 * time.Millisecond
+	progress.Stop()
+
+	progress.Start()
+	time.Sleep(30 * time.Millisecond)
+	progress.Stop()
+	s.Contains(out.String(), "still building... 0s\n")
+
+	written := out.Len()
+	time.Sleep(20 * time.Millisecond)
+	s.Equal(written, out.Len(), "nothing should be written once stopped")
+
+	out.Reset()
+	spinner := newProgressIndicator(&out, true)
+	spinner.interval = 5 * time.Millisecond
+	spinner.Start()
+	time.Sleep(30 * time.Millisecond)
+	spinner.Stop()
+	s.Contains(out.String(), "building... 0s")
+	s.True(strings.HasSuffix(out.String(), "\r\x1b[K"), "the spinner should clean up after itself")
+}
+
+func (s *WatchStepSuite) TestBuildsDontOverlap() {
+	var mutex sync.Mutex
+	running, overlaps, builds := 0, 0, 0
+	release := make(chan struct{})
+	finished := make(chan struct{}, 10)
+	queue := newReloadQueue(func() {
+		mutex.Lock()
+		running++
+		builds++
+		if running > 1 {
+			overlaps++
+		}
+		first := builds == 1
+		mutex.Unlock()
+
+		if first {
+			// a long build
+			<-release
+		}
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		finished <- struct{}{}
+	})
+
+	queue.Request()
+	// files keep changing while the first build is blocked
+	for i := 0; i < 5; i++ {
+		queue.Request()
+	}
+	close(release)
+
+	<-finished
+	<-finished
+	select {
+	case <-finished:
+		s.Fail("more than one follow-up build ran")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	s.Equal(2, builds)
+	s.Equal(0, overlaps)
+}
+
+func (s *WatchStepSuite) TestSimultaneousChangesBuildOnce() {
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	debounce := util.NewCoalescingDebouncer(watchSettle, watchDebounce, clock)
+	builds := make(chan struct{}, 10)
+	queue := newReloadQueue(func() { builds <- struct{}{} })
+	reloads := 0
+	drain := func() {
+		for {
+			select {
+			case <-debounce.C:
+				reloads++
+				queue.Request()
+			default:
+				return
+			}
+		}
+	}
+
+	// a checkout writing files for longer than watchSettle in total, but
+	// never pausing that long
+	for i := 0; i < 9; i++ {
+		debounce.Trigger()
+		clock.Advance(watchSettle / 2)
+		drain()
+	}
+	s.Equal(0, reloads, "still writing")
+	clock.Advance(watchSettle)
+	drain()
+	s.Equal(1, reloads)
+	clock.Advance(watchDebounce)
+	drain()
+	s.Equal(1, reloads)
+
+	<-builds
+	select {
+	case <-builds:
+		s.Fail("the changes built more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *WatchStepSuite) TestDebounceMode() {
+	for mode, immediate := range map[string]bool{"trailing": false, "leading": true} {
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "make", "debounce-mode": mode}}, &core.PipelineOptions{}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		clock := util.NewFakeClock(time.Unix(1000, 0))
+		step.clock = clock
+		debounce := step.newDebouncer()
+
+		debounce.Trigger()
+		s.Equal(immediate, util.Fired(debounce.C), mode)
+		clock.Advance(watchSettle)
+		s.Equal(!immediate, util.Fired(debounce.C), "%s settled", mode)
+		debounce.Trigger()
+		clock.Advance(watchSettle)
+		s.Equal(!immediate, util.Fired(debounce.C), "%s again", mode)
+		clock.Advance(watchDebounce)
+		s.Equal(immediate, util.Fired(debounce.C), "%s sends the held change at the end of the period", mode)
+	}
+}
+
+func (s *WatchStepSuite) TestConfigSummary() {
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir()}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, options, &Options{})
+	s.Require().Nil(err)
+
+	summary := step.configSummary("/bin/bash")
+	s.False(summary.Reload)
+	s.Equal(watchDebounce, summary.Debounce)
+	s.Equal(0, summary.Includes)
+	s.True(summary.Excludes > 0)
+	s.Equal("INT", summary.Signal)
+	s.Contains(formatConfigSummary(summary), "signal=SIGINT shell=/bin/bash")
+}
+
+func (s *WatchStepSuite) TestReady() {
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	select {
+	case <-step.Ready():
+		s.Fail("ready before watching")
+	default:
+	}
+
+	step.markReady()
+	step.markReady()
+	select {
+	case <-step.Ready():
+	default:
+		s.Fail("not ready after markReady")
+	}
+}
+
+func (s *WatchStepSuite) TestEmptyCode() {
+	newStep := func(data map[string]string) *WatchStep {
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: data}, &core.PipelineOptions{}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		return step
+	}
+
+	err := newStep(map[string]string{"reload": "true"}).Validate()
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "code")
+	s.NotNil(newStep(map[string]string{"code": " \n "}).Validate())
+
+	s.Nil(newStep(map[string]string{"code": "./server"}).Validate())
+	s.Nil(newStep(map[string]string{"groups": `[{"name": "api", "paths": ["api"], "command": "./api"}]`}).Validate())
+}
+
+type fakePathWatcher struct {
+	watched map[string]bool
+}
+
+func (w *fakePathWatcher) Add(name string) error {
+	w.watched[name] = true
+	return nil
+}
+
+func (w *fakePathWatcher) Remove(name string) error {
+	delete(w.watched, name)
+	return nil
+}
+
+func (s *WatchStepSuite) TestCommandWatchSet() {
+	root := s.WorkingDir()
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "pkg", "a"), 0755))
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "pkg", "b"), 0755))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "main.go"), []byte("package main"), 0644))
+
+	paths := parseCommandPaths(root, "pkg/a\n\n  main.go \n/nowhere\n")
+	s.Equal([]string{filepath.Join(root, "pkg", "a"), filepath.Join(root, "main.go"), "/nowhere"}, paths)
+
+	watcher := &fakePathWatcher{watched: map[string]bool{}}
+	set := newCommandWatchSet()
+	count, err := set.update(watcher, paths)
+	s.Nil(err)
+	s.Equal(2, count)
+	s.True(watcher.watched[root])
+	s.True(set.matches(filepath.Join(root, "pkg", "a", "x.go")))
+	s.True(set.matches(filepath.Join(root, "main.go")))
+	s.False(set.matches(filepath.Join(root, "README.md")))
+
+	count, err = set.update(watcher, []string{filepath.Join(root, "pkg", "b")})
+	s.Nil(err)
+	s.Equal(1, count)
+	s.Equal(map[string]bool{filepath.Join(root, "pkg", "b"): true}, watcher.watched)
+	s.False(set.matches(filepath.Join(root, "main.go")))
+}
+
+func (s *WatchStepSuite) TestIgnoreFiles() {
+	root := s.WorkingDir()
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".rgignore"), []byte("vendor\n"), 0644))
+
+	options := &core.PipelineOptions{ProjectPath: root}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"ignore-files": ".gitignore, .ignore, .rgignore"}}, options, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	filters := step.watchFilters(root)
+	s.Contains(filters, filepath.Join(root, "*.log"))
+	s.Contains(filters, filepath.Join(root, "vendor"))
+}
+
+func (s *WatchStepSuite) TestWerckerignore() {
+	root := s.WorkingDir()
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("node_modules\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".werckerignore"), []byte("public/assets\n"), 0644))
+
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	filters := step.watchFilters(root)
+	s.Contains(filters, filepath.Join(root, "node_modules"))
+	s.Contains(filters, filepath.Join(root, "public/assets"))
+	s.Equal([]string{filepath.Join(root, "public/assets")}, step.loadIgnoreFile(root, ".werckerignore"))
+	s.True(step.isIgnoreFile(root, filepath.Join(root, ".werckerignore")), "changing it re-walks too")
+}
+
+func (s *WatchStepSuite) TestInternalDirs() {
+	root := s.WorkingDir()
+	for _, workingDir := range []string{filepath.Join(root, ".wercker"), filepath.Join(root, ".wercker") + "/", filepath.Join(root, "x", "..", ".wercker")} {
+		options := &core.PipelineOptions{ProjectPath: root, WorkingDir: workingDir}
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, options, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		filters := step.watchFilters(root)
+		for _, dir := range []string{"builds", "steps", "projects"} {
+			path := filepath.Join(root, ".wercker", dir)
+			_, excluded := step.matchFilters(filters, path)
+			s.True(excluded, "%s with working dir %s", path, workingDir)
+			_, excluded = step.matchFilters(filters, path+"/")
+			s.True(excluded, "%s/ with working dir %s", path, workingDir)
+			_, excluded = step.matchFilters(filters, filepath.Join(path, "some", "file.go"))
+			s.True(excluded)
+			s.False(step.shouldTrigger(fsnotify.Event{Name: filepath.Join(path, "file.go"), Op: fsnotify.Write}))
+		}
+		_, excluded := step.matchFilters(filters, filepath.Join(root, ".wercker", "buildsite"))
+		s.False(excluded, "only the directories themselves")
+	}
+
+	// A relative working dir still matches the absolute paths we walk
+	cwd, err := os.Getwd()
+	s.Require().Nil(err)
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{ProjectPath: cwd, WorkingDir: "_wercker"}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	_, excluded := step.matchFilters(nil, filepath.Join(cwd, "_wercker", "builds"))
+	s.True(excluded)
+}
+
+// lockedBuffer is a bytes.Buffer a logger can write to while a test reads
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func (s *WatchStepSuite) TestDryRun() {
+	out, err := ioutil.TempDir("", "wercker-dry-run-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(out)
+	ran := filepath.Join(out, "ran")
+	for _, data := range []map[string]string{
+		{"code": "touch " + ran, "setup": "touch " + ran, "max-reloads-per-minute": "1"},
+		{"groups": `[{"name": "api", "paths": ["src"], "command": "touch ` + ran + `"}]`},
+	} {
+		root, err := ioutil.TempDir("", "wercker-watch-")
+		s.Require().Nil(err)
+		defer os.RemoveAll(root)
+		s.Require().Nil(os.MkdirAll(filepath.Join(root, "src"), 0755))
+		data["reload"] = "true"
+		data["dry-run"] = "true"
+		data["ignore-writes"] = "*.pid"
+		options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: data}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		logs := &lockedBuffer{}
+		logger := util.NewLogger()
+		logger.Out = logs
+		step.logger = logger.WithField("Logger", "Test")
+		waitForLog := func(line string) {
+			deadline := time.After(5 * time.Second)
+			for !strings.Contains(logs.String(), line) {
+				select {
+				case <-deadline:
+					s.Require().FailNow("never logged "+line, logs.String())
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}
+
+		run := s.startWatch(step)
+		// The first build only says what it would run
+		waitForLog("dry-run: would run: touch " + ran)
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "src", "server.pid"), []byte("1"), 0644))
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "src", "main.go"), []byte("package main"), 0644))
+		if data["groups"] != "" {
+			waitForLog("src/main.go, reload pending for api")
+			deadline := time.After(5 * time.Second)
+			for strings.Count(logs.String(), "would run: touch") < 2 {
+				select {
+				case <-deadline:
+					s.Require().FailNow("the group never reloaded", logs.String())
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		} else {
+			waitForLog("dry-run: would run: touch " + ran + " (changed: src/main.go)")
+			// The second one goes past max-reloads-per-minute and is held
+			s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "src", "other.go"), []byte("package main"), 0644))
+			waitForLog("Too many reloads")
+			run.waitForReloads(2)
+		}
+		run.stop()
+		s.Nil(run.err)
+
+		shown := logs.String()
+		s.Contains(shown, "src/server.pid, ignored")
+		s.Contains(shown, "dry-run: would stop the code with SIGINT")
+		if data["groups"] == "" {
+			s.Contains(shown, "src/main.go, reload pending")
+			s.Contains(shown, "dry-run: would run the setup first: touch "+ran)
+			s.Equal(1, strings.Count(shown, "would run the setup first"), "setup only comes first once")
+			s.NotContains(shown, "src/other.go)", "the held reload never went")
+		}
+		s.Empty(step.client.(*shellClient).signals, "nothing was killed")
+		_, err = os.Stat(ran)
+		s.True(os.IsNotExist(err), "nothing ran in the container")
+	}
+}
+
+func (s *WatchStepSuite) TestExcludedLocations() {
+	root := s.WorkingDir()
+	build := filepath.Join(root, "wercker-out", "builds", "run-1", "output")
+	dist := filepath.Join(root, "dist", "js")
+	for _, dir := range []string{build, dist} {
+		s.Require().Nil(os.MkdirAll(dir, 0755))
+	}
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("dist\n"), 0644))
+	options := &core.PipelineOptions{ProjectPath: root, WorkingDir: filepath.Join(root, "wercker-out")}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, options, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	// Watch the excluded directories anyway, the way a stale watch would
+	watcher, err := fsnotify.NewWatcher()
+	s.Require().Nil(err)
+	defer watcher.Close()
+	for _, dir := range []string{root, build, dist} {
+		s.Require().Nil(watcher.Add(dir))
+	}
+	reloads := func(path string) bool {
+		s.Require().Nil(ioutil.WriteFile(path, []byte("x"), 0644))
+		for {
+			select {
+			case event := <-watcher.Events:
+				if event.Name == path {
+					return step.reloadDecider().ShouldReload(event, nil)
+				}
+			case <-time.After(5 * time.Second):
+				s.Require().Fail("no event for " + path)
+			}
+		}
+	}
+	s.False(reloads(filepath.Join(build, "app.js")), "deep inside the build dir")
+	s.False(reloads(filepath.Join(dist, "bundle.js")), "below a gitignored directory")
+	s.True(reloads(filepath.Join(root, "main.go")))
+
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), nil, 0644))
+	s.Require().Nil(step.rewatch(watcher, root))
+	s.True(reloads(filepath.Join(dist, "bundle.js")), "the ignore rules changed")
+}
+
+func (s *WatchStepSuite) TestWatchHidden() {
+	root := s.WorkingDir()
+	for _, dir := range []string{".github/workflows", ".git/objects", ".cache"} {
+		s.Require().Nil(os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte(".cache\n"), 0644))
+	write := func(path string) fsnotify.Event {
+		return fsnotify.Event{Name: filepath.Join(root, path), Op: fsnotify.Write}
+	}
+	for _, hidden := range []bool{false, true} {
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "npm run lint", "watch_hidden": fmt.Sprint(hidden)}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		s.Require().Nil(step.Validate())
+		dirs, err := step.watchDirs(root)
+		s.Require().Nil(err)
+		s.Equal(hidden, util.ContainsString(dirs, filepath.Join(root, ".github", "workflows")), "watch-hidden %t", hidden)
+		s.Equal(hidden, step.shouldTrigger(write(".eslintrc")))
+		s.Equal(hidden, step.shouldTrigger(write(".github/workflows/ci.yml")))
+
+		s.False(util.ContainsString(dirs, filepath.Join(root, ".git")), ".git never is")
+		s.False(step.shouldTrigger(write(".git/index")))
+		s.False(util.ContainsString(dirs, filepath.Join(root, ".cache")), "gitignored")
+		s.False(step.shouldTrigger(write(".cache/x")))
+	}
+}
+
+func (s *WatchStepSuite) TestPaths() {
+	root := s.WorkingDir()
+	for _, dir := range []string{"services/api/handlers", "services/api/vendor", "services/web", "libs/util", "docs"} {
+		s.Require().Nil(os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("services/api/vendor\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "README.md"), []byte("hi\n"), 0644))
+	newStep := func(data map[string]string) *WatchStep {
+		data["code"] = "make"
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: data}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		return step
+	}
+
+	step := newStep(map[string]string{"paths": "services/api, libs\nservices/api/handlers"})
+	s.Require().Nil(step.Validate())
+	dirs, err := step.watchDirs(root)
+	s.Require().Nil(err)
+	s.Equal([]string{
+		filepath.Join(root, "services/api"),
+		filepath.Join(root, "services/api/handlers"),
+		filepath.Join(root, "libs"),
+		filepath.Join(root, "libs/util"),
+	}, dirs, "overlapping paths are watched once, the root's ignore files still apply")
+
+	step = newStep(map[string]string{})
+	dirs, err = step.watchDirs(root)
+	s.Require().Nil(err)
+	s.True(util.ContainsString(dirs, filepath.Join(root, "docs")), "everything without paths")
+
+	for path, problem := range map[string]string{
+		"services/missing": "no such file",
+		"README.md":        "is not a directory",
+	} {
+		err := newStep(map[string]string{"paths": path}).Validate()
+		s.Require().NotNil(err, path)
+		s.Contains(err.Error(), "paths")
+		s.Contains(err.Error(), problem)
+	}
+	err = newStep(map[string]string{"paths": "docs", "root": "services"}).Validate()
+	s.Require().NotNil(err)
+	s.Contains(err.Error(), "outside of root")
+}
+
+func (s *WatchStepSuite) TestReloadDecider() {
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	write := fsnotify.Event{Name: "/project/main.go", Op: fsnotify.Write}
+	hidden := fsnotify.Event{Name: "/project/.main.go.swp", Op: fsnotify.Write}
+	s.True(step.reloadDecider().ShouldReload(write, nil))
+	s.False(step.reloadDecider().ShouldReload(hidden, nil))
+
+	var seen []string
+	step.SetReloadDecider(ReloadDeciderFunc(func(event fsnotify.Event, changed []string) bool {
+		seen = changed
+		return len(changed) == 0 && step.DefaultReloadDecider().ShouldReload(event, changed)
+	}))
+	s.True(step.reloadDecider().ShouldReload(write, nil))
+	s.False(step.reloadDecider().ShouldReload(write, []string{"/project/other.go"}))
+	s.Equal([]string{"/project/other.go"}, seen)
+
+	step.SetReloadDecider(nil)
+	s.True(step.reloadDecider().ShouldReload(write, []string{"/project/other.go"}))
+}
+
+func (s *WatchStepSuite) TestReloadSchedule() {
+	clock := util.NewFakeClock(time.Now())
+	s.Nil(newReloadSchedule(clock, 0), "off")
+	var off *reloadSchedule
+	s.Nil(off.C())
+	off.restart()
+	off.stop()
+
+	schedule := newReloadSchedule(clock, time.Minute)
+	ticked := func() bool {
+		select {
+		case <-schedule.C():
+			return true
+		default:
+			return false
+		}
+	}
+	clock.Advance(59 * time.Second)
+	s.False(ticked())
+	clock.Advance(time.Second)
+	s.True(ticked())
+
+	// A reload for a change pushes the next tick out
+	schedule.restart()
+	clock.Advance(50 * time.Second)
+	schedule.restart()
+	clock.Advance(50 * time.Second)
+	s.False(ticked())
+	clock.Advance(10 * time.Second)
+	s.True(ticked())
+
+	// Even if the tick already fired
+	schedule.restart()
+	clock.Advance(time.Minute)
+	schedule.restart()
+	s.False(ticked())
+
+	schedule.stop()
+	clock.Advance(time.Hour)
+	s.False(ticked())
+}
+
+func (s *WatchStepSuite) TestPausable() {
+	for value, pausable := range map[string]bool{"": true, "HUP": true, "HUP, USR2": false} {
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "make", "forward-signals": value}}, &core.PipelineOptions{}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		s.Equal(pausable, step.pausable(), value)
+	}
+}
+
+func (s *WatchStepSuite) TestIgnoreWrites() {
+	newStep := func(data map[string]string) *WatchStep {
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: data}, &core.PipelineOptions{ProjectPath: "/project"}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		return step
+	}
+	write := func(name string) fsnotify.Event {
+		return fsnotify.Event{Name: name, Op: fsnotify.Write}
+	}
+
+	step := newStep(map[string]string{})
+	s.True(step.shouldTrigger(write("/project/server.pid")), "nothing is ignored unless set")
+	s.True(step.shouldTrigger(write("/project/logs/dev.log")))
+
+	step = newStep(map[string]string{"ignore-writes": "*.pid, *.log"})
+	s.False(step.shouldTrigger(write("/project/server.pid")))
+	s.False(step.shouldTrigger(write("/project/logs/dev.log")))
+	s.False(step.shouldTrigger(fsnotify.Event{Name: "/project/server.pid", Op: fsnotify.Remove}), "removed when the code is killed")
+	s.True(step.shouldTrigger(write("/project/main.go")))
+
+	step = newStep(map[string]string{"ignore-writes": "tmp, uploads/*.png"})
+	s.True(step.shouldTrigger(write("/project/server.pid")))
+	s.False(step.shouldTrigger(write("/project/tmp/cache/x.json")))
+	s.False(step.shouldTrigger(write("/project/uploads/a.png")))
+	s.True(step.shouldTrigger(write("/project/assets/a.png")))
+
+	step = newStep(map[string]string{"ignore-writes": ""})
+	s.True(step.shouldTrigger(write("/project/server.pid")))
+}
+
+func (s *WatchStepSuite) TestSnapshot() {
+	newStep := func(options *core.PipelineOptions) *WatchStep {
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "make migrate", "snapshot": "db/schema.sql gen/*"}}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		return step
+	}
+	s.NotNil(newStep(&core.PipelineOptions{DirectMount: true}).Validate(), "the checkout would be restored")
+
+	step := newStep(&core.PipelineOptions{})
+	s.Require().Nil(step.Validate())
+	s.Equal([]string{
+		"set +e",
+		`rm -rf '/tmp/wercker-watch-watch-test.snapshot' && mkdir -p '/tmp/wercker-watch-watch-test.snapshot' && for p in db/schema.sql gen/*; do [ -e "$p" ] && tar -cf - "$p" | tar -xf - -C '/tmp/wercker-watch-watch-test.snapshot'; done; true`,
+		"{ make migrate\n}; echo \"wercker-watch-exit-watch-test 1 $?\"",
+	}, step.reloadCommands(1))
+	s.Equal([]string{
+		"set +e",
+		`for p in db/schema.sql gen/*; do [ -e "$p" ] && rm -rf -- "$p"; done; cp -a '/tmp/wercker-watch-watch-test.snapshot'/. .`,
+		"{ make migrate\n}; echo \"wercker-watch-exit-watch-test 2 $?\"",
+	}, step.reloadCommands(2))
+
+	s.Nil(validSnapshotPattern("gen/*.go"))
+	s.NotNil(validSnapshotPattern("/etc"))
+	s.NotNil(validSnapshotPattern("gen/../../x"))
+	s.NotNil(validSnapshotPattern("gen;rm"))
+}
+
+type uploadClient struct {
+	fakeWatchClient
+	cmds    [][]string
+	path    string
+	entries map[string]string
+}
+
+func (c *uploadClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	c.cmds = append(c.cmds, cmd)
+	return nil
+}
+
+func (c *uploadClient) UploadToContainer(id string, opts docker.UploadToContainerOptions) error {
+	c.path = opts.Path
+	c.entries = map[string]string{}
+	archive := tar.NewReader(opts.InputStream)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content, _ := ioutil.ReadAll(archive)
+		c.entries[header.Name] = string(content)
+	}
+}
+
+func (s *WatchStepSuite) TestCopyChanges() {
+	root := s.WorkingDir()
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "src", "new"), 0755))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "src", "main.go"), []byte("package main"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "src", "new", "a.go"), []byte("package new"), 0644))
+	client := &uploadClient{}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "make migrate", "snapshot": "gen/*"}}, &core.PipelineOptions{ProjectPath: root, GuestRoot: "/pipeline"}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	step.client = client
+
+	s.Nil(step.copyChanges("abc", nil))
+	s.Nil(client.entries, "nothing changed")
+
+	s.Nil(step.copyChanges("abc", []string{"src/main.go", "src/new", "src/gone.go"}))
+	s.Equal("/pipeline/source", client.path)
+	s.Equal(map[string]string{"src/main.go": "package main", "src/new": "", "src/new/a.go": "package new"}, client.entries)
+	s.Equal([][]string{{"rm", "-rf", "--", "/pipeline/source/src/gone.go"}}, client.cmds, "deleted on the host")
+}
+
+func (s *WatchStepSuite) TestNothingWatched() {
+	root := s.WorkingDir()
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "docs"), 0755))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "docs", "README.txt"), []byte("hi"), 0644))
+	newStep := func(data map[string]string) (*WatchStep, *bytes.Buffer) {
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: data}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		var out bytes.Buffer
+		logger := util.NewLogger()
+		logger.Out = &out
+		step.logger = logger.WithField("Logger", "Test")
+		return step, &out
+	}
+
+	// Only .go files count and there are none
+	step, out := newStep(map[string]string{"extensions": "go"})
+	watcher, err := step.watch(root)
+	s.Require().Nil(err)
+	watcher.Close()
+	s.Contains(out.String(), "no directories under "+root+" are watched")
+
+	step, _ = newStep(map[string]string{"extensions": "go", "strict": "true"})
+	_, err = step.watch(root)
+	s.NotNil(err)
+
+	step, out = newStep(map[string]string{"extensions": "txt"})
+	watcher, err = step.watch(root)
+	s.Require().Nil(err)
+	watcher.Close()
+	s.NotContains(out.String(), "are watched")
+}
+
+func (s *WatchStepSuite) TestNestedIgnoreFiles() {
+	root := s.WorkingDir()
+	for _, dir := range []string{"web/build/js", "web/src", "api/build", "api/vendor/lib"} {
+		s.Require().Nil(os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("api/vendor\n"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "web", ".gitignore"), []byte("# bundles\nbuild/\n!build/keep\n"), 0644))
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	dirs, err := step.watchDirs(root)
+	s.Require().Nil(err)
+	watched := map[string]bool{}
+	for _, dir := range dirs {
+		watched[dir] = true
+	}
+	s.True(watched[filepath.Join(root, "web", "src")])
+	s.False(watched[filepath.Join(root, "web", "build")], "web/.gitignore applies in web")
+	s.True(watched[filepath.Join(root, "api", "build")], "but not next to it")
+	s.False(watched[filepath.Join(root, "api", "vendor")])
+
+	pattern, excluded := step.newDirFilters(root).match(filepath.Join(root, "web", "build"))
+	s.True(excluded)
+	s.Equal(filepath.Join(root, "web", "build"), pattern)
+}
+
+func (s *WatchStepSuite) TestPollWatcher() {
+	root := s.WorkingDir()
+	file := filepath.Join(root, "main.go")
+	s.Require().Nil(ioutil.WriteFile(file, []byte("package main\n"), 0644))
+
+	s.Equal([]fsnotify.Event{
+		{Name: filepath.Join(root, "a.go"), Op: fsnotify.Create},
+		{Name: filepath.Join(root, "b.go"), Op: fsnotify.Remove},
+		{Name: filepath.Join(root, "c.go"), Op: fsnotify.Write},
+		{Name: filepath.Join(root, "d.sh"), Op: fsnotify.Chmod},
+	}, diffPollDir(root, map[string]pollEntry{
+		"b.go": {size: 1},
+		"c.go": {size: 1},
+		"d.sh": {mode: 0644},
+		"e.go": {size: 1},
+		"pkg":  {mode: os.ModeDir},
+	}, map[string]pollEntry{
+		"a.go": {size: 1},
+		"c.go": {size: 2},
+		"d.sh": {mode: 0755},
+		"e.go": {size: 1},
+		"pkg":  {mode: os.ModeDir, modTime: time.Unix(1, 0)},
+	}))
+
+	watcher := newPollWatcher(time.Millisecond, util.RealClock)
+	defer watcher.Close()
+	s.Require().Nil(watcher.Add(root))
+	s.NotNil(watcher.Add(filepath.Join(root, "missing")))
+	next := func() fsnotify.Event {
+		select {
+		case event := <-watcher.Events():
+			return event
+		case <-time.After(5 * time.Second):
+			s.Require().Fail("no event")
+		}
+		return fsnotify.Event{}
+	}
+
+	s.Require().Nil(ioutil.WriteFile(file, []byte("package main\n\nfunc main() {}\n"), 0644))
+	s.Equal(fsnotify.Event{Name: file, Op: fsnotify.Write}, next())
+	s.Require().Nil(os.Remove(file))
+	s.Equal(fsnotify.Event{Name: file, Op: fsnotify.Remove}, next())
+
+	s.Nil(watcher.Remove(root))
+	s.NotNil(watcher.Remove(root))
+	s.Require().Nil(watcher.Close())
+	s.Nil(watcher.Close(), "more than once")
+
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"poll": "true", "poll_interval": "10ms"}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	polling, err := step.watch(root)
+	s.Require().Nil(err)
+	defer polling.Close()
+	s.IsType(&pollWatcher{}, polling)
+	s.Equal(10*time.Millisecond, polling.(*pollWatcher).interval)
+}
+
+func (s *WatchStepSuite) TestWatchLimitError() {
+	err := watchLimitError(syscall.ENOSPC, 8190)
+	s.Contains(err.Error(), "after watching 8190 directories")
+	s.Contains(err.Error(), "fs.inotify.max_user_watches")
+	s.Contains(watchLimitError(os.NewSyscallError("inotify_add_watch", syscall.ENOSPC), 1).Error(), "watch limit")
+
+	other := errors.New("permission denied")
+	s.Equal(other, watchLimitError(other, 1))
+}
+
+func (s *WatchStepSuite) TestWatchNewDir() {
+	root := s.WorkingDir()
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "dist"), 0755))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("dist\napp/generated\n"), 0644))
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	fake := &fakePathWatcher{watched: map[string]bool{}}
+	dirs, err := step.watchDirs(root)
+	s.Require().Nil(err)
+	step.dirWatch = newDirWatchSet()
+	_, _, err = step.dirWatch.update(fake, dirs)
+	s.Require().Nil(err)
+
+	scaffold := filepath.Join(root, "app", "models")
+	s.Require().Nil(os.MkdirAll(filepath.Join(scaffold, ".cache", "x"), 0755))
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "app", "generated"), 0755))
+	s.True(isNewDir(fsnotify.Event{Name: filepath.Join(root, "app"), Op: fsnotify.Create}))
+	s.False(isNewDir(fsnotify.Event{Name: filepath.Join(root, ".gitignore"), Op: fsnotify.Create}))
+	s.False(isNewDir(fsnotify.Event{Name: filepath.Join(root, "app"), Op: fsnotify.Chmod}))
+
+	s.Require().Nil(step.watchNewDir(fake, root, filepath.Join(root, "app")))
+	s.True(fake.watched[filepath.Join(root, "app")])
+	s.True(fake.watched[scaffold], "directories below it too")
+	s.False(fake.watched[filepath.Join(scaffold, ".cache")], "the filters still apply")
+	s.False(fake.watched[filepath.Join(root, "app", "generated")], "and so does .gitignore")
+	s.Equal(step.dirWatch.count(), step.status.watchedDirs)
+
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "dist", "new"), 0755))
+	s.Require().Nil(step.watchNewDir(fake, root, filepath.Join(root, "dist", "new")))
+	s.False(fake.watched[filepath.Join(root, "dist", "new")], "its parent is excluded")
+}
+
+func (s *WatchStepSuite) TestRename() {
+	root := s.WorkingDir()
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "api", "v1"), 0755))
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.True(step.config.Events&fsnotify.Rename != 0, "on by default")
+
+	watcher, err := step.watch(root)
+	s.Require().Nil(err)
+	defer watcher.Close()
+	// Like the loop, follow the directories while reading the events
+	events := make(chan fsnotify.Event, 100)
+	go func() {
+		for event := range watcher.Events() {
+			step.followDirs(watcher, root, event)
+			events <- event
+		}
+	}()
+	reloadFor := func(path string) {
+		for {
+			select {
+			case event := <-events:
+				if event.Name == path && step.reloadDecider().ShouldReload(event, nil) {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				s.Require().Fail("no reload for " + path)
+			}
+		}
+	}
+
+	// An atomic save writes a temp file and renames it over the target
+	main := filepath.Join(root, "main.go")
+	s.Require().Nil(ioutil.WriteFile(main+".tmp", []byte("package main"), 0644))
+	s.Require().Nil(os.Rename(main+".tmp", main))
+	reloadFor(main)
+
+	s.Require().Nil(os.Rename(filepath.Join(root, "api"), filepath.Join(root, "server")))
+	deadline := time.Now().Add(5 * time.Second)
+	for !step.dirWatch.watching(filepath.Join(root, "server", "v1")) || step.dirWatch.watching(filepath.Join(root, "api", "v1")) {
+		s.Require().True(time.Now().Before(deadline), "the watches follow the rename")
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.False(step.dirWatch.watching(filepath.Join(root, "api")))
+	s.True(step.dirWatch.watching(filepath.Join(root, "server")))
+	handler := filepath.Join(root, "server", "v1", "handler.go")
+	s.Require().Nil(ioutil.WriteFile(handler, []byte("package v1"), 0644))
+	reloadFor(handler)
+}
+
+func (s *WatchStepSuite) TestWatcherClose() {
+	root := s.WorkingDir()
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	// Only the inotify ones, files the other tests left to the GC can be
+	// closed any time
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			s.T().Skip("no /proc/self/fd")
+		}
+		count := 0
+		for _, fd := range fds {
+			if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); strings.Contains(target, "inotify") {
+				count++
+			}
+		}
+		return count
+	}
+
+	before := openFiles()
+	for _, watcher := range []fileWatcher{nil, newPollWatcher(time.Millisecond, util.RealClock)} {
+		if watcher == nil {
+			watcher, err = step.watch(root)
+			s.Require().Nil(err)
+		}
+		s.Nil(watcher.Close())
+		// The loops stop on closed channels rather than spinning on them
+		for _, closed := range []func() bool{
+			func() bool { _, ok := <-watcher.Events(); return !ok },
+			func() bool { _, ok := <-watcher.Errors(); return !ok },
+		} {
+			result := make(chan bool, 1)
+			go func() { result <- closed() }()
+			select {
+			case ok := <-result:
+				s.True(ok)
+			case <-time.After(5 * time.Second):
+				s.Require().Fail("channel still open after Close")
+			}
+		}
+	}
+	s.Equal(before, openFiles(), "the inotify descriptors are released")
+}
+
+func (s *WatchStepSuite) TestRewatch() {
+	root := s.WorkingDir()
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "api"), 0755))
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "dist"), 0755))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("dist\n"), 0644))
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{}}, &core.PipelineOptions{ProjectPath: root}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	watcher, err := step.watch(root)
+	s.Require().Nil(err)
+	defer watcher.Close()
+	// Like the loop, Remove needs the events to be read
+	go func() {
+		for range watcher.Events() {
+		}
+	}()
+	s.Equal(2, step.dirWatch.count())
+	s.True(step.isIgnoreFile(root, filepath.Join(root, ".gitignore")))
+	s.True(step.isIgnoreFile(root, filepath.Join(root, "api", ".gitignore")), "nested ones count too")
+	s.False(step.isIgnoreFile(root, filepath.Join(filepath.Dir(root), ".gitignore")))
+	s.False(step.isIgnoreFile(root, filepath.Join(root, ".ignore")))
+
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("api\n"), 0644))
+	s.Require().Nil(step.rewatch(watcher, root))
+	s.True(step.dirWatch.watched[filepath.Join(root, "dist")])
+	s.False(step.dirWatch.watched[filepath.Join(root, "api")])
+	s.Equal(2, step.status.watchedDirs)
+
+	fake := &fakePathWatcher{watched: map[string]bool{}}
+	dirs := newDirWatchSet()
+	added, removed, err := dirs.update(fake, []string{"/a", "/b"})
+	s.Nil(err)
+	s.Equal([]string{"/a", "/b"}, added)
+	s.Empty(removed)
+	added, removed, err = dirs.update(fake, []string{"/b", "/c"})
+	s.Nil(err)
+	s.Equal([]string{"/c"}, added)
+	s.Equal([]string{"/a"}, removed)
+	s.Equal(map[string]bool{"/b": true, "/c": true}, fake.watched)
+}
+
+func (s *WatchStepSuite) TestReloadCollector() {
+	var mutex sync.Mutex
+	collected := []int{}
+	discarded := []int{}
+	release := make(chan struct{})
+	running := make(chan int, 10)
+	collector := newReloadCollector(1, 2, func(reload int) error {
+		running <- reload
+		<-release
+		mutex.Lock()
+		defer mutex.Unlock()
+		collected = append(collected, reload)
+		return nil
+	}, func(reload int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		discarded = append(discarded, reload)
+	}, util.RootLogger().WithField("Logger", "Test"))
+
+	// Queueing never waits for the collection
+	collector.queue(1)
+	s.Equal(1, <-running)
+	collector.queue(2)
+	collector.queue(3)
+	collector.queue(4)
+	select {
+	case reload := <-running:
+		s.Fail("only one collection at a time", "reload %d started", reload)
+	default:
+	}
+	close(release)
+	collector.wait()
+
+	// 2 was already too old to keep by the time it got a slot
+	sort.Ints(collected)
+	s.Equal([]int{1, 3, 4}, collected)
+	s.Equal([]int{1}, discarded)
+}
+
+type otherTransport struct{}
+
+func (otherTransport) Attach(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (context.Context, error) {
+	return ctx, nil
+}
+
+// shellTransport stands in for the build container with a local sh, the
+// session's commands run in it like they would in the container
+type shellTransport struct {
+	id     string
+	cmd    *exec.Cmd
+	pipes  []*os.File
+	exited chan struct{}
+}
+
+func (t *shellTransport) ContainerID() string {
+	return t.id
+}
+
+func (t *shellTransport) Attach(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (context.Context, error) {
+	// Pipes of our own, Wait would wait for the session's reader otherwise
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	t.cmd = exec.Command("sh")
+	t.cmd.Stdin = inR
+	t.cmd.Stdout = outW
+	t.cmd.Stderr = outW
+	if err := t.cmd.Start(); err != nil {
+		return nil, err
+	}
+	inR.Close()
+	outW.Close()
+	t.pipes = []*os.File{inW, outR}
+	go io.Copy(inW, stdin)
+	go io.Copy(stdout, outR)
+	ctx, cancel := context.WithCancel(ctx)
+	t.exited = make(chan struct{})
+	go func() {
+		t.cmd.Wait()
+		cancel()
+		close(t.exited)
+	}()
+	return ctx, nil
+}
+
+// signal sends signal to what the shell runs, the way the kill commands
+// signal everything but PID 1 in the container
+func (t *shellTransport) signal(signal string) {
+	exec.Command("pkill", "-"+signal, "-P", strconv.Itoa(t.cmd.Process.Pid)).Run()
+}
+
+// close kills the shell and what it runs and closes our ends of its pipes
+func (t *shellTransport) close() {
+	t.signal("KILL")
+	t.cmd.Process.Kill()
+	<-t.exited
+	for _, pipe := range t.pipes {
+		pipe.Close()
+	}
+}
+
+// shellClient runs the step's kill commands against a shellTransport
+type shellClient struct {
+	fakeWatchClient
+	shell   *shellTransport
+	mutex   sync.Mutex
+	signals []string
+	// oomKills is what the memory cgroup says was OOM killed
+	oomKills int
+	ttys     [][]string
+}
+
+var killedSignal = regexp.MustCompile(`kill -s ([A-Z]+)`)
+
+func (c *shellClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	if len(cmd) == 3 && cmd[2] == oomKillsCmd {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		fmt.Fprintln(output, c.oomKills)
+		return nil
+	}
+	m := killedSignal.FindStringSubmatch(strings.Join(cmd, " "))
+	if m == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	c.signals = append(c.signals, m[1])
+	c.mutex.Unlock()
+	c.shell.signal(m[1])
+	return nil
+}
+
+// ExecTTY runs cmd next to the shell, without a terminal, and records it
+func (c *shellClient) ExecTTY(containerID string, cmd []string, output io.Writer) (int, error) {
+	c.mutex.Lock()
+	c.ttys = append(c.ttys, cmd)
+	c.mutex.Unlock()
+	run := exec.Command(cmd[0], cmd[1:]...)
+	run.Stdout = output
+	run.Stderr = output
+	err := run.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.Sys().(syscall.WaitStatus).ExitStatus(), nil
+	}
+	return 0, err
+}
+
+func (c *shellClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	codes := []int{}
+	for _, cmd := range cmds {
+		if err := c.ExecOne(containerID, cmd, output); err != nil {
+			return codes, err
+		}
+		codes = append(codes, 0)
+	}
+	return codes, nil
+}
+
+// watchRun is Execute running the real watch loop against a shellTransport
+type watchRun struct {
+	suite *WatchStepSuite
+	step  *WatchStep
+	shell *shellTransport
+	done  chan struct{}
+	exit  int
+	err   error
+
+	mutex    sync.Mutex
+	started  []*core.WatchReloadStartedArgs
+	complete []*core.WatchReloadCompleteArgs
+	finished []*core.WatchReloadFinishedArgs
+	// events is both of them in order, e.g. "started 1", "complete 1"
+	events  []string
+	changed chan struct{}
+}
+
+func (s *WatchStepSuite) startWatch(step *WatchStep) *watchRun {
+	return s.startWatchIn(step, "shell")
+}
+
+// startWatchIn is startWatch with the shell posing as container containerID
+func (s *WatchStepSuite) startWatchIn(step *WatchStep, containerID string) *watchRun {
+	shell := &shellTransport{id: containerID}
+	step.client = &shellClient{shell: shell}
+	ctx := core.NewEmitterContext(context.Background())
+	e, err := core.EmitterFromContext(ctx)
+	s.Require().Nil(err)
+	run := &watchRun{suite: s, step: step, shell: shell, done: make(chan struct{}), changed: make(chan struct{}, 1)}
+	e.AddListener(core.WatchReloadStarted, func(args *core.WatchReloadStartedArgs) {
+		run.mutex.Lock()
+		run.started = append(run.started, args)
+		run.events = append(run.events, fmt.Sprintf("started %d", args.Reload))
+		run.mutex.Unlock()
+		run.notify()
+	})
+	e.AddListener(core.WatchReloadComplete, func(args *core.WatchReloadCompleteArgs) {
+		run.mutex.Lock()
+		run.complete = append(run.complete, args)
+		run.events = append(run.events, fmt.Sprintf("complete %d", args.Reload))
+		run.mutex.Unlock()
+		run.notify()
+	})
+	e.AddListener(core.WatchReloadFinished, func(args *core.WatchReloadFinishedArgs) {
+		run.mutex.Lock()
+		run.finished = append(run.finished, args)
+		run.mutex.Unlock()
+		run.notify()
+	})
+
+	sess := core.NewSession(step.options, shell)
+	sessCtx, err := sess.Attach(ctx)
+	s.Require().Nil(err)
+	go func() {
+		run.exit, run.err = step.Execute(sessCtx, sess)
+		close(run.done)
+	}()
+	// Without reload there is no loop to wait for
+	if !step.config.Reload {
+		return run
+	}
+	select {
+	case <-step.Ready():
+	case <-run.done:
+		s.Require().FailNow("Execute returned before watching", "%v", run.err)
+	case <-time.After(5 * time.Second):
+		s.Require().FailNow("the watch loop didn't start")
+	}
+	return run
+}
+
+func (r *watchRun) notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// waitFor waits until ok is true, it's called with the events locked
+func (r *watchRun) waitFor(what string, ok func() bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		r.mutex.Lock()
+		done := ok()
+		r.mutex.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-r.changed:
+		case <-timeout:
+			r.suite.Require().FailNow("timed out waiting for " + what)
+		}
+	}
+}
+
+// waitForReloads waits for n reloads to start, the first build is one
+func (r *watchRun) waitForReloads(n int) []*core.WatchReloadStartedArgs {
+	var started []*core.WatchReloadStartedArgs
+	r.waitFor(fmt.Sprintf("%d reloads", n), func() bool {
+		started = append([]*core.WatchReloadStartedArgs{}, r.started...)
+		return len(started) >= n
+	})
+	return started
+}
+
+// waitForRuns waits for n runs of the code to complete
+func (r *watchRun) waitForRuns(n int) []*core.WatchReloadCompleteArgs {
+	var complete []*core.WatchReloadCompleteArgs
+	r.waitFor(fmt.Sprintf("%d runs", n), func() bool {
+		complete = append([]*core.WatchReloadCompleteArgs{}, r.complete...)
+		return len(complete) >= n
+	})
+	return complete
+}
+
+// eventLog is the started and complete events so far
+func (r *watchRun) eventLog() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.events...)
+}
+
+// stop is Ctrl-C, it waits for Execute to return
+func (r *watchRun) stop() {
+	defer r.shell.close()
+	util.GlobalSigint().Dispatch()
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		r.suite.Require().FailNow("Execute didn't return after Ctrl-C")
+	}
+}
+
+func (s *WatchStepSuite) TestRemoteFallback() {
+	for _, data := range []map[string]string{
+		// Not a git repository, git-trigger gives up on the first status
+		{"git-trigger": "true"},
+		// ssh only runs with --allow-host-commands
+		{"ssh-host": "example.invalid", "ssh-path": "/src"},
+	} {
+		root, err := ioutil.TempDir("", "wercker-watch-")
+		s.Require().Nil(err)
+		defer os.RemoveAll(root)
+		data["code"] = "echo run"
+		data["reload"] = "true"
+		options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: data}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+
+		run := s.startWatch(step)
+		run.waitForReloads(1)
+		// The watcher's events reload now
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "main.go"), []byte("package main"), 0644))
+		started := run.waitForReloads(2)
+		s.Equal([]string{"main.go"}, started[1].Files, "%v", data)
+		run.stop()
+		s.Nil(run.err)
+	}
+}
+
+func (s *WatchStepSuite) TestExitCodeWithoutReload() {
+	for _, data := range []map[string]string{
+		{"on-exit": "finish"},
+		// Waits for Ctrl-C, the exit before that is how the step went
+		{},
+	} {
+		data["code"] = "sh -c 'exit 3'"
+		options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: data}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+
+		run := s.startWatch(step)
+		if data["on-exit"] == "" {
+			run.waitForRuns(1)
+			// The exit is recorded after its cycle completes
+			time.Sleep(100 * time.Millisecond)
+		} else {
+			select {
+			case <-run.done:
+			case <-time.After(5 * time.Second):
+				s.Require().FailNow("the step didn't finish on the exit")
+			}
+		}
+		run.stop()
+		s.Nil(run.err)
+		s.Equal(3, run.exit, "on-exit: %q", data["on-exit"])
+	}
+}
+
+func (s *WatchStepSuite) TestOOMKillOnExit() {
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 0.3; sh -c 'exit 137'", "reload": "true", "memory": "64m"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	client := step.client.(*shellClient)
+	client.mutex.Lock()
+	client.oomKills = 1
+	client.mutex.Unlock()
+	// Checked when the code exits non-zero, not only before the next reload
+	run.waitForRuns(1)
+	var kills int
+	for i := 0; i < 50; i++ {
+		step.oomMutex.Lock()
+		kills = step.oomKills
+		step.oomMutex.Unlock()
+		if kills == 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.Equal(1, kills)
+}
+
+func (s *WatchStepSuite) TestTTYExec() {
+	dir, err := ioutil.TempDir("", "wercker-tty-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": `echo "$GREETING from $(pwd)"; sh -c 'exit 3'`, "setup": "cd " + dir + "; export GREETING=hello", "reload": "true", "tty": "true", "log-file": filepath.Join(dir, "log")}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	complete := run.waitForRuns(1)
+	s.True(complete[0].Exited)
+	s.Equal(3, complete[0].ExitCode, "the exec's exit code")
+	client := step.client.(*shellClient)
+	client.mutex.Lock()
+	s.Len(client.ttys, 1, "the code runs in an exec of its own")
+	client.mutex.Unlock()
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	s.Require().Nil(err)
+	s.Contains(string(log), "hello from "+dir, "with our shell's environment and directory")
+	s.NotContains(string(log), "wercker-watch-tty")
+}
+
+func (s *WatchStepSuite) TestReloadCompleteOnExit() {
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sh -c 'exit 3'", "reload": "true"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	// Complete while we wait for changes, not once the next reload stops it
+	run := s.startWatch(step)
+	complete := run.waitForRuns(1)
+	s.Equal(1, complete[0].Reload)
+	s.True(complete[0].Exited)
+	s.Equal(3, complete[0].ExitCode)
+	s.False(complete[0].Successful)
+	run.stop()
+	s.Len(run.complete, 1, "not again at the end of the step")
+}
+
+func (s *WatchStepSuite) TestProgressStopsOnExit() {
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 1", "reload": "true", "progress": "true"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	// The code never says anything, its exit line still ends the indicator
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	time.Sleep(200 * time.Millisecond)
+	s.True(step.progress.running())
+	run.waitForRuns(1)
+	s.False(step.progress.running())
+}
+
+// stubbornCode is code that ignores the stop signal, it runs until release
+// exists
+func stubbornCode(release string) string {
+	return fmt.Sprintf(`sh -c "trap '' INT; while [ ! -e %s ]; do sleep 0.05; done"`, release)
+}
+
+func (s *WatchStepSuite) TestRunsDontOverlap() {
+	root := s.WorkingDir()
+	release := filepath.Join(root, "release")
+	options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": stubbornCode(release), "reload": "true", "ignore-writes": "release"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "a.go"), []byte("package a"), 0644))
+	// The reload stopped the first run but it's still going
+	time.Sleep(watchSettle + 500*time.Millisecond)
+	s.Equal([]string{"started 1"}, run.eventLog())
+
+	s.Require().Nil(ioutil.WriteFile(release, nil, 0644))
+	run.waitForRuns(2)
+	s.Equal([]string{"started 1", "complete 1", "started 2", "complete 2"}, run.eventLog())
+}
+
+func (s *WatchStepSuite) TestChangesDuringBuild() {
+	root := s.WorkingDir()
+	release := filepath.Join(root, "release")
+	options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": stubbornCode(release), "reload": "true", "ignore-writes": "release", "debounce-mode": "trailing"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	// The reload for a.go waits on the first run, the changes after it
+	// each trigger the loop but only make one follow-up
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(root, name), []byte("package a"), 0644))
+		time.Sleep(watchSettle + 200*time.Millisecond)
+	}
+	s.Require().Nil(ioutil.WriteFile(release, nil, 0644))
+	started := run.waitForReloads(3)
+	s.Equal([]string{"a.go"}, started[1].Files)
+	s.Equal([]string{"b.go", "c.go"}, started[2].Files)
+	run.waitForRuns(3)
+	time.Sleep(watchSettle + 200*time.Millisecond)
+	s.Equal([]string{"started 1", "complete 1", "started 2", "complete 2", "started 3", "complete 3"}, run.eventLog())
+}
+
+func (s *WatchStepSuite) TestBackoffOnExitCode() {
+	for code, backsOff := range map[string]bool{"true": false, "sh -c 'exit 1'": true} {
+		root, err := ioutil.TempDir("", "wercker-watch-")
+		s.Require().Nil(err)
+		defer os.RemoveAll(root)
+		options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+		data := map[string]string{"code": code, "reload": "true", "reload-backoff": "1h", "reload-backoff-max": "1h"}
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: data}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+
+		run := s.startWatch(step)
+		run.waitForRuns(1)
+		s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "main.go"), []byte("package main"), 0644))
+		if backsOff {
+			time.Sleep(watchSettle + 700*time.Millisecond)
+			s.Equal([]string{"started 1", "complete 1"}, run.eventLog(), code)
+		} else {
+			run.waitForReloads(2)
+		}
+		run.stop()
+	}
+}
+
+func (s *WatchStepSuite) TestInitialRetryOnExitCode() {
+	root := s.WorkingDir()
+	marker := filepath.Join(root, "failed-once")
+	options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+	// Fails the first time only, like a port the last run still held
+	code := fmt.Sprintf(`sh -c '[ -e %[1]s ] || { touch %[1]s; exit 1; }'`, marker)
+	data := map[string]string{"code": code, "reload": "true", "initial-retries": "2", "initial-retry-delay": "10ms", "ignore-writes": "failed-once"}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: data}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	complete := run.waitForRuns(2)
+	s.Equal(1, complete[0].ExitCode)
+	s.Equal(0, complete[1].ExitCode)
+	time.Sleep(200 * time.Millisecond)
+	s.Len(run.eventLog(), 4, "no retry after it started")
+}
+
+func (s *WatchStepSuite) TestSkipUnchangedInitialRuns() {
+	root := s.WorkingDir()
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "main.go"), []byte("package main"), 0644))
+	workingDir, err := ioutil.TempDir("", "wercker-watch-")
+	s.Require().Nil(err)
+	defer os.RemoveAll(workingDir)
+	initialRuns := func(code, containerID string) int {
+		options := &core.PipelineOptions{ProjectPath: root, WorkingDir: workingDir, GlobalOptions: &core.GlobalOptions{}}
+		data := map[string]string{"code": code, "reload": "true", "skip-unchanged-initial": "true"}
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: data}, options, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		run := s.startWatchIn(step, containerID)
+		defer run.stop()
+		time.Sleep(watchSettle + 500*time.Millisecond)
+		return len(run.eventLog()) / 2
+	}
+
+	s.Equal(1, initialRuns("sh -c 'exit 1'", "abc"))
+	s.Equal(1, initialRuns("sh -c 'exit 1'", "abc"), "exiting 1 isn't a successful build")
+	s.Equal(1, initialRuns("true", "abc"))
+	s.Equal(0, initialRuns("true", "abc"), "unchanged in the same container")
+	s.Equal(1, initialRuns("true", "def"), "a new container needs its first run")
+}
+
+func (s *WatchStepSuite) TestReloadDuration() {
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 0.3", "reload": "true"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	step.status.mutex.Lock()
+	s.True(step.status.building, "in flight until the code exits")
+	step.status.mutex.Unlock()
+	run.waitForRuns(1)
+	step.status.mutex.Lock()
+	defer step.status.mutex.Unlock()
+	s.False(step.status.building)
+	s.True(step.status.lastDuration >= 300*time.Millisecond, "from the send to the exit, not %s", step.status.lastDuration)
+}
+
+func (s *WatchStepSuite) TestNotDockerTransport() {
+	options := &core.PipelineOptions{GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, options, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	ctx := core.NewEmitterContext(context.Background())
+	exit, err := step.Execute(ctx, core.NewSession(options, otherTransport{}))
+	s.Equal(-1, exit)
+	s.Equal(errNotDockerTransport, err)
+}
+
+func (s *WatchStepSuite) TestResourceLimits() {
+	step := &WatchStep{}
+	_, ok := step.resourceLimits()
+	s.False(ok)
+
+	step.config.Memory = 512 * 1024 * 1024
+	step.config.CPU = 1.5
+	opts, ok := step.resourceLimits()
+	s.True(ok)
+	s.Equal(512*1024*1024, opts.Memory)
+	s.Equal(100000, opts.CPUPeriod)
+	s.Equal(150000, opts.CPUQuota)
+}
+
+func (s *WatchStepSuite) TestLockFile() {
+	root := s.WorkingDir()
+	step := &WatchStep{options: &core.PipelineOptions{ProjectPath: root}}
+	s.False(step.locked())
+
+	step.config.LockFile = ".codegen.lock"
+	path := filepath.Join(root, ".codegen.lock")
+	s.Equal(path, step.lockFile())
+	s.False(step.locked())
+	s.Require().Nil(ioutil.WriteFile(path, nil, 0644))
+	s.True(step.locked())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	removed := waitForRemoval(clock, path, time.Second, stop)
+	clock.Advance(time.Second)
+	select {
+	case <-removed:
+		s.Fail("removed while the file exists")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.Require().Nil(os.Remove(path))
+	select {
+	case <-removed:
+		s.Fail("noticed before the next check")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		s.Fail("removal not noticed")
+	}
+}
+
+func (s *WatchStepSuite) TestReloadBackoff() {
+	none := func(n int64) int64 { return 0 }
+	all := func(n int64) int64 { return n - 1 }
+
+	s.Equal(time.Duration(0), reloadBackoff(0, time.Second, time.Minute, all))
+	s.Equal(time.Duration(0), reloadBackoff(3, 0, time.Minute, all))
+	s.Equal(500*time.Millisecond, reloadBackoff(1, time.Second, time.Minute, none))
+	s.Equal(time.Second, reloadBackoff(1, time.Second, time.Minute, all))
+	s.Equal(4*time.Second, reloadBackoff(3, time.Second, time.Minute, all))
+	s.Equal(10*time.Second, reloadBackoff(50, time.Second, 10*time.Second, all))
+	s.Equal(5*time.Second, reloadBackoff(50, time.Second, 10*time.Second, none))
+}
+
+func (s *WatchStepSuite) TestFilterOutput() {
+	step := &WatchStep{}
+	s.Equal("a\nb\n", step.filterOutput("a\nb\n"))
+
+	step.config.LogFilter = regexp.MustCompile("^(ERROR|WARN)")
+	step.config.LogExclude = regexp.MustCompile("ignored")
+	s.Equal("ERROR one\nWARN three", step.filterOutput("ERROR one\nINFO two\nERROR ignored\nWARN three"))
+	s.Equal("", step.filterOutput("INFO nothing\n"))
+}
+
+func (s *WatchStepSuite) TestWatchRoot() {
+	newStep := func(data map[string]string) *WatchStep {
+		data["code"] = "./server"
+		step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: data}, &core.PipelineOptions{ProjectPath: "/project"}, &Options{})
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		return step
+	}
+
+	step := newStep(map[string]string{})
+	s.Equal("/project", step.watchRoot())
+	s.Nil(step.Validate())
+
+	step = newStep(map[string]string{"root": "web/"})
+	s.Equal("/project/web", step.watchRoot())
+	s.Nil(step.Validate())
+
+	step = newStep(map[string]string{"root": "/project/api"})
+	s.Equal("/project/api", step.watchRoot())
+	s.Nil(step.Validate())
+
+	step = newStep(map[string]string{"root": "../shared"})
+	s.Equal("/shared", step.watchRoot())
+	s.NotNil(step.Validate())
+	s.NotNil(newStep(map[string]string{"root": "/projects"}).Validate())
+	s.Nil(newStep(map[string]string{"root": "../shared", "root-outside-project": "true"}).Validate())
+}
+
+func (s *WatchStepSuite) TestBuildCache() {
+	root := s.WorkingDir()
+	options := &core.PipelineOptions{ProjectPath: root, WorkingDir: filepath.Join(root, ".wercker")}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "make"}}, options, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "main.go"), []byte("package main"), 0644))
+	hash, err := step.treeHash(root)
+	s.Require().Nil(err)
+	s.False(step.unchangedSinceLastBuild(root, hash, "abc"))
+	s.Nil(step.recordBuild(root, hash, "abc"))
+	s.True(step.unchangedSinceLastBuild(root, hash, "abc"))
+	s.False(step.unchangedSinceLastBuild(root, hash, "def"), "a new container")
+
+	again, err := step.treeHash(root)
+	s.Nil(err)
+	s.Equal(hash, again, "the working dir isn't part of the hash")
+
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "other.go"), []byte("package main"), 0644))
+	changed, err := step.treeHash(root)
+	s.Nil(err)
+	s.NotEqual(hash, changed)
+
+	step.config.Code = "make test"
+	other, err := step.treeHash(root)
+	s.Nil(err)
+	s.NotEqual(changed, other)
+}
+
+func (s *WatchStepSuite) TestLogCycles() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server", "group-logs": "true"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.Equal(`echo "wercker-watch-exit-watch-test 1 $?"`, step.exitCommand(1), "footers need the exit code")
+	s.False(step.actsOnExit())
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	cycles := &logCycles{}
+	s.Equal("", cycles.end(start), "no cycle yet")
+	s.Equal([]string{"--- reload #1 ---"}, cycles.begin(1, nil, start))
+	cycles.exited(1, 2, start.Add(1234*time.Millisecond))
+	s.Equal([]string{
+		"--- reload #1 ran 1.2s, exited 2 ---",
+		"--- reload #2 (a.go, b.go, c.go and 2 more) ---",
+	}, cycles.begin(2, []string{"a.go", "b.go", "c.go", "d.go", "e.go"}, start.Add(2*time.Second)), "ran until it exited")
+	cycles.exited(1, 0, start.Add(3*time.Second))
+	s.Equal("--- reload #2 ran 2.2s, stopped ---", cycles.end(start.Add(4234*time.Millisecond)))
+	s.Equal("", cycles.end(start.Add(5*time.Second)), "already closed")
+}
+
+func (s *WatchStepSuite) TestRunExits() {
+	exits := newRunExits()
+	wait := exits.wait(1)
+	_, ok := exits.code(1)
+	s.False(ok)
+	exits.exited(1, 2)
+	exits.exited(1, 0)
+	select {
+	case <-wait:
+	default:
+		s.Fail("waiting before the exit")
+	}
+	code, ok := exits.code(1)
+	s.True(ok)
+	s.Equal(2, code, "the first exit counts")
+
+	exits.exited(2, 0)
+	select {
+	case <-exits.wait(2):
+	default:
+		s.Fail("waiting after the exit")
+	}
+
+	called := []int{}
+	exits.onExit(3, func(code int) { called = append(called, code) })
+	s.Empty(called)
+	exits.exited(3, 1)
+	exits.exited(3, 0)
+	exits.onExit(3, func(code int) { called = append(called, code+10) })
+	s.Equal([]int{1, 11}, called, "once, right away after the exit")
+}
+
+func (s *WatchStepSuite) TestReloadMessage() {
+	s.Equal("Reloading", reloadMessage(nil), "the interval or a webhook")
+	s.Equal("Reloading (changed: src/main.go)", reloadMessage([]string{"src/main.go"}))
+	s.Equal("Reloading (changed: a.go, b.go, c.go and 2 more)", reloadMessage([]string{"a.go", "b.go", "c.go", "d.go", "e.go"}))
+
+	changes := newChangeSet()
+	changes.add(fsnotify.Event{Name: "gone.go", Op: fsnotify.Remove})
+	s.Empty(changes.present())
+	s.Equal("Reloading (changed: gone.go)", reloadMessage(changes.paths), "only deleted")
+}
+
+func (s *WatchStepSuite) TestReloadComplete() {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	completed := []*core.WatchReloadCompleteArgs{}
+	cycles := &logCycles{completed: func(args *core.WatchReloadCompleteArgs) {
+		completed = append(completed, args)
+	}}
+	cycles.begin(1, nil, start)
+	cycles.exited(1, 2, start.Add(time.Second))
+	s.Len(completed, 1, "complete when it exits")
+	cycles.exited(1, 2, start.Add(time.Second))
+	s.Len(completed, 1, "once")
+	cycles.begin(2, []string{"a.go"}, start.Add(2*time.Second))
+	cycles.begin(3, []string{"b.go"}, start.Add(3*time.Second))
+	cycles.failed(3, errors.New("session closed"))
+	cycles.end(start.Add(4 * time.Second))
+	s.Equal([]*core.WatchReloadCompleteArgs{
+		{Reload: 1, Exited: true, ExitCode: 2, Duration: time.Second},
+		{Reload: 2, Files: []string{"a.go"}, ExitCode: -1, Duration: time.Second, Successful: true},
+		{Reload: 3, Files: []string{"b.go"}, ExitCode: -1, Duration: time.Second, Error: "session closed"},
+	}, completed)
+
+	line, err := json.Marshal(reloadCompleteEvent(completed[0]))
+	s.Nil(err)
+	s.Contains(string(line), `"reload":1,"duration":1,"exit-code":2,"successful":false}`)
+	line, err = json.Marshal(reloadCompleteEvent(completed[1]))
+	s.Nil(err)
+	s.NotContains(string(line), "exit-code", "stopped, not exited")
+}
+
+func (s *WatchStepSuite) TestAnnounceReload() {
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server", "reload": "true"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	clock := util.NewFakeClock(time.Unix(1000, 0))
+	step.clock = clock
+	options := &core.PipelineOptions{}
+	e := core.NewNormalizedEmitter()
+	e.Emit(core.BuildStarted, &core.BuildStartedArgs{Options: options})
+	started := []*core.WatchReloadStartedArgs{}
+	finished := []*core.WatchReloadFinishedArgs{}
+	e.AddListener(core.WatchReloadStarted, func(args *core.WatchReloadStartedArgs) {
+		started = append(started, args)
+	})
+	e.AddListener(core.WatchReloadFinished, func(args *core.WatchReloadFinishedArgs) {
+		finished = append(finished, args)
+	})
+
+	done := step.announceReload(e, 2, []string{"main.go"})
+	s.Equal([]*core.WatchReloadStartedArgs{{Options: options, Reload: 2, Files: []string{"main.go"}}}, started)
+	s.Empty(finished)
+	clock.Advance(1500 * time.Millisecond)
+	done(errors.New("session closed"), nil)
+	s.Equal([]*core.WatchReloadFinishedArgs{{Options: options, Reload: 2, Files: []string{"main.go"}, Duration: 1500 * time.Millisecond, ExitCode: -1, Error: "session closed"}}, finished)
+
+	finished = finished[:0]
+	done = step.announceReload(e, 3, nil)
+	clock.Advance(time.Second)
+	code := 3
+	done(nil, &code)
+	s.Equal([]*core.WatchReloadFinishedArgs{{Options: options, Reload: 3, Duration: time.Second, Exited: true, ExitCode: 3}}, finished)
+}
+
+func (s *WatchStepSuite) TestReloadFinishedOnExit() {
+	options := &core.PipelineOptions{ProjectPath: s.WorkingDir(), GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 0.5; sh -c 'exit 3'", "reload": "true"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	run.waitForReloads(1)
+	time.Sleep(200 * time.Millisecond)
+	run.mutex.Lock()
+	s.Empty(run.finished, "not while the code runs")
+	run.mutex.Unlock()
+	var finished []*core.WatchReloadFinishedArgs
+	run.waitFor("reload-finished", func() bool {
+		finished = append([]*core.WatchReloadFinishedArgs{}, run.finished...)
+		return len(finished) > 0
+	})
+	s.Equal(1, finished[0].Reload)
+	s.True(finished[0].Exited)
+	s.Equal(3, finished[0].ExitCode)
+	s.True(finished[0].Duration >= 500*time.Millisecond, "until the exit, got %s", finished[0].Duration)
+}
+
+func (s *WatchStepSuite) TestCommandExits() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "go test ./..."}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.Equal(`echo "wercker-watch-exit-watch-test 1 $?"`, step.exitCommand(1), "reported even when waiting")
+	s.Equal([]string{"set +e", "{ go test ./...\n}; echo \"wercker-watch-exit-watch-test 1 $?\""}, step.reloadCommands(1))
+
+	step.config.OnExit = onExitFinish
+	s.Equal(`echo "wercker-watch-exit-watch-test 3 $?"`, step.exitCommand(3))
+	s.Contains(step.reloadCommands(3)[1], "{ go test ./...\n}; ")
+
+	output, exits := step.parseCommandExits("ok  pkg\nwercker-watch-exit-watch-test 3 1\nmore\n")
+	s.Equal("ok  pkg\nmore\n", output)
+	s.Equal([]commandExit{{reload: 3, code: 1}}, exits)
+
+	output, exits = step.parseCommandExits("wercker-watch-exit-other 3 1\n")
+	s.Equal("wercker-watch-exit-other 3 1\n", output)
+	s.Nil(exits)
+
+	// A run we killed for a reload doesn't count
+	status := &watchStatus{}
+	s.True(status.current(status.startReload()))
+	status.supersede()
+	s.False(status.current(1))
+	s.True(status.current(status.startReload()))
+	s.False(status.current(1))
+}
+
+func (s *WatchStepSuite) TestExitCode() {
+	status := &watchStatus{}
+	_, ok := status.exitCode()
+	s.False(ok, "still running")
+
+	reload := status.startReload()
+	s.True(status.exited(reload, 3))
+	code, ok := status.exitCode()
+	s.True(ok)
+	s.Equal(3, code)
+
+	status.supersede()
+	reload = status.startReload()
+	s.False(status.exited(1, 130), "killed for the reload")
+	_, ok = status.exitCode()
+	s.False(ok, "a new run starts over")
+	s.True(status.exited(reload, 0))
+	code, _ = status.exitCode()
+	s.Equal(0, code)
+}
+
+func (s *WatchStepSuite) TestPortForwarder() {
+	s.True(isLocalHostURI("localhost:8080"))
+	s.True(isLocalHostURI("127.0.0.1:8080"))
+	s.False(isLocalHostURI("192.168.99.100:8080"))
+
+	// stands in for the port docker publishes on its host
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().Nil(err)
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	forwards := newPortForwarder(util.RootLogger().WithField("Logger", "Test"))
+	echo := func(local, message string) (string, error) {
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, message)
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+	for _, message := range []string{"first run", "after the reload"} {
+		local, err := forwards.forward("127.0.0.1:0", server.Addr().String())
+		s.Require().Nil(err)
+		second, err := forwards.forward("127.0.0.1:0", server.Addr().String())
+		s.Require().Nil(err, "more than one port")
+		reply, err := echo(local, message)
+		s.Nil(err)
+		s.Equal(message+"\n", reply)
+		_, err = echo(second, message)
+		s.Nil(err)
+
+		forwards.stop()
+		_, err = net.Dial("tcp", local)
+		s.NotNil(err, "torn down")
+	}
+	var stopped *portForwarder
+	stopped.stop()
+}
+
+func (s *WatchStepSuite) TestKillGroup() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "npm start", "kill-group": "true"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	cmds := step.reloadCommands(1)
+	s.Contains(cmds[1], `setsid sh -c 'npm start' & echo $! > '/tmp/wercker-watch-watch-test.pgid'; wait $!`)
+
+	cmd := step.killCommand("TERM")
+	s.Contains(cmd, "kill -s TERM -- -$pgid")
+	s.Contains(cmd, step.killAllCommand("TERM"), "falls back to killing everything")
+	s.Equal([]string{"-42"}, parseKilledPids("-42\n"))
+}
+
+// scriptedKillClient echoes the PID for every signal and keeps it alive
+// through the first alive checks
+type scriptedKillClient struct {
+	fakeWatchClient
+	signals []string
+	alive   int
+	checked func()
+}
+
+func (c *scriptedKillClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	script := cmd[len(cmd)-1]
+	if strings.Contains(script, "kill -s 0 ") {
+		if c.checked != nil {
+			c.checked()
+		}
+		if c.alive > 0 {
+			c.alive--
+			fmt.Fprintln(output, "12")
+		}
+		return nil
+	}
+	for _, signal := range []string{"INT", "TERM", "KILL"} {
+		if strings.Contains(script, "kill -s "+signal+" ") {
+			c.signals = append(c.signals, signal)
+		}
+	}
+	fmt.Fprintln(output, "12")
+	return nil
+}
+
+func (c *scriptedKillClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	codes := []int{}
+	for _, cmd := range cmds {
+		if err := c.ExecOne(containerID, cmd, output); err != nil {
+			return codes, err
+		}
+		codes = append(codes, 0)
+	}
+	return codes, nil
+}
+
+// procLessClient is a container without /proc, the ps fallback still works
+type procLessClient struct {
+	fakeWatchClient
+	scripts []string
+}
+
+func (c *procLessClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	c.scripts = append(c.scripts, cmd[len(cmd)-1])
+	fmt.Fprintln(output, "12")
+	return nil
+}
+
+func (c *procLessClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	c.scripts = append(c.scripts, cmds[0][len(cmds[0])-1])
+	return []int{procUnavailable}, nil
+}
+
+// shellLessClient is a distroless container, docker top works and kill is
+// there but /bin/sh isn't. KILL takes everything but PID 1 down.
+type shellLessClient struct {
+	fakeWatchClient
+	noKill bool
+	cmds   [][]string
+}
+
+func (c *shellLessClient) InspectContainer(id string) (*docker.Container, error) {
+	return &docker.Container{ID: id, State: docker.State{Pid: 100}}, nil
+}
+
+func (c *shellLessClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	c.cmds = append(c.cmds, cmds[0])
+	if cmds[0][0] == "/bin/sh" || c.noKill {
+		return nil, fmt.Errorf("exec: %q: executable file not found in $PATH", cmds[0][0])
+	}
+	if cmds[0][2] == "KILL" {
+		c.top.Processes = c.top.Processes[:1]
+	}
+	return []int{0}, nil
+}
+
+func (c *shellLessClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	_, err := c.ExecAll(containerID, [][]string{cmd}, output)
+	return err
+}
+
+func (s *WatchStepSuite) TestSignalWithoutShell() {
+	sequence, err := parseKillSequence("INT:1ms,KILL")
+	s.Require().Nil(err)
+	newClient := func() *shellLessClient {
+		return &shellLessClient{fakeWatchClient: fakeWatchClient{top: &docker.TopResult{
+			Titles:    []string{"UID", "PID", "PPID", "CMD"},
+			Processes: [][]string{{"root", "100", "99", "/bin/sh"}, {"root", "120", "100", "./server"}, {"root", "121", "120", "worker"}},
+		}}}
+	}
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	step.config.KillSequence = sequence
+	client := newClient()
+	step.client = client
+
+	sent, err := step.signalProcesses("container", "TERM")
+	s.Nil(err)
+	s.Equal(signalled{pids: []string{"120", "121"}, top: true}, sent, "PID 1 is left out")
+	s.Equal([][]string{{"kill", "-s", "TERM", "--", "-1"}}, client.cmds)
+
+	// INT doesn't get them, KILL does and the wait sees that through top
+	client = newClient()
+	step.client = client
+	s.Nil(step.stopProcesses("container"))
+	s.Equal([][]string{{"kill", "-s", "INT", "--", "-1"}, {"kill", "-s", "KILL", "--", "-1"}}, client.cmds)
+
+	// Nothing but PID 1, nothing to run
+	client = newClient()
+	client.top.Processes = client.top.Processes[:1]
+	step.client = client
+	sent, err = step.signalProcesses("container", "TERM")
+	s.Nil(err)
+	s.Empty(sent.pids)
+	s.Empty(client.cmds)
+
+	// Without kill, or with kill-group, it's the shell or nothing
+	client = newClient()
+	client.noKill = true
+	step.client = client
+	_, err = step.signalProcesses("container", "TERM")
+	s.NotNil(err)
+	s.Equal("/bin/sh", client.cmds[len(client.cmds)-1][0], "falls back to the shell")
+
+	client = newClient()
+	step.client = client
+	step.config.KillGroup = true
+	_, err = step.signalProcesses("container", "TERM")
+	s.NotNil(err)
+	s.Equal("/bin/sh", client.cmds[0][0], "kill-group needs the shell")
+}
+
+func (s *WatchStepSuite) TestForwardInput() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "python", "interactive": "true"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	sent := []string{}
+	send := func(line string) error {
+		sent = append(sent, line)
+		return nil
+	}
+	step.forwardInput(strings.NewReader("before\n"), send, nil)
+	s.Empty(sent, "nothing runs yet, the shell would run it")
+
+	reload := step.status.startReload()
+	step.forwardInput(strings.NewReader("1 + 1\nprint(2)"), send, nil)
+	s.Equal([]string{"1 + 1", "print(2)"}, sent, "a last line without newline still goes")
+
+	step.status.exited(reload, 0)
+	step.forwardInput(strings.NewReader("after\n"), send, nil)
+	s.Len(sent, 2, "the code exited")
+
+	step.status.startReload()
+	step.forwardInput(strings.NewReader("a\nb\n"), func(line string) error {
+		sent = append(sent, line)
+		return errors.New("session gone")
+	}, nil)
+	s.Equal("a", sent[len(sent)-1], "stops at the first failing send")
+	s.Len(sent, 3)
+
+	stop := make(chan struct{})
+	close(stop)
+	step.forwardInput(strings.NewReader("late\n"), send, stop)
+	s.Len(sent, 3, "stopped")
+}
+
+func (s *WatchStepSuite) TestExitLineNotInput() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": `echo ready; read line; echo "got $line"`, "interactive": "true"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	// The session shell gets the reload, then what's typed once the code
+	// runs, the code reads the typed line and the exit line reaches the
+	// shell. bash reads a pipe a byte at a time so it leaves the rest of the
+	// input to the code, sh buffers it.
+	for _, shell := range []string{"sh", "bash"} {
+		if _, err := exec.LookPath(shell); err != nil {
+			continue
+		}
+		cmd := exec.Command(shell)
+		stdin, err := cmd.StdinPipe()
+		s.Require().Nil(err)
+		stdout, err := cmd.StdoutPipe()
+		s.Require().Nil(err)
+		s.Require().Nil(cmd.Start())
+		defer cmd.Process.Kill()
+		_, err = io.WriteString(stdin, strings.Join(step.reloadCommands(1), "\n")+"\n")
+		s.Require().Nil(err)
+
+		lines := bufio.NewScanner(stdout)
+		s.Require().True(lines.Scan(), shell)
+		s.Equal("ready", lines.Text(), shell)
+		_, err = io.WriteString(stdin, "typed\n")
+		s.Require().Nil(err)
+		s.Require().True(lines.Scan(), shell)
+		s.Require().Equal("got typed", lines.Text(), shell)
+		s.Require().True(lines.Scan(), shell)
+		s.Equal("wercker-watch-exit-watch-test 1 0", lines.Text(), shell)
+		stdin.Close()
+		s.Nil(cmd.Wait(), shell)
+	}
+}
+
+func (s *WatchStepSuite) TestProcKillCommand() {
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, &core.PipelineOptions{}, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.NotContains(step.procKillCommand("TERM"), "ps")
+
+	// Signal 0 only checks the processes exist, it's safe to run here. Our
+	// own PID is kept through a pid file, the shell leaves itself out.
+	pidfile := filepath.Join(s.WorkingDir(), "test.pid")
+	s.Require().Nil(ioutil.WriteFile(pidfile, []byte(fmt.Sprint(os.Getpid())), 0644))
+	step.config.KeepPidfiles = []string{pidfile, filepath.Join(s.WorkingDir(), "missing.pid")}
+	for _, group := range []bool{false, true} {
+		step.config.KillGroup = group
+		cmd := exec.Command("sh", "-c", step.procKillCommand("0"))
+		output, err := cmd.Output()
+		s.Require().Nil(err, "kill-group %t", group)
+		pids := parseKilledPids(string(output))
+		s.NotEmpty(pids)
+		s.NotContains(pids, "1")
+		s.NotContains(pids, fmt.Sprint(os.Getpid()), "kept")
+		s.NotContains(pids, fmt.Sprint(cmd.Process.Pid), "the shell itself")
+	}
+
+	client := &procLessClient{}
+	step.client = client
+	step.config.KillGroup = false
+	sent, err := step.signalProcesses("container", "TERM")
+	s.Nil(err)
+	s.Equal([]string{"12"}, sent.pids)
+	s.Equal([]string{step.procKillCommand("TERM"), step.killCommand("TERM")}, client.scripts, "falls back to ps")
+}
+
+func (s *WatchStepSuite) TestStopProcesses() {
+	sequence, err := parseKillSequence("INT:1ms,TERM:1ms,KILL")
+	s.Require().Nil(err)
+
+	client := &scriptedKillClient{alive: 100}
+	step := &WatchStep{client: client, clock: util.RealClock, logger: util.RootLogger().WithField("Logger", "Test")}
+	step.config.KillSequence = sequence
+	s.Nil(step.stopProcesses("container"))
+	s.Equal([]string{"INT", "TERM", "KILL"}, client.signals)
+
+	client = &scriptedKillClient{}
+	step.client = client
+	s.Nil(step.stopProcesses("container"))
+	s.Equal([]string{"INT"}, client.signals, "nothing is left after INT")
+
+	client = &scriptedKillClient{alive: 100}
+	step.client = client
+	step.config.KillSequence = []killStep{{Signal: "INT"}}
+	s.Nil(step.stopProcesses("container"))
+	s.Equal([]string{"INT"}, client.signals, "a single signal doesn't escalate")
+}
+
+// localExecClient runs the execs here, as if this machine was the container
+type localExecClient struct {
+	fakeWatchClient
+}
+
+func (c *localExecClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	run := exec.Command(cmd[0], cmd[1:]...)
+	run.Stdout = output
+	if err := run.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WatchStepSuite) TestStopGroup() {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		s.T().Skip("no setsid")
+	}
+	sequence, err := parseKillSequence("INT:200ms,KILL")
+	s.Require().Nil(err)
+	step := &WatchStep{client: &localExecClient{}, clock: util.RealClock, logger: util.RootLogger().WithField("Logger", "Test")}
+	step.config.KillSequence = sequence
+	group := WatchGroup{Name: fmt.Sprintf("test-%d", os.Getpid()), Command: "trap '' INT; while true; do sleep 0.05; done"}
+	defer os.Remove(group.pidfile())
+
+	// Nothing ran yet, there's nothing to stop
+	s.Nil(step.stopGroup("container", group))
+
+	s.Require().Nil(exec.Command("sh", "-c", group.reloadCommand()).Run())
+	var pgid int
+	for deadline := time.Now().Add(5 * time.Second); pgid == 0; time.Sleep(10 * time.Millisecond) {
+		s.Require().True(time.Now().Before(deadline), "the group never started")
+		data, _ := ioutil.ReadFile(group.pidfile())
+		pgid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	defer syscall.Kill(-pgid, syscall.SIGKILL)
+
+	start := time.Now()
+	s.Nil(step.stopGroup("container", group))
+	s.True(time.Since(start) >= 200*time.Millisecond, "INT is ignored, KILL comes after the wait")
+	gone := false
+	for deadline := time.Now().Add(5 * time.Second); !gone && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		// Nothing may reap it here, a zombie is gone too
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pgid))
+		gone = err != nil || strings.Contains(string(stat), ") Z ")
+	}
+	s.True(gone, "the group's processes are gone")
+}
+
+func (s *WatchStepSuite) TestForceStop() {
+	sequence, err := parseKillSequence("INT:1h,TERM:1h,KILL")
+	s.Require().Nil(err)
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	step.config.KillSequence = sequence
+
+	// A second Ctrl-C while we wait for the code to go after INT
+	client := &scriptedKillClient{alive: 100, checked: step.forceStop}
+	step.client = client
+	s.Nil(step.stopProcesses("container"))
+	s.Equal([]string{"INT", "KILL"}, client.signals, "doesn't wait the hour")
+
+	client = &scriptedKillClient{alive: 100}
+	step.client = client
+	step.forceStop()
+	s.Nil(step.stopProcesses("container"))
+	s.Equal([]string{"KILL"}, client.signals, "forced before stopping started")
+}
+
+func (s *WatchStepSuite) TestStopWatchHandler() {
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	finishedStep := make(chan struct{}, 1)
+	handler := step.stopWatchHandler(finishedStep)
+	s.True(handler.Persistent)
+
+	s.False(handler.F(), "the step finishes itself")
+	s.Len(finishedStep, 1)
+	select {
+	case <-step.forced:
+		s.Fail("not forced yet")
+	default:
+	}
+
+	s.True(handler.F(), "the cleanup handlers run on the second")
+	s.Len(finishedStep, 1, "finishes only once")
+	select {
+	case <-step.forced:
+	default:
+		s.Fail("the code is killed")
+	}
+}
+
+func (s *WatchStepSuite) TestStopWatchHandlerDoesntBlock() {
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, &core.PipelineOptions{}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	// Nobody reads it, like a loop busy with a reload
+	monkey := util.NewSignalMonkey()
+	monkey.Add(step.stopWatchHandler(make(chan struct{})))
+
+	dispatched := make(chan struct{})
+	go func() {
+		monkey.Dispatch()
+		monkey.Dispatch()
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		s.Require().FailNow("the first Ctrl-C kept the second from being handled")
+	}
+	select {
+	case <-step.forced:
+	default:
+		s.Fail("the second Ctrl-C kills the code")
+	}
+}
+
+func (s *WatchStepSuite) TestParseInotifyLine() {
+	event, ok := parseInotifyLine("CLOSE_WRITE,CLOSE /srv/app/main.go\n")
+	s.True(ok)
+	s.Equal(fsnotify.Event{Name: "/srv/app/main.go", Op: fsnotify.Write}, event)
+
+	event, ok = parseInotifyLine("MOVED_TO /srv/app/new name.go")
+	s.True(ok)
+	s.Equal(fsnotify.Event{Name: "/srv/app/new name.go", Op: fsnotify.Create}, event)
+
+	_, ok = parseInotifyLine("OPEN /srv/app/main.go")
+	s.False(ok)
+	_, ok = parseInotifyLine("garbage")
+	s.False(ok)
+
+	step := &WatchStep{config: WatchConfig{SSHHost: "dev@box", SSHPath: "/srv/app", SSHKey: "~/.ssh/dev"}}
+	args := step.sshArgs()
+	s.Equal("dev@box", args[len(args)-2])
+	s.Contains(args[len(args)-1], "'/srv/app'")
+	s.Contains(strings.Join(args, " "), "-i ~/.ssh/dev")
+}
+
+func (s *WatchStepSuite) TestEventSocket() {
+	path := filepath.Join(s.WorkingDir(), "events.sock")
+	sock, err := listenEventSocket(path)
+	s.Require().Nil(err)
+
+	conn, err := net.Dial("unix", path)
+	s.Require().Nil(err)
+	defer conn.Close()
+	// Give accept a moment to pick the client up
+	for i := 0; i < 100; i++ {
+		sock.mutex.Lock()
+		n := len(sock.clients)
+		sock.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sock.publish(socketEvent{Type: socketChanged, Files: []string{"main.go"}})
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	s.Require().Nil(err)
+	s.Contains(line, `"type":"changed"`)
+	s.Contains(line, `"files":["main.go"]`)
+
+	s.Nil(sock.Close())
+	_, err = os.Stat(path)
+	s.True(os.IsNotExist(err), "socket file is removed")
+
+	// A socket left behind is replaced, other files are not
+	var none *eventSocket
+	none.publish(socketEvent{Type: socketError})
+	s.Require().Nil(ioutil.WriteFile(path, nil, 0644))
+	_, err = listenEventSocket(path)
+	s.NotNil(err)
+}
+
+func (s *WatchStepSuite) TestEventSocketFinishedOnExit() {
+	root := s.WorkingDir()
+	path := filepath.Join(root, "events.sock")
+	options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "sleep 0.5; sh -c 'exit 3'", "reload": "true", "event-socket": path, "ignore-writes": "events.sock"}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+
+	run := s.startWatch(step)
+	defer run.stop()
+	conn, err := net.Dial("unix", path)
+	s.Require().Nil(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		s.Require().Nil(err)
+		event := socketEvent{}
+		s.Require().Nil(json.Unmarshal([]byte(line), &event))
+		if event.Type != socketReloadFinished {
+			continue
+		}
+		s.Require().NotNil(event.ExitCode, line)
+		s.Equal(3, *event.ExitCode)
+		s.True(event.Duration >= 0.5, "until the exit, got %v", event.Duration)
+		return
+	}
+}
+
+func (s *WatchStepSuite) TestPerFileCommand() {
+	newStep := func(data map[string]string) *WatchStep {
+		data["code"] = "go test ./..."
+		step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: data}, &core.PipelineOptions{ProjectPath: "/project"}, &Options{}, StaticIDSource("test"))
+		s.Require().Nil(err)
+		step.InitEnv(nil)
+		s.Require().Nil(step.Validate())
+		return step
+	}
+	withExit := func(reload int, cmd string) string {
+		return fmt.Sprintf("{ %s\n}; echo \"wercker-watch-exit-watch-test %d $?\"", cmd, reload)
+	}
+
+	step := newStep(map[string]string{"per-file-command": "go test {{.File}}"})
+	s.Equal([]string{"set +e", withExit(1, "go test ./...")}, step.reloadCommands(1), "the first build runs the code")
+	files := step.projectRelative([]string{"/project/a/a_test.go", "/elsewhere/b.go", "/project/it's_test.go"})
+	s.Equal([]string{"a/a_test.go", "it's_test.go"}, files)
+	s.Equal([]string{"set +e", withExit(2, `go test 'a/a_test.go' 'it'\''s_test.go'`)}, step.reloadCommands(2, files...))
+
+	step = newStep(map[string]string{"per-file-command": "go test {{.File}}", "per-file-mode": "each"})
+	s.Equal([]string{"set +e", withExit(2, "go test 'a.go'; go test 'b.go'")}, step.reloadCommands(2, "a.go", "b.go"))
+
+	var pending reloadFiles
+	pending.add([]string{"a.go", "b.go"})
+	pending.add([]string{"b.go", "c.go"})
+	s.Equal([]string{"a.go", "b.go", "c.go"}, pending.take())
+	s.Nil(pending.take())
+
+	changes := newChangeSet()
+	changes.add(fsnotify.Event{Name: "/project/a.go", Op: fsnotify.Write})
+	changes.add(fsnotify.Event{Name: "/project/gone.go", Op: fsnotify.Remove})
+	s.Equal([]string{"/project/a.go"}, changes.present())
+}
+
+func (s *WatchStepSuite) TestValidatePublishedPorts() {
+	s.Nil(validatePublishedPorts(nil))
+	s.Nil(validatePublishedPorts([]string{"8080", "5000:80", "127.0.0.1:5000:80/udp", ":80"}))
+
+	for _, bad := range []string{"http", "80:web", "1:2:3:4", "host:5000:80", "70000"} {
+		s.NotNil(validatePublishedPorts([]string{bad}), bad)
+	}
+
+	step, err := NewWatchStep(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"code": "./server"}}, &core.PipelineOptions{PublishPorts: []string{"80:web"}}, &Options{})
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	s.NotNil(step.Validate())
+}
+
+// fakeFileWatcher is a fileWatcher the test hands the events to
+type fakeFileWatcher struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func newFakeFileWatcher() *fakeFileWatcher {
+	return &fakeFileWatcher{events: make(chan fsnotify.Event), errors: make(chan error)}
+}
+
+func (w *fakeFileWatcher) Add(name string) error         { return nil }
+func (w *fakeFileWatcher) Remove(name string) error      { return nil }
+func (w *fakeFileWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *fakeFileWatcher) Errors() <-chan error          { return w.errors }
+func (w *fakeFileWatcher) Close() error                  { return nil }
+
+// recordingTransport keeps the lines the step sends to the container
+type recordingTransport struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (t *recordingTransport) Attach(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (context.Context, error) {
+	go func() {
+		lines := bufio.NewScanner(stdin)
+		for lines.Scan() {
+			t.mutex.Lock()
+			t.lines = append(t.lines, lines.Text())
+			t.mutex.Unlock()
+		}
+	}()
+	return ctx, nil
+}
+
+// count is how often line was sent
+func (t *recordingTransport) count(line string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n := 0
+	for _, sent := range t.lines {
+		if sent == line {
+			n++
+		}
+	}
+	return n
+}
+
+// groupsClient records the execs of the groups loop. Stopping the group
+// named hold blocks once, until release is closed.
+type groupsClient struct {
+	fakeWatchClient
+	mutex   sync.Mutex
+	scripts []string
+	hold    string
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (c *groupsClient) ExecOne(containerID string, cmd []string, output io.Writer) error {
+	script := cmd[len(cmd)-1]
+	c.mutex.Lock()
+	c.scripts = append(c.scripts, script)
+	hold := c.hold
+	if hold != "" && strings.Contains(script, WatchGroup{Name: hold}.pidfile()) {
+		c.hold = ""
+	} else {
+		hold = ""
+	}
+	c.mutex.Unlock()
+	if hold != "" {
+		close(c.held)
+		<-c.release
+	}
+	return nil
+}
+
+func (c *groupsClient) ExecAll(containerID string, cmds [][]string, output io.Writer) ([]int, error) {
+	codes := []int{}
+	for _, cmd := range cmds {
+		c.ExecOne(containerID, cmd, output)
+		codes = append(codes, 0)
+	}
+	return codes, nil
+}
+
+func (c *groupsClient) ran(script string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, ran := range c.scripts {
+		if ran == script {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsRun is executeGroups running against a fake watcher and clock
+type groupsRun struct {
+	suite     *WatchStepSuite
+	step      *WatchStep
+	root      string
+	clock     *util.FakeClock
+	watcher   *fakeFileWatcher
+	transport *recordingTransport
+	client    *groupsClient
+	logs      *lockedBuffer
+	finish    chan struct{}
+	done      chan struct{}
+	exit      int
+	err       error
+}
+
+func (s *WatchStepSuite) startGroups(groups string) *groupsRun {
+	root := s.WorkingDir()
+	for _, dir := range []string{"api", "web", "docs"} {
+		s.Require().Nil(os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	options := &core.PipelineOptions{ProjectPath: root, GlobalOptions: &core.GlobalOptions{}}
+	step, err := NewWatchStepWithIDs(&core.StepConfig{ID: "internal/watch", Data: map[string]string{"reload": "true", "groups": groups}}, options, &Options{}, StaticIDSource("test"))
+	s.Require().Nil(err)
+	step.InitEnv(nil)
+	run := &groupsRun{
+		suite:     s,
+		step:      step,
+		root:      root,
+		clock:     util.NewFakeClock(time.Now()),
+		watcher:   newFakeFileWatcher(),
+		transport: &recordingTransport{},
+		client:    &groupsClient{},
+		logs:      &lockedBuffer{},
+		finish:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	step.clock = run.clock
+	step.client = run.client
+	logger := util.NewLogger()
+	logger.Out = run.logs
+	step.logger = logger.WithField("Logger", "Test")
+
+	sess := core.NewSession(options, run.transport)
+	ctx, err := sess.Attach(core.NewEmitterContext(context.Background()))
+	s.Require().Nil(err)
+	go func() {
+		run.exit, run.err = step.executeGroups(ctx, sess, run.watcher, run.finish, "container", &util.Formatter{})
+		close(run.done)
+	}()
+	select {
+	case <-step.Ready():
+	case <-time.After(5 * time.Second):
+		s.Require().FailNow("the groups loop didn't start")
+	}
+	return run
+}
+
+// reloads is how often group was started
+func (r *groupsRun) reloads(group string) int {
+	for _, g := range r.step.config.Groups {
+		if g.Name == group {
+			return r.transport.count(g.reloadCommand())
+		}
+	}
+	return 0
+}
+
+// waitFor moves the clock along until ok, so debouncers fire
+func (r *groupsRun) waitFor(what string, ok func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			r.suite.Require().FailNow("timed out waiting for "+what, r.logs.String())
+		}
+		r.clock.Advance(watchDebounce)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// settle moves the clock well past every debouncer and gives the loop a
+// moment, for checking nothing happens
+func (r *groupsRun) settle() {
+	for i := 0; i < 5; i++ {
+		r.clock.Advance(watchDebounce)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// change writes a file and hands its event to the loop
+func (r *groupsRun) change(rel string) {
+	path := filepath.Join(r.root, rel)
+	r.suite.Require().Nil(ioutil.WriteFile(path, []byte(rel), 0644))
+	select {
+	case r.watcher.events <- fsnotify.Event{Name: path, Op: fsnotify.Write}:
+	case <-time.After(5 * time.Second):
+		r.suite.Require().FailNow("the loop didn't take the event for " + rel)
+	}
+}
+
+func (r *groupsRun) wait() {
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		r.suite.Require().FailNow("executeGroups didn't return")
+	}
+}
+
+const testGroups = `[{"name": "api", "paths": ["api"], "command": "./api"}, {"name": "web", "paths": ["web"], "command": "npm start"}]`
+
+func (s *WatchStepSuite) TestGroupsRouting() {
+	run := s.startGroups(testGroups)
+	run.waitFor("every group to start", func() bool { return run.reloads("api") == 1 && run.reloads("web") == 1 })
+
+	run.change("api/server.go")
+	run.waitFor("api to reload", func() bool { return run.reloads("api") == 2 })
+	run.settle()
+	s.Equal(1, run.reloads("web"), "web isn't affected")
+
+	// Outside every group nothing reloads
+	run.change("docs/README.md")
+	run.settle()
+	s.Equal(2, run.reloads("api"))
+	s.Equal(1, run.reloads("web"))
+
+	run.change("web/index.js")
+	run.waitFor("web to reload", func() bool { return run.reloads("web") == 2 })
+	s.Equal(2, run.reloads("api"))
+
+	close(run.finish)
+	run.wait()
+	s.Equal(0, run.exit)
+	s.Nil(run.err)
+}
+
+func (s *WatchStepSuite) TestGroupsCollapsePending() {
+	run := s.startGroups(testGroups)
+	run.waitFor("every group to start", func() bool { return run.reloads("api") == 1 && run.reloads("web") == 1 })
+
+	// Stopping api's run for the next reload hangs, the reload is in flight
+	run.client.mutex.Lock()
+	run.client.hold = "api"
+	run.client.held = make(chan struct{})
+	run.client.release = make(chan struct{})
+	run.client.mutex.Unlock()
+	run.change("api/server.go")
+	run.waitFor("api's reload to start", func() bool {
+		select {
+		case <-run.client.held:
+			return true
+		default:
+			return false
+		}
+	})
+
+	// Every change meanwhile adds up to one more reload
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		run.change("api/" + name)
+		run.settle()
+	}
+	// Other groups aren't held up
+	run.change("web/index.js")
+	run.waitFor("web to reload", func() bool { return run.reloads("web") == 2 })
+
+	close(run.client.release)
+	run.waitFor("the held and the pending reload", func() bool { return run.reloads("api") == 3 })
+	run.settle()
+	s.Equal(3, run.reloads("api"), "the changes in flight collapse into one reload")
+
+	close(run.finish)
+	run.wait()
+}
+
+func (s *WatchStepSuite) TestGroupsPause() {
+	run := s.startGroups(testGroups)
+	run.waitFor("every group to start", func() bool { return run.reloads("api") == 1 && run.reloads("web") == 1 })
+	toggle := func(logged string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for n := strings.Count(run.logs.String(), logged); strings.Count(run.logs.String(), logged) == n; time.Sleep(10 * time.Millisecond) {
+			s.Require().True(time.Now().Before(deadline), "never "+logged)
+			util.GlobalSigusr2().Dispatch()
+		}
+	}
+
+	toggle("Paused")
+	run.change("api/server.go")
+	run.change("api/other.go")
+	run.settle()
+	s.Equal(1, run.reloads("api"), "paused")
+
+	toggle("Resumed")
+	run.waitFor("api to reload on resume", func() bool { return run.reloads("api") == 2 })
+	run.settle()
+	s.Equal(2, run.reloads("api"), "once for everything while paused")
+	s.Equal(1, run.reloads("web"))
+
+	close(run.finish)
+	run.wait()
+}
+
+func (s *WatchStepSuite) TestGroupsTeardown() {
+	everything := &WatchStep{}
+	everything.config.KillSequence = timeoutKillSequence(stopSignal, defaultKillTimeout)
+	stopAll := everything.procKillCommand(stopSignal)
+
+	for _, end := range []string{"finish", "error", "closed"} {
+		run := s.startGroups(testGroups)
+		run.waitFor("every group to start", func() bool { return run.reloads("api") == 1 && run.reloads("web") == 1 })
+		switch end {
+		case "finish":
+			close(run.finish)
+		case "error":
+			run.watcher.errors <- errors.New("inotify went away")
+		case "closed":
+			close(run.watcher.events)
+		}
+		run.wait()
+		s.True(run.client.ran(stopAll), "%s: everything is stopped", end)
+
+		// The groups are gone, nothing reloads anymore
+		run.settle()
+		s.Equal(1, run.reloads("api"), end)
+		s.Equal(1, run.reloads("web"), end)
+
+		switch end {
+		case "finish":
+			s.Equal(0, run.exit)
+			s.Nil(run.err)
+		case "error":
+			s.Equal(-1, run.exit)
+			s.EqualError(run.err, "inotify went away")
+		case "closed":
+			s.Equal(-1, run.exit)
+			s.Equal(errWatcherClosed, run.err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ttyExecFailed is the exit code we report for code we couldn't start on a
+// terminal, the one shells use for a command they can't execute
+const ttyExecFailed = 126
+
+// With tty the code runs in a docker exec of its own that has a pseudo-TTY,
+// our session to the container is a plain pipe and plenty of tools turn off
+// colors and progress output without a terminal. Our shell still does
+// everything up to the code, setup included, then writes down its
+// environment and directory and says it's ready with ttySentinel. That's
+// when we start the exec, which picks the environment and directory up and
+// runs the code. Its output and the exit line we make up for it go through
+// the same listener as the session's.
+
+// ttyScripts keeps the script of each reload that runs on a terminal until
+// our shell is ready for it
+type ttyScripts struct {
+	mutex   sync.Mutex
+	scripts map[int]string
+}
+
+func (t *ttyScripts) add(reload int, script string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.scripts == nil {
+		t.scripts = map[int]string{}
+	}
+	t.scripts[reload] = script
+}
+
+// take hands out the script of reload once
+func (t *ttyScripts) take(reload int) (string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	script, ok := t.scripts[reload]
+	delete(t.scripts, reload)
+	return script, ok
+}
+
+// ttySentinel marks the line our shell prints once a reload's code can be
+// started on a terminal
+func (s *WatchStep) ttySentinel() string {
+	return "wercker-watch-tty-" + s.SafeID()
+}
+
+// ttyStateFile is where our shell leaves its environment or directory for
+// the exec of reload
+func (s *WatchStep) ttyStateFile(reload int, kind string) string {
+	return fmt.Sprintf("/tmp/wercker-watch-%s.tty-%d.%s", s.SafeID(), reload, kind)
+}
+
+// ttyCommand is the line our shell runs for reload instead of cmd, it
+// keeps cmd for the exec. The shell only prints an exit line if setup
+// fails, otherwise the exec's exit is the run's.
+func (s *WatchStep) ttyCommand(reload int, cmd string) string {
+	if s.config.KillGroup {
+		cmd = s.groupCommand(cmd)
+	}
+	env := shellQuote(s.ttyStateFile(reload, "env"))
+	dir := shellQuote(s.ttyStateFile(reload, "dir"))
+	s.ttyScripts.add(reload, fmt.Sprintf(". %[1]s; cd \"$(cat %[2]s)\"; rm -f %[1]s %[2]s\n%[3]s", env, dir, cmd))
+	handoff := fmt.Sprintf(`export -p > %s; pwd > %s; echo "%s %d"`, env, dir, s.ttySentinel(), reload)
+	return fmt.Sprintf("{ %s\n} || %s", s.setupCommand(reload, handoff), s.exitCommand(reload))
+}
+
+// parseTTYStarts takes the ttySentinel lines out of some output and returns
+// the reloads they are for
+func (s *WatchStep) parseTTYStarts(output string) (string, []int) {
+	sentinel := s.ttySentinel()
+	if !strings.Contains(output, sentinel) {
+		return output, nil
+	}
+	kept := []string{}
+	reloads := []int{}
+	for _, line := range strings.SplitAfter(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == sentinel {
+			if reload, err := strconv.Atoi(fields[1]); err == nil {
+				reloads = append(reloads, reload)
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, ""), reloads
+}
+
+// runTTY runs the code of reload on a terminal in the container, sending
+// its output and then its exit line to output until done is closed
+func (s *WatchStep) runTTY(client watchClient, containerID string, reload int, output chan<- string, done <-chan struct{}) {
+	script, ok := s.ttyScripts.take(reload)
+	if !ok {
+		return
+	}
+	// Our shell wrote the environment, the exec needs the same one to read it
+	shell := "/bin/sh"
+	if container, err := client.InspectContainer(containerID); err == nil && container.Config != nil && len(container.Config.Cmd) > 0 {
+		shell = container.Config.Cmd[0]
+	}
+	code, err := client.ExecTTY(containerID, []string{shell, "-c", script}, &ttyOutput{out: output, done: done})
+	if err != nil {
+		s.logger.Errorln("Unable to run the code on a terminal:", err)
+		code = ttyExecFailed
+	}
+	select {
+	case output <- fmt.Sprintf("%s %d %d\n", s.exitSentinel(), reload, code):
+	case <-done:
+	}
+}
+
+// ttyOutput hands what the exec writes to the listener, dropping it once
+// the step is done
+type ttyOutput struct {
+	out  chan<- string
+	done <-chan struct{}
+}
+
+func (w *ttyOutput) Write(p []byte) (int, error) {
+	select {
+	case w.out <- string(p):
+		return len(p), nil
+	case <-w.done:
+		return 0, io.ErrClosedPipe
+	}
+}
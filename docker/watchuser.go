@@ -0,0 +1,70 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// validUserName is what the user key takes, names and numeric ids, so it
+// can go in messages unquoted
+var validUserName = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._-]*$`)
+
+// userMissing is what the code exits with when the user key names a user
+// the container doesn't have
+const userMissing = 67
+
+// asUser runs cmd as the user key says, or as is without one. Our session
+// keeps running as the container's user, only the code switches, with
+// gosu or su-exec if the box has them and su otherwise. Switching needs
+// root unless the container runs as that user already, su would sit there
+// asking for a password on our stdin.
+func (s *WatchStep) asUser(cmd string) string {
+	if s.config.User == "" {
+		return cmd
+	}
+	user, quoted := s.config.User, shellQuote(cmd)
+	return fmt.Sprintf(`if ! id -u %[1]s >/dev/null 2>&1; then echo "user: %[1]s doesn't exist in the container" >&2; (exit %[3]d); elif [ "$(id -u)" = "$(id -u %[1]s)" ]; then %[4]s
+elif [ "$(id -u)" != 0 ]; then echo "user: switching to %[1]s needs root, the container runs as $(id -un)" >&2; (exit %[3]d); elif command -v gosu >/dev/null 2>&1; then gosu %[1]s sh -c %[2]s; elif command -v su-exec >/dev/null 2>&1; then su-exec %[1]s sh -c %[2]s; else su -s /bin/sh %[1]s -c %[2]s; fi`, user, quoted, userMissing, cmd)
+}
+
+// checkUser fails if the container doesn't have the user key's user, so
+// the step stops with a clear error rather than every run failing. A
+// dry-run runs nothing as the user, so it has nothing to check.
+func (s *WatchStep) checkUser(containerID string) error {
+	if s.config.User == "" || s.config.DryRun {
+		return nil
+	}
+	client, err := s.dockerClient()
+	if err != nil {
+		return err
+	}
+	var output bytes.Buffer
+	codes, err := client.ExecAll(containerID, [][]string{{"/bin/sh", "-c", "id -u " + s.config.User}}, &output)
+	if err != nil {
+		return err
+	}
+	switch codes[0] {
+	case 0:
+		return nil
+	case 127:
+		// Each run says so if the user really is missing
+		s.logger.Debugln("Unable to check the user, the container has no id")
+		return nil
+	}
+	return WatchConfigError{fmt.Errorf("user: %s doesn't exist in the container", s.config.User)}
+}
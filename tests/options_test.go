@@ -101,6 +101,22 @@ func (s *OptionsSuite) TestGlobalOptions() {
 	run(s, globalFlags, emptyFlags, test, args)
 }
 
+func (s *OptionsSuite) TestLogTimestamps() {
+	for _, flags := range [][]string{{}, {"--journal"}, {"--debug"}} {
+		args := append(append([]string{"wercker", "--log-timestamps", "relative"}, flags...), "test")
+		test := func(c *cli.Context) {
+			opts, err := core.NewGlobalOptions(util.NewCLISettings(c), emptyEnv())
+			s.Require().Nil(err)
+			if len(flags) == 0 {
+				s.Equal(util.TimestampsRelative, opts.LogTimestamps)
+			} else {
+				s.Equal("", opts.LogTimestamps, "%v keeps its own time", flags)
+			}
+		}
+		run(s, globalFlags, emptyFlags, test, args)
+	}
+}
+
 func (s *OptionsSuite) TestGuessAuthToken() {
 	tmpFile, err := ioutil.TempFile("", "test-auth-token")
 	s.Nil(err)
@@ -0,0 +1,222 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ClockSuite struct {
+	*TestSuite
+}
+
+func TestClockSuite(t *testing.T) {
+	suiteTester := &ClockSuite{&TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *ClockSuite) TestFakeClock() {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	after := clock.After(time.Second)
+	timer := clock.NewTimer(2 * time.Second)
+
+	clock.Advance(999 * time.Millisecond)
+	s.False(Fired(after))
+	clock.Advance(time.Millisecond)
+	s.True(Fired(after))
+	s.False(Fired(timer.C()))
+	s.Equal(start.Add(time.Second), clock.Now())
+
+	s.True(timer.Stop())
+	clock.Advance(time.Minute)
+	s.False(Fired(timer.C()))
+
+	s.False(timer.Reset(time.Second))
+	clock.Advance(time.Second)
+	s.True(Fired(timer.C()))
+	s.True(Fired(clock.After(0)))
+}
+
+func (s *ClockSuite) TestDebouncer() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	debounce := NewDebouncerWithClock(2*time.Second, clock)
+
+	debounce.Trigger()
+	s.True(Fired(debounce.C), "fires on the first trigger")
+	debounce.Trigger()
+	clock.Advance(time.Second)
+	debounce.Trigger()
+	s.False(Fired(debounce.C), "silent while settling")
+
+	clock.Advance(time.Second)
+	debounce.Trigger()
+	s.True(Fired(debounce.C), "fires again once settled")
+}
+
+func (s *ClockSuite) TestCoalescingDebouncer() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	debounce := NewCoalescingDebouncer(time.Second, 3*time.Second, clock)
+
+	debounce.Trigger()
+	s.False(Fired(debounce.C), "waits for the triggers to stop")
+	clock.Advance(500 * time.Millisecond)
+	debounce.Trigger()
+	clock.Advance(900 * time.Millisecond)
+	s.False(Fired(debounce.C), "the second trigger moved it")
+	clock.Advance(100 * time.Millisecond)
+	s.True(Fired(debounce.C), "settled")
+
+	// a trigger every half second never settles, maxWait cuts it off
+	for i := 0; i < 6; i++ {
+		debounce.Trigger()
+		s.False(Fired(debounce.C))
+		clock.Advance(500 * time.Millisecond)
+	}
+	s.True(Fired(debounce.C), "fires maxWait after the first trigger")
+	debounce.Trigger()
+	s.False(Fired(debounce.C), "starts over")
+	clock.Advance(time.Second)
+	s.True(Fired(debounce.C))
+}
+
+func (s *ClockSuite) TestThrottler() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	throttle := NewThrottler(2*time.Second, clock)
+
+	throttle.Trigger()
+	s.True(Fired(throttle.C), "fires on the first trigger")
+	clock.Advance(time.Second)
+	throttle.Trigger()
+	throttle.Trigger()
+	s.False(Fired(throttle.C), "held for the rest of the period")
+	clock.Advance(time.Second)
+	s.True(Fired(throttle.C), "the held triggers are sent once")
+	s.False(Fired(throttle.C))
+
+	// The send at the end of the period starts another one
+	clock.Advance(time.Second)
+	throttle.Trigger()
+	s.False(Fired(throttle.C))
+	clock.Advance(time.Second)
+	s.True(Fired(throttle.C))
+
+	clock.Advance(time.Minute)
+	s.False(Fired(throttle.C), "nothing held")
+	throttle.Trigger()
+	s.True(Fired(throttle.C), "quiet long enough to fire right away")
+
+	throttle.Trigger()
+	throttle.Flush()
+	s.True(Fired(throttle.C), "flushed")
+	clock.Advance(time.Second)
+	throttle.Trigger()
+	s.False(Fired(throttle.C), "a flush starts a period too")
+	throttle.Stop()
+	clock.Advance(time.Minute)
+	s.False(Fired(throttle.C))
+}
+
+func (s *ClockSuite) TestDebouncerStop() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	debounce := NewCoalescingDebouncer(time.Second, 3*time.Second, clock)
+	debounce.Trigger()
+	debounce.Stop()
+	clock.Advance(time.Minute)
+	s.False(Fired(debounce.C), "the pending send is cancelled")
+	debounce.Trigger()
+	clock.Advance(time.Minute)
+	s.False(Fired(debounce.C), "triggers after Stop do nothing")
+	debounce.Stop()
+
+	plain := NewDebouncerWithClock(time.Second, clock)
+	plain.Stop()
+	plain.Trigger()
+	s.False(Fired(plain.C))
+
+	// Real timers don't get a goroutine of their own, stopping a lot of
+	// debouncers mid-wait leaves nothing running
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		d := NewCoalescingDebouncer(time.Hour, time.Hour, RealClock)
+		d.Trigger()
+		d.Stop()
+		d.Stop()
+	}
+	s.True(runtime.NumGoroutine() <= before)
+}
+
+func (s *ClockSuite) TestDebouncerFlush() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	debounce := NewCoalescingDebouncer(time.Second, 3*time.Second, clock)
+
+	debounce.Flush()
+	s.False(Fired(debounce.C), "nothing pending")
+	debounce.Trigger()
+	debounce.Flush()
+	s.True(Fired(debounce.C), "sent without waiting")
+	clock.Advance(time.Minute)
+	s.False(Fired(debounce.C), "only once")
+	debounce.Flush()
+	s.False(Fired(debounce.C))
+
+	debounce.Trigger()
+	clock.Advance(500 * time.Millisecond)
+	s.False(Fired(debounce.C), "a trigger after a flush waits again")
+	clock.Advance(500 * time.Millisecond)
+	s.True(Fired(debounce.C))
+
+	plain := NewDebouncerWithClock(time.Second, clock)
+	plain.Trigger()
+	plain.Flush()
+	s.True(Fired(plain.C))
+	s.False(Fired(plain.C))
+}
+
+func (s *ClockSuite) TestDebouncerUnreadSend() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	debounce := NewCoalescingDebouncer(time.Second, 3*time.Second, clock)
+
+	// Fired, but the trigger comes before anyone read it
+	debounce.Trigger()
+	clock.Advance(time.Second)
+	debounce.Trigger()
+	s.False(Fired(debounce.C), "the unread send waits for this trigger")
+	clock.Advance(time.Second)
+	s.True(Fired(debounce.C), "one send for both")
+	clock.Advance(time.Minute)
+	s.False(Fired(debounce.C), "and no stale one")
+
+	// Taking the send back doesn't get around maxWait
+	debounce.Trigger()
+	for i := 0; i < 6; i++ {
+		clock.Advance(500 * time.Millisecond)
+		debounce.Trigger()
+	}
+	s.True(Fired(debounce.C), "due maxWait after the first trigger")
+	s.False(Fired(debounce.C))
+
+	throttle := NewThrottler(2*time.Second, clock)
+	throttle.Trigger()
+	clock.Advance(time.Second)
+	throttle.Trigger()
+	s.True(Fired(throttle.C), "the leading send is still there")
+	clock.Advance(time.Minute)
+	s.False(Fired(throttle.C), "it covers the trigger after it")
+}
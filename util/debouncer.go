@@ -14,41 +14,201 @@
 
 package util
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 // Debouncer silences repeated triggers for settlePeriod
 // and sends the current time on first trigger to C
 // C is the public read only channel, c is the private r/w chan
+//
+// A coalescing Debouncer waits instead, it sends once triggers have stopped
+// for settlePeriod or maxWait after the first of them, whichever is sooner.
+//
+// A throttling Debouncer sends on the first trigger right away and then
+// holds the triggers of the next settlePeriod, if there were any it sends
+// once more when the period is up, so the last of a burst isn't lost.
+//
+// After Stop nothing is sent anymore, C stays open so a select on it just
+// never fires.
 type Debouncer struct {
+	mutex        sync.Mutex
+	stopped      bool
 	C            <-chan time.Time
 	c            chan time.Time
 	settlePeriod time.Duration
-	settling     bool
+	settleUntil  time.Time
+	clock        Clock
+
+	// Only used when coalescing or throttling, C is timer's channel then
+	throttle bool
+	maxWait  time.Duration
+	timer    ClockTimer
+	first    time.Time
+	fireAt   time.Time
 }
 
 // NewDebouncer constructor
 func NewDebouncer(d time.Duration) *Debouncer {
+	return NewDebouncerWithClock(d, RealClock)
+}
+
+// NewDebouncerWithClock constructor for a debouncer on a specific clock
+func NewDebouncerWithClock(d time.Duration, clock Clock) *Debouncer {
 	c := make(chan time.Time, 1)
 	return &Debouncer{
 		C:            c,
 		c:            c,
 		settlePeriod: d,
-		settling:     false,
+		clock:        clock,
+	}
+}
+
+// NewCoalescingDebouncer constructor for a debouncer that collapses a
+// stream of triggers into one send, however long the stream lasts the send
+// comes at most maxWait after it started
+func NewCoalescingDebouncer(d, maxWait time.Duration, clock Clock) *Debouncer {
+	timer := clock.NewTimer(d)
+	timer.Stop()
+	return &Debouncer{
+		C:            timer.C(),
+		settlePeriod: d,
+		clock:        clock,
+		maxWait:      maxWait,
+		timer:        timer,
+	}
+}
+
+// NewThrottler constructor for a debouncer that sends on the leading edge of
+// a stream of triggers, at most once per d
+func NewThrottler(d time.Duration, clock Clock) *Debouncer {
+	timer := clock.NewTimer(d)
+	timer.Stop()
+	return &Debouncer{
+		C:            timer.C(),
+		settlePeriod: d,
+		clock:        clock,
+		throttle:     true,
+		timer:        timer,
 	}
 }
 
 // Trigger tells us we should do the thing we're waiting on
 func (d *Debouncer) Trigger() {
-	if d.settling {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return
+	}
+	now := d.clock.Now()
+	if d.throttle {
+		d.hold(now)
+		return
+	}
+	if d.timer != nil {
+		d.coalesce(now)
 		return
 	}
-	d.settling = true
-	time.AfterFunc(d.settlePeriod, func() {
-		d.settling = false
-	})
+	if now.Before(d.settleUntil) {
+		return
+	}
+	d.settleUntil = now.Add(d.settlePeriod)
 	// Non-blocking send of time on c.
 	select {
-	case d.c <- time.Now():
+	case d.c <- now:
 	default:
 	}
 }
+
+// Stop cancels a pending send, triggers after it do nothing. Stopping
+// twice is fine.
+func (d *Debouncer) Stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return
+	}
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// Flush sends a pending trigger right away instead of waiting for it to
+// settle, without one pending it does nothing. Only a coalescing or
+// throttling Debouncer ever has a trigger pending, the plain one sends on
+// Trigger. Like Trigger and Stop it can be called from any goroutine.
+func (d *Debouncer) Flush() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped || d.timer == nil || d.first.IsZero() {
+		return
+	}
+	now := d.clock.Now()
+	if !now.Before(d.fireAt) {
+		return
+	}
+	d.first = time.Time{}
+	d.fireAt = now
+	d.settleUntil = now.Add(d.settlePeriod)
+	d.stopTimer()
+	d.timer.Reset(0)
+}
+
+// stopTimer stops the timer so it can be Reset, a send it already made
+// that nobody read is taken back. It says whether there was one.
+func (d *Debouncer) stopTimer() bool {
+	if d.timer.Stop() {
+		return false
+	}
+	select {
+	case <-d.timer.C():
+		return true
+	default:
+		return false
+	}
+}
+
+// hold sends right away unless a send was less than settlePeriod ago,
+// then one send is queued for when the period is up. settleUntil is when
+// the period after the last send, queued or not, is over.
+func (d *Debouncer) hold(now time.Time) {
+	if !d.first.IsZero() && now.Before(d.fireAt) {
+		// Already queued
+		return
+	}
+	if len(d.timer.C()) > 0 {
+		// Sent but not read yet, whoever reads it sees this trigger too
+		return
+	}
+	if !now.Before(d.settleUntil) {
+		d.first = time.Time{}
+		d.fireAt = now
+		d.settleUntil = now.Add(d.settlePeriod)
+		d.stopTimer()
+		d.timer.Reset(0)
+		return
+	}
+	d.first = now
+	d.fireAt = d.settleUntil
+	d.settleUntil = d.fireAt.Add(d.settlePeriod)
+	d.stopTimer()
+	d.timer.Reset(d.fireAt.Sub(now))
+}
+
+// coalesce moves the send to settlePeriod from now, but not past maxWait
+// after the first trigger. Once the send is read a trigger starts over, a
+// send nobody read yet is taken back and made again with this trigger.
+func (d *Debouncer) coalesce(now time.Time) {
+	unread := d.stopTimer()
+	if d.first.IsZero() || (!unread && !now.Before(d.fireAt)) {
+		d.first = now
+	}
+	fireAt := now.Add(d.settlePeriod)
+	if latest := d.first.Add(d.maxWait); fireAt.After(latest) {
+		fireAt = latest
+	}
+	d.fireAt = fireAt
+	d.timer.Reset(fireAt.Sub(now))
+}
@@ -96,6 +96,50 @@ func (e *Environment) Interpolate(s string) string {
 	return os.Expand(s, e.GetInclHidden)
 }
 
+// InterpolateDefined is Interpolate for shell commands: $VAR and ${VAR}
+// are only replaced if VAR is set, in this or the hidden environment, the
+// rest are left for the shell to expand, like $? or a loop variable. $$ is
+// a literal $.
+func (e *Environment) InterpolateDefined(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		if s[i+1] == '$' {
+			out = append(out, '$')
+			i++
+			continue
+		}
+		name, width := "", 0
+		if s[i+1] == '{' {
+			if end := strings.IndexByte(s[i+2:], '}'); end != -1 {
+				name, width = s[i+2:i+2+end], end+3
+			}
+		} else {
+			end := i + 1
+			for end < len(s) && isNameByte(s[end], end == i+1) {
+				end++
+			}
+			name, width = s[i+1:end], end-i
+		}
+		if value, ok := e.lookupInclHidden(name); ok && name != "" {
+			out = append(out, value...)
+			i += width - 1
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// isNameByte tells whether c can be part of a variable name, digits can't
+// start one
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || !first && c >= '0' && c <= '9'
+}
+
 var mirroredEnv = [...]string{
 	"WERCKER_STARTED_BY",
 	"WERCKER_MAIN_PIPELINE_STARTED",
@@ -141,17 +185,23 @@ func (e *Environment) GetMirror() [][]string {
 // GetInclHidden gets an individual record either from this environment or the
 // hidden environment.
 func (e *Environment) GetInclHidden(key string) string {
+	val, _ := e.lookupInclHidden(key)
+	return val
+}
+
+// lookupInclHidden is GetInclHidden telling whether key is set at all
+func (e *Environment) lookupInclHidden(key string) (string, bool) {
 	if e.Map != nil {
 		if val, ok := e.Map[key]; ok {
-			return val
+			return val, true
 		}
 	}
 
 	if e.Hidden != nil && e.Hidden.Map != nil {
 		if val, ok := e.Hidden.Map[key]; ok {
-			return val
+			return val, true
 		}
 	}
 
-	return ""
+	return "", false
 }
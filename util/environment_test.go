@@ -57,6 +57,23 @@ func (s *EnvironmentSuite) TestInterpolate() {
 	s.Equal(env.Interpolate("one two $PUBLIC bar"), "one two foo bar", "interpolation should work in middle of string.")
 }
 
+func (s *EnvironmentSuite) TestInterpolateDefined() {
+	env := NewEnvironment("PORT=8080", "EMPTY=", "APP_1=api")
+	env.Hidden.Update([][]string{{"TOKEN", "s3cret"}})
+
+	s.Equal("./server -port 8080", env.InterpolateDefined("./server -port $PORT"))
+	s.Equal("8080/api", env.InterpolateDefined("${PORT}/$APP_1"))
+	s.Equal("s3cret", env.InterpolateDefined("$TOKEN"), "hidden ones too")
+	s.Equal("[]", env.InterpolateDefined("[$EMPTY]"), "set but empty")
+
+	// Undefined variables are left for the shell in the container
+	s.Equal("echo $UNSET ${UNSET} $? $1 $", env.InterpolateDefined("echo $UNSET ${UNSET} $? $1 $"))
+	s.Equal("for f in *; do echo $f; done", env.InterpolateDefined("for f in *; do echo $f; done"))
+	s.Equal("${broken", env.InterpolateDefined("${broken"))
+
+	s.Equal("cost: $PORT $8080", env.InterpolateDefined("cost: $$PORT $$$PORT"), "$$ is a literal $")
+}
+
 func (s *EnvironmentSuite) TestOrdered() {
 	env := NewEnvironment("PUBLIC=foo", "X_PRIVATE=zed")
 	expected := [][]string{[]string{"PUBLIC", "foo"}, []string{"X_PRIVATE", "zed"}}
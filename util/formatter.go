@@ -17,6 +17,7 @@ package util
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 const (
@@ -24,27 +25,94 @@ const (
 	failColor    = "\x1b[31m"
 	varColor     = "\x1b[33m"
 	reset        = "\x1b[m"
+	clearScreen  = "\x1b[H\x1b[2J"
 )
 
+const (
+	// TimestampsRFC3339 prefixes messages with the wall clock time
+	TimestampsRFC3339 = "rfc3339"
+	// TimestampsRelative prefixes messages with the time since wercker started
+	TimestampsRelative = "relative"
+)
+
+// ValidTimestampMode checks whether mode can be used as Formatter.Timestamps
+func ValidTimestampMode(mode string) bool {
+	return mode == "" || mode == TimestampsRFC3339 || mode == TimestampsRelative
+}
+
 // Formatter formats the messages, and optionally disabling colors. See
-// FormatMessage for the structure of messages.
+// FormatMessage for the structure of messages. If Timestamps is set to one
+// of the Timestamps* modes every message is prefixed with a timestamp.
 type Formatter struct {
 	ShowColors bool
+	Timestamps string
 }
 
 // Info uses no color.
 func (f *Formatter) Info(messages ...string) string {
-	return FormatMessage("", f.ShowColors, messages...)
+	return f.Prefix(FormatMessage("", f.ShowColors, messages...))
 }
 
 // Success uses successColor (green) as color.
 func (f *Formatter) Success(messages ...string) string {
-	return FormatMessage(successColor, f.ShowColors, messages...)
+	return f.Prefix(FormatMessage(successColor, f.ShowColors, messages...))
 }
 
 // Fail uses failColor (red) as color.
 func (f *Formatter) Fail(messages ...string) string {
-	return FormatMessage(failColor, f.ShowColors, messages...)
+	return f.Prefix(FormatMessage(failColor, f.ShowColors, messages...))
+}
+
+// IsTerminal tells whether our output goes to a terminal, so things like
+// spinners can fall back to plain lines in CI logs.
+func (f *Formatter) IsTerminal() bool {
+	return isTerminal
+}
+
+// ClearScreen returns the escape codes that clear the terminal, nothing if
+// our output doesn't go to one so CI logs stay clean.
+func (f *Formatter) ClearScreen() string {
+	if !f.IsTerminal() {
+		return ""
+	}
+	return clearScreen
+}
+
+// Timestamp returns the timestamp prefix for the current time, or an empty
+// string if timestamps are disabled.
+func (f *Formatter) Timestamp() string {
+	var ts string
+	switch f.Timestamps {
+	case TimestampsRFC3339:
+		ts = time.Now().Format(time.RFC3339)
+	case TimestampsRelative:
+		ts = fmt.Sprintf("+%.3fs", time.Since(baseTimestamp).Seconds())
+	default:
+		return ""
+	}
+	if f.ShowColors {
+		return fmt.Sprintf("%s[%s]%s ", varColor, ts, reset)
+	}
+	return fmt.Sprintf("[%s] ", ts)
+}
+
+// Prefix adds the timestamp prefix to the start of each line in s, a
+// trailing newline is not considered the start of a new line.
+func (f *Formatter) Prefix(s string) string {
+	ts := f.Timestamp()
+	if ts == "" || s == "" {
+		return s
+	}
+	trailing := strings.HasSuffix(s, "\n")
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = ts + line
+	}
+	prefixed := strings.Join(lines, "\n")
+	if trailing {
+		prefixed += "\n"
+	}
+	return prefixed
 }
 
 // FormatMessage handles one or two messages. If more messages are used, those
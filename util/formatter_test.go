@@ -0,0 +1,65 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FormatterSuite struct {
+	*TestSuite
+}
+
+func TestFormatterSuite(t *testing.T) {
+	suiteTester := &FormatterSuite{&TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *FormatterSuite) TestNoTimestamps() {
+	f := &Formatter{}
+	s.Equal("--> Reloading", f.Info("Reloading"))
+	s.Equal("line one\nline two\n", f.Prefix("line one\nline two\n"))
+}
+
+func (s *FormatterSuite) TestRelativeTimestamps() {
+	f := &Formatter{Timestamps: TimestampsRelative}
+	prefixed := f.Prefix("line one\nline two\n")
+	s.Regexp(regexp.MustCompile(`^\[\+[0-9.]+s\] line one\n\[\+[0-9.]+s\] line two\n$`), prefixed)
+	s.Regexp(regexp.MustCompile(`^\[\+[0-9.]+s\] --> Reloading$`), f.Info("Reloading"))
+}
+
+func (s *FormatterSuite) TestRFC3339Timestamps() {
+	f := &Formatter{Timestamps: TimestampsRFC3339}
+	s.Regexp(regexp.MustCompile(`^\[\d{4}-\d{2}-\d{2}T[^\]]+\] output$`), f.Prefix("output"))
+}
+
+func (s *FormatterSuite) TestValidTimestampMode() {
+	s.True(ValidTimestampMode(""))
+	s.True(ValidTimestampMode(TimestampsRFC3339))
+	s.True(ValidTimestampMode(TimestampsRelative))
+	s.False(ValidTimestampMode("unix"))
+}
+
+func (s *FormatterSuite) TestClearScreen() {
+	defer func(was bool) { isTerminal = was }(isTerminal)
+	f := &Formatter{Timestamps: TimestampsRelative}
+	isTerminal = false
+	s.Equal("", f.ClearScreen(), "not on a terminal")
+	isTerminal = true
+	s.Equal("\x1b[H\x1b[2J", f.ClearScreen())
+}
@@ -21,13 +21,23 @@ import (
 )
 
 // SignalHandler is a little struct to hold our signal handling functions
-// and an identifier so we can remove it from the list.
+// and an identifier so we can remove it from the list. A Persistent
+// handler isn't removed when it is called, it gets every signal until it
+// is removed, e.g. to treat a second Ctrl-C differently from the first.
 type SignalHandler struct {
-	ID string
-	F  func() bool
+	ID         string
+	F          func() bool
+	Persistent bool
 }
 
 // SignalMonkey is a LIFO, cascading, singleton for dispatching signal handlers
+//
+// The handler added last is called first, returning false keeps the ones
+// added before it from being called for that signal. Add and Remove wait
+// for a Dispatch that is running, so a handler must not call them itself,
+// and once Remove returns the handler won't be called again. A signal that
+// comes in while the handlers of the previous one are still running exits
+// right away, handlers should return quickly.
 type SignalMonkey struct {
 	signal   os.Signal
 	handlers []*SignalHandler
@@ -51,28 +61,35 @@ func (s *SignalMonkey) Add(fn *SignalHandler) {
 func (s *SignalMonkey) Remove(fn *SignalHandler) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	for i, x := range s.handlers {
-		if x.ID == fn.ID {
-			// Delete preserving order from here:
-			// https://code.google.com/p/go-wiki/wiki/SliceTricks
-			copy(s.handlers[i:], s.handlers[i+1:])
-			s.handlers[len(s.handlers)-1] = nil // or the zero value of T
-			s.handlers = s.handlers[:len(s.handlers)-1]
+	// Filter in place preserving order, removing while ranging over the
+	// slice would read the nil left at its end
+	kept := s.handlers[:0]
+	for _, x := range s.handlers {
+		if x.ID != fn.ID {
+			kept = append(kept, x)
 		}
 	}
+	for i := len(kept); i < len(s.handlers); i++ {
+		s.handlers[i] = nil
+	}
+	s.handlers = kept
 }
 
 // Dispatch calls the handlers LIFO, removing them from the list as it does
-// if any returns false, it stops processing further handlers.
+// unless they are Persistent, if any returns false, it stops processing
+// further handlers.
 func (s *SignalMonkey) Dispatch() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	for len(s.handlers) > 0 {
-		// Pop from:
-		// https://code.google.com/p/go-wiki/wiki/SliceTricks
-		fn, a := s.handlers[len(s.handlers)-1], s.handlers[:len(s.handlers)-1]
-		s.handlers = a
+	for i := len(s.handlers) - 1; i >= 0; i-- {
+		fn := s.handlers[i]
+		if !fn.Persistent {
+			// Only the handlers above i moved, we're done with them
+			copy(s.handlers[i:], s.handlers[i+1:])
+			s.handlers[len(s.handlers)-1] = nil
+			s.handlers = s.handlers[:len(s.handlers)-1]
+		}
 
 		result := fn.F()
 		if result == false {
@@ -108,6 +125,8 @@ func (s *SignalMonkey) Register(sig os.Signal) {
 
 var globalSigint = NewSignalMonkey()
 var globalSigterm = NewSignalMonkey()
+var globalSigusr1 = NewSignalMonkey()
+var globalSigusr2 = NewSignalMonkey()
 
 // GlobalSigint returns the sigint registry
 func GlobalSigint() *SignalMonkey {
@@ -118,3 +137,13 @@ func GlobalSigint() *SignalMonkey {
 func GlobalSigterm() *SignalMonkey {
 	return globalSigterm
 }
+
+// GlobalSigusr1 returns the sigusr1 registry
+func GlobalSigusr1() *SignalMonkey {
+	return globalSigusr1
+}
+
+// GlobalSigusr2 returns the sigusr2 registry
+func GlobalSigusr2() *SignalMonkey {
+	return globalSigusr2
+}
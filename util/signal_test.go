@@ -0,0 +1,72 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SignalSuite struct {
+	*TestSuite
+}
+
+func TestSignalSuite(t *testing.T) {
+	suiteTester := &SignalSuite{&TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *SignalSuite) TestDispatch() {
+	monkey := NewSignalMonkey()
+	called := []string{}
+	handler := func(id string, cascade, persistent bool) *SignalHandler {
+		return &SignalHandler{ID: id, Persistent: persistent, F: func() bool {
+			called = append(called, id)
+			return cascade
+		}}
+	}
+	monkey.Add(handler("cleanup", true, false))
+	monkey.Add(handler("watch", false, true))
+	monkey.Add(handler("pull", true, false))
+
+	monkey.Dispatch()
+	s.Equal([]string{"pull", "watch"}, called, "last added first, watch stops the cascade")
+	monkey.Dispatch()
+	s.Equal([]string{"pull", "watch", "watch"}, called, "watch is still there, pull isn't")
+
+	monkey.Remove(&SignalHandler{ID: "watch"})
+	monkey.Dispatch()
+	s.Equal([]string{"pull", "watch", "watch", "cleanup"}, called)
+	monkey.Dispatch()
+	s.Len(called, 4, "no handlers left")
+}
+
+func (s *SignalSuite) TestRemoveBelowTop() {
+	monkey := NewSignalMonkey()
+	called := []string{}
+	for _, id := range []string{"cleanup", "pause", "status"} {
+		id := id
+		monkey.Add(&SignalHandler{ID: id, F: func() bool {
+			called = append(called, id)
+			return true
+		}})
+	}
+
+	monkey.Remove(&SignalHandler{ID: "pause"})
+	monkey.Remove(&SignalHandler{ID: "cleanup"})
+	monkey.Dispatch()
+	s.Equal([]string{"status"}, called)
+}
@@ -38,8 +38,9 @@ func (s *TestSuite) SetupTest() {
 // TearDownTest cleans up our working dir if we made one
 func (s *TestSuite) TearDownTest() {
 	if s.workingDir != "" {
+		workingDir := s.workingDir
 		s.workingDir = ""
-		err := os.RemoveAll(s.WorkingDir())
+		err := os.RemoveAll(workingDir)
 		if err != nil {
 			s.T().Error(err.Error())
 		}
@@ -111,6 +112,16 @@ func setupTestLogging(t *testing.T) {
 	rootLogger.Formatter = NewTestLogFormatter()
 }
 
+// Fired tells whether c has a value ready, without waiting for one
+func Fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
 // Stepper lets use step and sync goroutines
 type Stepper struct {
 	stepper chan struct{}